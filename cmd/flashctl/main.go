@@ -0,0 +1,112 @@
+// Command flashctl runs administrative tasks against the flash sale databases.
+//
+//	flashctl reconcile [-dry-run]
+//
+// reconcile rebuilds the Redis state of every active sale (sold flags, purchase counters
+// and live reservations) from Postgres and prints the differences it found as JSON.
+// With -dry-run nothing is written.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"flash/internal/config"
+	"flash/internal/domain"
+	"flash/internal/repository/postgres"
+	"flash/internal/repository/redis"
+	"flash/internal/service"
+	"flash/pkg/database"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: flashctl reconcile [-dry-run]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	switch os.Args[1] {
+	case "reconcile":
+		fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only report differences, do not modify Redis")
+		fs.Parse(os.Args[2:])
+		reconcile(ctx, *dryRun)
+	default:
+		usage()
+	}
+}
+
+func reconcile(ctx context.Context, dryRun bool) {
+	svc := newService(ctx)
+
+	drifts, err := svc.ReconcileRedis(ctx, dryRun)
+	if err != nil {
+		log.Fatalf("Reconciliation error: %v", err)
+	}
+
+	total := 0
+	for _, drift := range drifts {
+		total += drift.Count()
+	}
+	if drifts == nil {
+		drifts = []*domain.SaleDrift{}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(drifts); err != nil {
+		log.Fatalf("Encoding report failed: %v", err)
+	}
+	if dryRun {
+		log.Printf("Dry run: %d differences in %d sales, nothing was changed", total, len(drifts))
+	} else {
+		log.Printf("Repaired %d differences in %d sales", total, len(drifts))
+	}
+}
+
+func newService(ctx context.Context) *service.FlashSaleService {
+	// flashctl only talks to Postgres and Redis, so it runs without the keys that authenticate requests
+	cfg, err := config.LoadWithoutAuth()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dbPool, err := database.NewPostgresPool(ctx, cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Database connection error: %v", err)
+	}
+	redisClient, err := database.NewRedisClient(ctx, cfg.Redis.Addr, cfg.Redis.Password)
+	if err != nil {
+		log.Fatalf("Redis connection error: %v", err)
+	}
+
+	redisRepo := redis.NewRedisRepository(redisClient, cfg.ReservationTimeout)
+	if err := redisRepo.LoadScripts(ctx); err != nil {
+		log.Fatalf("Redis script load error: %v", err)
+	}
+	return service.NewFlashSaleService(postgres.NewPostgresRepository(dbPool), redisRepo, service.Options{
+		SaleDefaults: domain.SaleLimits{
+			ItemQuota:                 cfg.SaleDefaults.ItemQuota,
+			PerUserLimit:              cfg.SaleDefaults.PerUserLimit,
+			MaxConcurrentReservations: cfg.SaleDefaults.MaxConcurrentReservations,
+		},
+		IdempotencyTTL:     cfg.IdempotencyTTL,
+		ReservationTimeout: cfg.ReservationTimeout,
+		Consistency: service.ConsistencyOptions{
+			Interval:   cfg.Consistency.Interval,
+			SampleSize: cfg.Consistency.SampleSize,
+			Repair:     cfg.Consistency.Repair,
+		},
+		NodeID:               cfg.Finalization.NodeID,
+		FinalizationLeaseTTL: cfg.Finalization.LeaseTTL,
+	})
+}
@@ -8,8 +8,12 @@ import (
 	"os/signal"
 	"syscall"
 
+	"flash/internal/auth"
 	"flash/internal/config"
+	"flash/internal/domain"
 	"flash/internal/handler/http"
+	"flash/internal/notify"
+	"flash/internal/payment"
 	"flash/internal/repository/postgres"
 	"flash/internal/repository/redis"
 	"flash/internal/service"
@@ -35,6 +39,26 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Authenticate users from their bearer tokens, unless explicitly disabled
+	var verifier *auth.Verifier
+	if cfg.Auth.Disabled {
+		log.Println("Authentication is disabled: the user_id query parameter is trusted")
+	} else {
+		keys, err := auth.LoadKeys(auth.KeySources{
+			JWKSFile:           cfg.Auth.JWKSFile,
+			HS256Secret:        cfg.Auth.HS256Secret,
+			RS256PublicKeyFile: cfg.Auth.RS256PublicKeyFile,
+		})
+		if err != nil {
+			log.Fatalf("Auth key load error: %v", err)
+		}
+		verifier = auth.NewVerifier(keys, auth.VerifierOptions{
+			Issuer:   cfg.Auth.Issuer,
+			Audience: cfg.Auth.Audience,
+			Leeway:   cfg.Auth.Leeway,
+		})
+	}
+
 	// Setup Database & Redis Connections
 	dbPool, err := database.NewPostgresPool(ctx, cfg.DatabaseURL)
 	if err != nil {
@@ -55,14 +79,65 @@ func main() {
 	// Dependency Injection: Create instances of repositories, services, and handlers
 	pgRepo := postgres.NewPostgresRepository(dbPool)
 	redisRepo := redis.NewRedisRepository(redisClient, cfg.ReservationTimeout)
-	flashSaleSvc := service.NewFlashSaleService(pgRepo, redisRepo)
+	if err := redisRepo.LoadScripts(ctx); err != nil {
+		log.Fatalf("Redis script load error: %v", err)
+	}
+	rateLimits := make(map[string]domain.RateLimit, len(cfg.RateLimit.Routes))
+	for route, rule := range cfg.RateLimit.Routes {
+		rateLimits[route] = domain.RateLimit{Requests: rule.Requests, Window: rule.Window}
+	}
+	flashSaleSvc := service.NewFlashSaleService(pgRepo, redisRepo, service.Options{
+		SaleDefaults: domain.SaleLimits{
+			ItemQuota:                 cfg.SaleDefaults.ItemQuota,
+			PerUserLimit:              cfg.SaleDefaults.PerUserLimit,
+			MaxConcurrentReservations: cfg.SaleDefaults.MaxConcurrentReservations,
+		},
+		IdempotencyTTL:     cfg.IdempotencyTTL,
+		ReservationTimeout: cfg.ReservationTimeout,
+		AdmissionTTL:       cfg.AdmissionTTL,
+		Consistency: service.ConsistencyOptions{
+			Interval:   cfg.Consistency.Interval,
+			SampleSize: cfg.Consistency.SampleSize,
+			Repair:     cfg.Consistency.Repair,
+		},
+		NodeID:               cfg.Finalization.NodeID,
+		FinalizationLeaseTTL: cfg.Finalization.LeaseTTL,
+		Payments: payment.NewFakeProvider(payment.FakeOptions{
+			Latency:     cfg.Payment.FakeLatency,
+			DeclineRate: cfg.Payment.FakeDeclineRate,
+		}),
+		AuthorizationTimeout: cfg.Payment.AuthorizationTimeout,
+		Notifier:             notify.NewLogNotifier(),
+		RateLimits:           rateLimits,
+	})
+
+	// Rebuild sold flags, purchase counters and reservations if Redis lost its data
+	if err := flashSaleSvc.RestoreRedisIfEmpty(ctx); err != nil {
+		log.Fatalf("Redis restore error: %v", err)
+	}
 
 	// Start the background finalization process
-	go flashSaleSvc.RunHourlyFinalization(ctx)
+	go flashSaleSvc.RunFinalization(ctx)
+	go flashSaleSvc.RunReservationReaper(ctx)
+	go flashSaleSvc.RunOutboxRelay(ctx)
+	go flashSaleSvc.RunPaymentSettler(ctx)
+	go flashSaleSvc.RunLotteryDrawer(ctx)
+	go flashSaleSvc.RunWaitlistServer(ctx)
+	go flashSaleSvc.RunConsistencyChecker(ctx)
+	go flashSaleSvc.RunSaleEventListener(ctx)
+	statusFlushed := make(chan struct{})
+	go func() {
+		flashSaleSvc.RunStatusFlusher(ctx)
+		close(statusFlushed)
+	}()
 
 	// Setup and start the HTTP server
 	addr := fmt.Sprintf(":%s", cfg.Port)
-	server, err := http.NewServer(addr, flashSaleSvc)
+	server, err := http.NewServer(addr, flashSaleSvc, http.ServerOptions{
+		AdminToken:        cfg.AdminToken,
+		TrustForwardedFor: cfg.RateLimit.TrustForwardedFor,
+		Verifier:          verifier,
+	})
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
@@ -72,5 +147,9 @@ func main() {
 		log.Printf("Server error: %v", err)
 	}
 
+	// Wait for the final flush of the status counters to Redis
+	cancel()
+	<-statusFlushed
+
 	log.Println("Server stopped gracefully")
 }
@@ -0,0 +1,17 @@
+// Package auth authenticates the users requests are made by from signed JSON Web Tokens.
+package auth
+
+import "context"
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx that carries the ID of the authenticated user.
+func WithUser(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userKey{}, userID)
+}
+
+// UserFromContext returns the ID of the authenticated user ctx carries, if any.
+func UserFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userKey{}).(string)
+	return userID, ok && userID != ""
+}
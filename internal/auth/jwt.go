@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Algorithms tokens can be signed with.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+// Claims are the registered claims of a token the service checks. Subject is the user's ID.
+type Claims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  audience    `json:"aud"`
+	ExpiresAt NumericDate `json:"exp"`
+	NotBefore NumericDate `json:"nbf"`
+}
+
+// NumericDate is a time in seconds since the epoch, which may come with a fraction.
+type NumericDate int64
+
+func (d *NumericDate) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+	*d = NumericDate(math.Floor(seconds))
+	return nil
+}
+
+// Time returns the date as a time, or the zero time when it is not set.
+func (d NumericDate) Time() time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(d), 0)
+}
+
+// audience is the aud claim, which is either a single string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// VerifierOptions configures a Verifier.
+type VerifierOptions struct {
+	// Issuer, when set, is the iss claim every token must carry.
+	Issuer string
+	// Audience, when set, must be one of the aud claim of every token.
+	Audience string
+	// Leeway tolerates clock skew between the issuer and the service in the exp and nbf checks.
+	Leeway time.Duration
+}
+
+// Verifier checks the signature and the claims of tokens. A token is verified with the keys of
+// the algorithm its header names, and only with the key its kid names when it names one, so an
+// HMAC secret can never verify an RS256 token or the other way round.
+type Verifier struct {
+	keys []Key
+	opts VerifierOptions
+	now  func() time.Time
+}
+
+func NewVerifier(keys []Key, opts VerifierOptions) *Verifier {
+	return &Verifier{keys: keys, opts: opts, now: time.Now}
+}
+
+// Verify returns the claims of a compact serialized token once its signature, expiry, issuer and
+// audience check out. Tokens without an expiry or a subject are rejected.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	var head header
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	if err := v.verifySignature(head, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (v *Verifier) verifySignature(head header, signed string, signature []byte) error {
+	if head.Algorithm != HS256 && head.Algorithm != RS256 {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, head.Algorithm)
+	}
+	digest := sha256.Sum256([]byte(signed))
+	for _, key := range v.keys {
+		if key.Algorithm != head.Algorithm || (head.KeyID != "" && key.ID != head.KeyID) {
+			continue
+		}
+		switch key.Algorithm {
+		case HS256:
+			if len(key.secret) < minHMACSecretSize {
+				continue
+			}
+			mac := hmac.New(sha256.New, key.secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return nil
+			}
+		case RS256:
+			if rsa.VerifyPKCS1v15(key.public, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: signature does not match any key", ErrInvalidToken)
+}
+
+func (v *Verifier) checkClaims(claims *Claims) error {
+	now := v.now()
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if !now.Before(claims.ExpiresAt.Time().Add(v.opts.Leeway)) {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(v.opts.Leeway).Before(claims.NotBefore.Time()) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if v.opts.Issuer != "" && claims.Issuer != v.opts.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if v.opts.Audience != "" && !slices.Contains(claims.Audience, v.opts.Audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testNow    = time.Unix(1_800_000_000, 0)
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+)
+
+// signToken returns a compact serialized token with the given header and claims. The signature
+// is HMAC-SHA256 with secret, or RSA PKCS #1 v1.5 with private when it is set.
+func signToken(t *testing.T, head, claims map[string]any, secret []byte, private *rsa.PrivateKey) string {
+	t.Helper()
+	segment := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := segment(head) + "." + segment(claims)
+
+	var signature []byte
+	if private != nil {
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else if secret != nil {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestVerify(t *testing.T) {
+	private := generateRSAKey(t)
+	other := generateRSAKey(t)
+	publicDER, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs256 := map[string]any{"alg": HS256, "typ": "JWT"}
+	rs256 := map[string]any{"alg": RS256, "typ": "JWT"}
+	valid := func() map[string]any {
+		return map[string]any{"sub": "user1", "exp": testNow.Add(time.Hour).Unix()}
+	}
+	with := func(key string, value any) map[string]any {
+		claims := valid()
+		claims[key] = value
+		return claims
+	}
+
+	hmacKeys := []Key{NewHMACKey("", testSecret)}
+	rsaKeys := []Key{NewRSAKey("", &private.PublicKey)}
+	bothKeys := append(append([]Key{}, hmacKeys...), rsaKeys...)
+
+	tests := []struct {
+		name    string
+		keys    []Key
+		opts    VerifierOptions
+		token   string
+		wantErr error
+	}{
+		{
+			name:  "valid HS256",
+			keys:  hmacKeys,
+			token: signToken(t, hs256, valid(), testSecret, nil),
+		},
+		{
+			name:  "valid RS256",
+			keys:  rsaKeys,
+			token: signToken(t, rs256, valid(), nil, private),
+		},
+		{
+			name:    "RS256 token with only an HMAC key",
+			keys:    hmacKeys,
+			token:   signToken(t, rs256, valid(), nil, private),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "HS256 token signed with the RSA public key",
+			keys:    bothKeys,
+			token:   signToken(t, hs256, valid(), publicDER, nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "unsupported algorithm",
+			keys:    bothKeys,
+			token:   signToken(t, map[string]any{"alg": "HS512"}, valid(), testSecret, nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "alg none",
+			keys:    bothKeys,
+			token:   signToken(t, map[string]any{"alg": "none"}, valid(), nil, nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "expired",
+			keys:    hmacKeys,
+			token:   signToken(t, hs256, with("exp", testNow.Add(-time.Minute).Unix()), testSecret, nil),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:  "expired within the leeway",
+			keys:  hmacKeys,
+			opts:  VerifierOptions{Leeway: 30 * time.Second},
+			token: signToken(t, hs256, with("exp", testNow.Add(-10*time.Second).Unix()), testSecret, nil),
+		},
+		{
+			name:    "no expiry",
+			keys:    hmacKeys,
+			token:   signToken(t, hs256, map[string]any{"sub": "user1"}, testSecret, nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "nbf in the future",
+			keys:    hmacKeys,
+			token:   signToken(t, hs256, with("nbf", testNow.Add(time.Minute).Unix()), testSecret, nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:  "nbf within the leeway",
+			keys:  hmacKeys,
+			opts:  VerifierOptions{Leeway: 30 * time.Second},
+			token: signToken(t, hs256, with("nbf", testNow.Add(10*time.Second).Unix()), testSecret, nil),
+		},
+		{
+			name:    "bad signature",
+			keys:    hmacKeys,
+			token:   signToken(t, hs256, valid(), []byte("fedcba9876543210fedcba9876543210"), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "tampered claims",
+			keys:    hmacKeys,
+			token:   tamper(t, signToken(t, hs256, valid(), testSecret, nil), with("sub", "admin")),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "HS256 secret shorter than 32 bytes",
+			keys:    []Key{NewHMACKey("", testSecret[:16])},
+			token:   signToken(t, hs256, valid(), testSecret[:16], nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "RS256 signed with another key",
+			keys:    rsaKeys,
+			token:   signToken(t, rs256, valid(), nil, other),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "kid names another key",
+			keys:    []Key{NewRSAKey("a", &private.PublicKey), NewRSAKey("b", &other.PublicKey)},
+			token:   signToken(t, map[string]any{"alg": RS256, "kid": "b"}, valid(), nil, private),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "unexpected issuer",
+			keys:    hmacKeys,
+			opts:    VerifierOptions{Issuer: "https://issuer.example"},
+			token:   signToken(t, hs256, with("iss", "https://other.example"), testSecret, nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:  "audience in a list",
+			keys:  hmacKeys,
+			opts:  VerifierOptions{Audience: "flash"},
+			token: signToken(t, hs256, with("aud", []string{"other", "flash"}), testSecret, nil),
+		},
+		{
+			name:    "malformed",
+			keys:    hmacKeys,
+			token:   "not-a-token",
+			wantErr: ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewVerifier(tt.keys, tt.opts)
+			verifier.now = func() time.Time { return testNow }
+
+			claims, err := verifier.Verify(tt.token)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if claims.Subject != "user1" {
+				t.Errorf("Subject = %q, want user1", claims.Subject)
+			}
+		})
+	}
+}
+
+// tamper replaces the claims of a signed token and keeps its signature.
+func tamper(t *testing.T, token string, claims map[string]any) string {
+	t.Helper()
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString(raw)
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// minHMACSecretSize is the shortest HS256 secret accepted, the size of the hash as RFC 7518 requires.
+const minHMACSecretSize = 32
+
+// Key is a key tokens are verified with. A key with an ID only verifies tokens whose kid names it
+// or that name no key at all.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	public    *rsa.PublicKey
+}
+
+// NewHMACKey returns a key that verifies HS256 tokens signed with a shared secret. Secrets shorter
+// than 32 bytes verify no token.
+func NewHMACKey(id string, secret []byte) Key {
+	return Key{ID: id, Algorithm: HS256, secret: secret}
+}
+
+// NewRSAKey returns a key that verifies RS256 tokens signed with the private half of a key pair.
+func NewRSAKey(id string, public *rsa.PublicKey) Key {
+	return Key{ID: id, Algorithm: RS256, public: public}
+}
+
+// KeySources names where the keys of a Verifier come from; every source that is set adds its keys.
+type KeySources struct {
+	// JWKSFile is a JSON Web Key Set with RSA and symmetric keys.
+	JWKSFile string
+	// HS256Secret is a shared secret.
+	HS256Secret string
+	// RS256PublicKeyFile is a PEM encoded RSA public key.
+	RS256PublicKeyFile string
+}
+
+// LoadKeys reads the keys of every source that is set.
+func LoadKeys(sources KeySources) ([]Key, error) {
+	var keys []Key
+	if sources.JWKSFile != "" {
+		set, err := LoadJWKS(sources.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, set...)
+	}
+	if sources.HS256Secret != "" {
+		keys = append(keys, NewHMACKey("", []byte(sources.HS256Secret)))
+	}
+	if sources.RS256PublicKeyFile != "" {
+		raw, err := os.ReadFile(sources.RS256PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading public key: %w", err)
+		}
+		public, err := ParseRSAPublicKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, NewRSAKey("", public))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no token verification keys configured")
+	}
+	return keys, nil
+}
+
+// ParseRSAPublicKey reads a PEM encoded RSA public key in PKIX or PKCS #1 form.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	if public, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return public, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	public, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return public, nil
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	K         string `json:"k"`
+}
+
+// LoadJWKS reads the keys of a JSON Web Key Set file. RSA keys verify RS256 tokens and symmetric
+// keys HS256 tokens; keys meant for encryption or for other algorithms are skipped.
+func LoadJWKS(path string) ([]Key, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	var keys []Key
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch {
+		case jwk.KeyType == "RSA" && (jwk.Algorithm == "" || jwk.Algorithm == RS256):
+			public, err := jwk.rsaPublicKey()
+			if err != nil {
+				return nil, fmt.Errorf("JWKS key %q: %w", jwk.KeyID, err)
+			}
+			keys = append(keys, NewRSAKey(jwk.KeyID, public))
+		case jwk.KeyType == "oct" && (jwk.Algorithm == "" || jwk.Algorithm == HS256):
+			secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("JWKS key %q: invalid secret", jwk.KeyID)
+			}
+			if len(secret) < minHMACSecretSize {
+				return nil, fmt.Errorf("JWKS key %q: secret must be at least %d bytes", jwk.KeyID, minHMACSecretSize)
+			}
+			keys = append(keys, NewHMACKey(jwk.KeyID, secret))
+		}
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	exponent := new(big.Int).SetBytes(e)
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadJWKSSecretSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  []byte
+		wantErr bool
+	}{
+		{name: "32 bytes", secret: testSecret},
+		{name: "16 bytes", secret: testSecret[:16], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jwks.json")
+			set := `{"keys":[{"kty":"oct","kid":"k1","alg":"HS256","k":"` + base64.RawURLEncoding.EncodeToString(tt.secret) + `"}]}`
+			if err := os.WriteFile(path, []byte(set), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := LoadJWKS(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadJWKS() = %d keys, want an error", len(keys))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadJWKS() error = %v", err)
+			}
+			if len(keys) != 1 || keys[0].ID != "k1" || keys[0].Algorithm != HS256 {
+				t.Errorf("LoadJWKS() = %+v, want the HS256 key k1", keys)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,18 +14,180 @@ type RedisConfig struct {
 	Password string
 }
 
+// SaleDefaultsConfig holds the limits applied to sales created without explicit values.
+type SaleDefaultsConfig struct {
+	ItemQuota                 int
+	PerUserLimit              int
+	MaxConcurrentReservations int
+}
+
+// ConsistencyConfig configures the background Postgres/Redis consistency checker.
+type ConsistencyConfig struct {
+	Interval   time.Duration
+	SampleSize int
+	Repair     bool
+}
+
+// FinalizationConfig configures how replicas elect the node that finalizes a sale.
+type FinalizationConfig struct {
+	NodeID   string
+	LeaseTTL time.Duration
+}
+
+// PaymentConfig selects and configures the payment provider purchases are charged through.
+type PaymentConfig struct {
+	// Provider names the payment provider; only "fake" exists so far.
+	Provider             string
+	AuthorizationTimeout time.Duration
+	FakeLatency          time.Duration
+	FakeDeclineRate      float64
+}
+
+// RateLimitConfig configures the per-client rate limits of the HTTP routes.
+type RateLimitConfig struct {
+	// Routes holds the limit of every limited route by name; "default" applies to the others.
+	Routes            map[string]RateLimitRule
+	TrustForwardedFor bool
+}
+
+// RateLimitRule allows a client Requests requests in any sliding Window.
+type RateLimitRule struct {
+	Requests int
+	Window   time.Duration
+}
+
+// AuthConfig configures how users are authenticated from their bearer tokens. Every key source
+// that is set adds its keys.
+type AuthConfig struct {
+	// Disabled trusts the user_id query parameter instead of tokens, for local development only.
+	Disabled           bool
+	JWKSFile           string
+	HS256Secret        string
+	RS256PublicKeyFile string
+	Issuer             string
+	Audience           string
+	Leeway             time.Duration
+}
+
 type Config struct {
 	Port               string
 	DatabaseURL        string
 	Redis              RedisConfig
 	ReservationTimeout time.Duration
+	IdempotencyTTL     time.Duration
+	AdmissionTTL       time.Duration
+	SaleDefaults       SaleDefaultsConfig
+	Consistency        ConsistencyConfig
+	Finalization       FinalizationConfig
+	Payment            PaymentConfig
+	RateLimit          RateLimitConfig
+	Auth               AuthConfig
+	// AdminToken is the bearer token of the admin API; empty disables it.
+	AdminToken string
 }
 
 // Load loads configuration from environment variables.
 func Load() (*Config, error) {
-	timeout, err := strconv.Atoi(getEnv("RESERVATION_TIMEOUT", "600"))
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadWithoutAuth loads configuration like Load, but without requiring the keys that authenticate
+// requests, for tools such as flashctl that serve none.
+func LoadWithoutAuth() (*Config, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateWithoutAuth(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func load() (*Config, error) {
+	timeout, err := getEnvInt("RESERVATION_TIMEOUT", 600)
+	if err != nil {
+		return nil, err
+	}
+	idempotencyTTL, err := getEnvInt("IDEMPOTENCY_TTL", 86400)
+	if err != nil {
+		return nil, err
+	}
+	admissionTTL, err := getEnvInt("ADMISSION_TOKEN_TTL", 300)
+	if err != nil {
+		return nil, err
+	}
+	itemQuota, err := getEnvInt("SALE_ITEM_QUOTA", 10000)
+	if err != nil {
+		return nil, err
+	}
+	perUserLimit, err := getEnvInt("SALE_PER_USER_LIMIT", 10)
+	if err != nil {
+		return nil, err
+	}
+	maxConcurrent, err := getEnvInt("SALE_MAX_CONCURRENT_RESERVATIONS", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	consistencyInterval, err := getEnvInt("CONSISTENCY_CHECK_INTERVAL", 60)
+	if err != nil {
+		return nil, err
+	}
+	consistencySample, err := getEnvInt("CONSISTENCY_SAMPLE_SIZE", 100)
+	if err != nil {
+		return nil, err
+	}
+	consistencyRepair, err := getEnvBool("CONSISTENCY_REPAIR", false)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseTTL, err := getEnvInt("FINALIZATION_LEASE_TTL", 30)
+	if err != nil {
+		return nil, err
+	}
+	authorizationTimeout, err := getEnvInt("PAYMENT_AUTHORIZATION_TIMEOUT", 30)
+	if err != nil {
+		return nil, err
+	}
+	fakeLatency, err := getEnvInt("FAKE_PAYMENT_LATENCY_MS", 0)
+	if err != nil {
+		return nil, err
+	}
+	fakeDeclineRate, err := getEnvFloat("FAKE_PAYMENT_DECLINE_RATE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimits, err := parseRateLimits(getEnv("RATE_LIMITS", ""))
+	if err != nil {
+		return nil, err
+	}
+	trustForwardedFor, err := getEnvBool("RATE_LIMIT_TRUST_FORWARDED_FOR", false)
+	if err != nil {
+		return nil, err
+	}
+
+	authDisabled, err := getEnvBool("AUTH_DISABLED", false)
+	if err != nil {
+		return nil, err
+	}
+	authLeeway, err := getEnvInt("AUTH_LEEWAY", 30)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
 	if err != nil {
-		return nil, fmt.Errorf("invalid RESERVATION_TIMEOUT: %w", err)
+		hostname = "flash"
 	}
 
 	cfg := &Config{
@@ -40,13 +204,178 @@ func Load() (*Config, error) {
 			Password: getEnv("REDIS_PASSWORD", ""),
 		},
 		ReservationTimeout: time.Duration(timeout) * time.Second,
+		IdempotencyTTL:     time.Duration(idempotencyTTL) * time.Second,
+		AdmissionTTL:       time.Duration(admissionTTL) * time.Second,
+		SaleDefaults: SaleDefaultsConfig{
+			ItemQuota:                 itemQuota,
+			PerUserLimit:              perUserLimit,
+			MaxConcurrentReservations: maxConcurrent,
+		},
+		Consistency: ConsistencyConfig{
+			Interval:   time.Duration(consistencyInterval) * time.Second,
+			SampleSize: consistencySample,
+			Repair:     consistencyRepair,
+		},
+		Finalization: FinalizationConfig{
+			NodeID:   getEnv("NODE_ID", hostname),
+			LeaseTTL: time.Duration(leaseTTL) * time.Second,
+		},
+		Payment: PaymentConfig{
+			Provider:             getEnv("PAYMENT_PROVIDER", "fake"),
+			AuthorizationTimeout: time.Duration(authorizationTimeout) * time.Second,
+			FakeLatency:          time.Duration(fakeLatency) * time.Millisecond,
+			FakeDeclineRate:      fakeDeclineRate,
+		},
+		RateLimit: RateLimitConfig{
+			Routes:            rateLimits,
+			TrustForwardedFor: trustForwardedFor,
+		},
+		Auth: AuthConfig{
+			Disabled:           authDisabled,
+			JWKSFile:           getEnv("AUTH_JWKS_FILE", ""),
+			HS256Secret:        getEnv("AUTH_HS256_SECRET", ""),
+			RS256PublicKeyFile: getEnv("AUTH_RS256_PUBLIC_KEY_FILE", ""),
+			Issuer:             getEnv("AUTH_ISSUER", ""),
+			Audience:           getEnv("AUTH_AUDIENCE", ""),
+			Leeway:             time.Duration(authLeeway) * time.Second,
+		},
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
 	}
 	return cfg, nil
 }
 
+// Validate rejects configurations the service cannot run with.
+func (c *Config) Validate() error {
+	if err := c.validateWithoutAuth(); err != nil {
+		return err
+	}
+	if !c.Auth.Disabled && c.Auth.JWKSFile == "" && c.Auth.HS256Secret == "" && c.Auth.RS256PublicKeyFile == "" {
+		return errors.New("one of AUTH_JWKS_FILE, AUTH_HS256_SECRET or AUTH_RS256_PUBLIC_KEY_FILE must be set, or AUTH_DISABLED=true")
+	}
+	if c.Auth.HS256Secret != "" && len(c.Auth.HS256Secret) < 32 {
+		return errors.New("AUTH_HS256_SECRET must be at least 32 bytes long")
+	}
+	if c.Auth.Leeway < 0 {
+		return errors.New("AUTH_LEEWAY must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) validateWithoutAuth() error {
+	if c.ReservationTimeout <= 0 {
+		return errors.New("RESERVATION_TIMEOUT must be positive")
+	}
+	if c.IdempotencyTTL <= 0 {
+		return errors.New("IDEMPOTENCY_TTL must be positive")
+	}
+	if c.AdmissionTTL <= 0 {
+		return errors.New("ADMISSION_TOKEN_TTL must be positive")
+	}
+	if c.SaleDefaults.ItemQuota <= 0 {
+		return errors.New("SALE_ITEM_QUOTA must be positive")
+	}
+	if c.SaleDefaults.PerUserLimit <= 0 {
+		return errors.New("SALE_PER_USER_LIMIT must be positive")
+	}
+	if c.SaleDefaults.MaxConcurrentReservations <= 0 {
+		return errors.New("SALE_MAX_CONCURRENT_RESERVATIONS must be positive")
+	}
+	if c.SaleDefaults.PerUserLimit > c.SaleDefaults.ItemQuota {
+		return errors.New("SALE_PER_USER_LIMIT must not exceed SALE_ITEM_QUOTA")
+	}
+	if c.Consistency.Interval < 0 {
+		return errors.New("CONSISTENCY_CHECK_INTERVAL must not be negative")
+	}
+	if c.Consistency.SampleSize <= 0 {
+		return errors.New("CONSISTENCY_SAMPLE_SIZE must be positive")
+	}
+	if c.Finalization.NodeID == "" {
+		return errors.New("NODE_ID must not be empty")
+	}
+	if c.Finalization.LeaseTTL <= 0 {
+		return errors.New("FINALIZATION_LEASE_TTL must be positive")
+	}
+	if c.Payment.Provider != "fake" {
+		return fmt.Errorf("unknown PAYMENT_PROVIDER %q", c.Payment.Provider)
+	}
+	if c.Payment.AuthorizationTimeout <= 0 {
+		return errors.New("PAYMENT_AUTHORIZATION_TIMEOUT must be positive")
+	}
+	if c.Payment.FakeLatency < 0 {
+		return errors.New("FAKE_PAYMENT_LATENCY_MS must not be negative")
+	}
+	if c.Payment.FakeDeclineRate < 0 || c.Payment.FakeDeclineRate > 1 {
+		return errors.New("FAKE_PAYMENT_DECLINE_RATE must be between 0 and 1")
+	}
+	return nil
+}
+
+// parseRateLimits reads rate limits written as comma separated route=requests/window entries,
+// e.g. "checkout=5/1s,default=100/1m".
+func parseRateLimits(value string) (map[string]RateLimitRule, error) {
+	rules := make(map[string]RateLimitRule)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, limit, ok := strings.Cut(entry, "=")
+		requests, window, ok2 := strings.Cut(limit, "/")
+		if !ok || !ok2 || route == "" {
+			return nil, fmt.Errorf("invalid RATE_LIMITS entry %q: want route=requests/window", entry)
+		}
+		n, err := strconv.Atoi(requests)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMITS entry %q: requests must be a positive number", entry)
+		}
+		d, err := time.ParseDuration(window)
+		if err != nil || d < time.Millisecond {
+			return nil, fmt.Errorf("invalid RATE_LIMITS entry %q: window must be a duration of at least 1ms", entry)
+		}
+		rules[route] = RateLimitRule{Requests: n, Window: d}
+	}
+	return rules, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func getEnvFloat(key string, defaultValue float64) (float64, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
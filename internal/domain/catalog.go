@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidItem = errors.New("invalid catalog item")
+
+// CatalogItem is a product offered in a sale, identified by its SKU, with the number of
+// units the sale has to sell and the price of a unit. Price is in the minor unit of
+// Currency, an ISO 4217 code, e.g. cents for USD.
+type CatalogItem struct {
+	SaleID   int64  `json:"sale_id"`
+	SKU      string `json:"sku"`
+	Name     string `json:"name"`
+	Stock    int    `json:"stock"`
+	Price    int64  `json:"price"`
+	Currency string `json:"currency"`
+}
+
+// Validate checks that the catalog item is complete.
+func (i *CatalogItem) Validate() error {
+	if i.SKU == "" {
+		return fmt.Errorf("%w: sku is required", ErrInvalidItem)
+	}
+	if i.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidItem)
+	}
+	if i.Stock < 0 {
+		return fmt.Errorf("%w: stock must not be negative", ErrInvalidItem)
+	}
+	if i.Price < 0 {
+		return fmt.Errorf("%w: price must not be negative", ErrInvalidItem)
+	}
+	if !validCurrency(i.Currency) {
+		return fmt.Errorf("%w: currency must be a three letter ISO 4217 code", ErrInvalidItem)
+	}
+	return nil
+}
+
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
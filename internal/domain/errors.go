@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reservation and purchase failures that are caused by the client rather than the system.
+var (
+	ErrUnknownItem                   = errors.New("unknown item")
+	ErrOutOfStock                    = errors.New("item is out of stock")
+	ErrSaleSoldOut                   = errors.New("sale completed, items sold out")
+	ErrPurchaseLimitExceeded         = errors.New("purchase limit exceeded for this user")
+	ErrConcurrentReservationExceeded = errors.New("concurrent reservation limit exceeded for this user")
+	ErrReservationNotFound           = errors.New("Reservation not found or expired")
+	ErrDuplicatePurchase             = errors.New("reservation has already been purchased")
+	ErrReservationNotOwned           = errors.New("reservation belongs to another user")
+	ErrUnauthenticated               = errors.New("authentication required")
+)
+
+// limitError keeps the configured limit in the message while still matching its sentinel with errors.Is.
+type limitError struct {
+	err error
+	msg string
+}
+
+func (e *limitError) Error() string { return e.msg }
+func (e *limitError) Unwrap() error { return e.err }
+
+// PurchaseLimitError reports that the user already bought the maximum number of items.
+func PurchaseLimitError(limit int) error {
+	return &limitError{
+		err: ErrPurchaseLimitExceeded,
+		msg: fmt.Sprintf("purchase limit of %d items exceeded for this user", limit),
+	}
+}
+
+// ConcurrentReservationLimitError reports that the user holds the maximum number of open reservations.
+func ConcurrentReservationLimitError(limit int) error {
+	return &limitError{
+		err: ErrConcurrentReservationExceeded,
+		msg: fmt.Sprintf("concurrent reservation limit of %d exceeded for this user", limit),
+	}
+}
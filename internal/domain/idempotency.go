@@ -0,0 +1,17 @@
+package domain
+
+import "errors"
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was already used with different parameters")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an Idempotency-Key.
+// A record that is not Completed marks a request that is still being processed.
+type IdempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
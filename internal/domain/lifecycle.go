@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrSalePaused        = errors.New("sale is paused")
+	ErrInvalidTransition = errors.New("invalid sale status transition")
+)
+
+// SaleStatus is a stage of the sale lifecycle.
+type SaleStatus string
+
+const (
+	// SaleScheduled sales have not started yet.
+	SaleScheduled SaleStatus = "scheduled"
+	// SaleOpen sales accept checkouts and purchases.
+	SaleOpen SaleStatus = "open"
+	// SalePaused sales reject new checkouts but let existing reservations be purchased.
+	SalePaused SaleStatus = "paused"
+	// SaleSoldOut sales have sold their whole quota.
+	SaleSoldOut SaleStatus = "sold_out"
+	// SaleSettling sales have ended and are being finalized.
+	SaleSettling SaleStatus = "settling"
+	// SaleSettled sales have been finalized according to their settlement policy.
+	SaleSettled SaleStatus = "settled"
+	// SaleCancelled sales were aborted.
+	SaleCancelled SaleStatus = "cancelled"
+)
+
+// saleTransitions lists the statuses each status may move to.
+var saleTransitions = map[SaleStatus][]SaleStatus{
+	SaleScheduled: {SaleOpen, SaleSettling, SaleCancelled},
+	SaleOpen:      {SalePaused, SaleSoldOut, SaleSettling, SaleCancelled},
+	SalePaused:    {SaleOpen, SaleSettling, SaleCancelled},
+	SaleSoldOut:   {SaleOpen, SaleSettling, SaleCancelled},
+	SaleSettling:  {SaleSettled},
+}
+
+// CanTransitionTo reports whether a sale may move from this status to next.
+func (s SaleStatus) CanTransitionTo(next SaleStatus) bool {
+	for _, allowed := range saleTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Predecessors returns the statuses a sale may move to this status from.
+func (s SaleStatus) Predecessors() []SaleStatus {
+	var from []SaleStatus
+	for status, next := range saleTransitions {
+		for _, allowed := range next {
+			if allowed == s {
+				from = append(from, status)
+			}
+		}
+	}
+	return from
+}
+
+// IsTerminal reports whether a sale in this status is over for good.
+func (s SaleStatus) IsTerminal() bool {
+	return s == SaleSettled || s == SaleCancelled
+}
+
+// TransitionError reports a transition the lifecycle does not allow.
+func TransitionError(from, to SaleStatus) error {
+	return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+}
+
+// CheckCheckout returns why the sale does not accept new checkouts at the given time, if it does not.
+func (s *Sale) CheckCheckout(now time.Time) error {
+	if s.Mode == SaleModeLottery {
+		return ErrLotterySale
+	}
+	switch s.Status {
+	case SaleOpen:
+	case SalePaused:
+		return ErrSalePaused
+	case SaleSoldOut:
+		return ErrSaleSoldOut
+	default:
+		return ErrSaleNotActive
+	}
+	if !s.inWindow(now) {
+		return ErrSaleNotActive
+	}
+	return nil
+}
+
+// CheckPurchase returns why the sale does not accept purchases at the given time, if it does not.
+// Reservations taken before a sale was paused or sold out can still be purchased.
+func (s *Sale) CheckPurchase(now time.Time) error {
+	switch s.Status {
+	case SaleOpen, SalePaused, SaleSoldOut:
+	default:
+		return ErrSaleNotActive
+	}
+	if !s.inWindow(now) {
+		return ErrSaleNotActive
+	}
+	return nil
+}
+
+// SaleEvent announces a change to a sale to every replica.
+type SaleEvent struct {
+	SaleID int64      `json:"sale_id"`
+	Status SaleStatus `json:"status"`
+	NodeID string     `json:"node_id"`
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+var allSaleStatuses = []SaleStatus{
+	SaleScheduled, SaleOpen, SalePaused, SaleSoldOut, SaleSettling, SaleSettled, SaleCancelled,
+}
+
+func TestSaleStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from SaleStatus
+		to   []SaleStatus
+	}{
+		{from: SaleScheduled, to: []SaleStatus{SaleOpen, SaleSettling, SaleCancelled}},
+		{from: SaleOpen, to: []SaleStatus{SalePaused, SaleSoldOut, SaleSettling, SaleCancelled}},
+		{from: SalePaused, to: []SaleStatus{SaleOpen, SaleSettling, SaleCancelled}},
+		{from: SaleSoldOut, to: []SaleStatus{SaleOpen, SaleSettling, SaleCancelled}},
+		{from: SaleSettling, to: []SaleStatus{SaleSettled}},
+		{from: SaleSettled},
+		{from: SaleCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from), func(t *testing.T) {
+			for _, to := range allSaleStatuses {
+				want := slices.Contains(tt.to, to)
+				if got := tt.from.CanTransitionTo(to); got != want {
+					t.Errorf("CanTransitionTo(%s) = %v, want %v", to, got, want)
+				}
+				if got := slices.Contains(to.Predecessors(), tt.from); got != want {
+					t.Errorf("%s in Predecessors() of %s = %v, want %v", tt.from, to, got, want)
+				}
+			}
+			if got, want := tt.from.IsTerminal(), len(tt.to) == 0; got != want {
+				t.Errorf("IsTerminal() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSaleChecks(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		status      SaleStatus
+		checkoutErr error
+		purchaseErr error
+		ended       bool
+		lottery     bool
+	}{
+		{status: SaleScheduled, checkoutErr: ErrSaleNotActive, purchaseErr: ErrSaleNotActive},
+		{status: SaleOpen},
+		{status: SalePaused, checkoutErr: ErrSalePaused},
+		{status: SaleSoldOut, checkoutErr: ErrSaleSoldOut},
+		{status: SaleSettling, checkoutErr: ErrSaleNotActive, purchaseErr: ErrSaleNotActive},
+		{status: SaleSettled, checkoutErr: ErrSaleNotActive, purchaseErr: ErrSaleNotActive},
+		{status: SaleCancelled, checkoutErr: ErrSaleNotActive, purchaseErr: ErrSaleNotActive},
+		{status: SaleOpen, ended: true, checkoutErr: ErrSaleNotActive, purchaseErr: ErrSaleNotActive},
+		{status: SaleOpen, lottery: true, checkoutErr: ErrLotterySale},
+	}
+
+	for _, tt := range tests {
+		sale := &Sale{Status: tt.status, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}
+		if tt.ended {
+			sale.EndsAt = now.Add(-time.Minute)
+		}
+		if tt.lottery {
+			sale.Mode = SaleModeLottery
+		}
+		if err := sale.CheckCheckout(now); !errors.Is(err, tt.checkoutErr) {
+			t.Errorf("%s sale (ended %v, lottery %v): CheckCheckout() error = %v, want %v",
+				tt.status, tt.ended, tt.lottery, err, tt.checkoutErr)
+		}
+		if err := sale.CheckPurchase(now); !errors.Is(err, tt.purchaseErr) {
+			t.Errorf("%s sale (ended %v, lottery %v): CheckPurchase() error = %v, want %v",
+				tt.status, tt.ended, tt.lottery, err, tt.purchaseErr)
+		}
+	}
+}
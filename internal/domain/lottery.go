@@ -0,0 +1,148 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotLottery     = errors.New("sale is not a lottery")
+	ErrLotterySale    = errors.New("sale is allocated by lottery")
+	ErrLotteryClosed  = errors.New("lottery entries are closed")
+	ErrDuplicateEntry = errors.New("user has already entered the lottery")
+	ErrEntryNotFound  = errors.New("lottery entry not found")
+)
+
+// SaleMode decides how the units of a sale are allocated.
+type SaleMode string
+
+const (
+	// SaleModeFirstCome sales reserve units to whoever checks out first.
+	SaleModeFirstCome SaleMode = "first_come"
+	// SaleModeLottery sales take entries until they start and then draw the winners at random.
+	SaleModeLottery SaleMode = "lottery"
+)
+
+// DefaultSaleMode applies to sales created without a mode.
+const DefaultSaleMode = SaleModeFirstCome
+
+// EntryStatus is the state of a lottery entry.
+type EntryStatus string
+
+const (
+	// EntryEntered entries wait for the draw.
+	EntryEntered EntryStatus = "entered"
+	// EntryWon entries were drawn and hold a reservation their user can purchase.
+	EntryWon EntryStatus = "won"
+	// EntryLost entries were drawn after the stock or quota they asked for was gone.
+	EntryLost EntryStatus = "lost"
+)
+
+// LotteryEntry is a user's request to buy the lines of a lottery sale. Rank is the entry's place
+// in the draw order, starting at 1, and Code the reservation code of a winning entry.
+type LotteryEntry struct {
+	ID        int64       `json:"id"`
+	SaleID    int64       `json:"sale_id"`
+	UserID    string      `json:"user_id"`
+	Lines     []OrderLine `json:"items"`
+	Status    EntryStatus `json:"status"`
+	Rank      int         `json:"rank,omitempty"`
+	Code      string      `json:"code,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	DrawnAt   *time.Time  `json:"drawn_at,omitempty"`
+}
+
+// Lottery is the draw of a lottery sale. SeedHash is published while entries are taken, and the
+// seed itself only once the winners are drawn, so anyone can check that the draw used the seed
+// committed to before the entries were known. Seed is empty until then. EntriesHash fingerprints
+// the entries the draw was made from, which are only fixed once entries close, so whoever knows
+// the seed early still cannot tell the draw order before then.
+type Lottery struct {
+	SaleID      int64      `json:"sale_id"`
+	SeedHash    string     `json:"seed_hash"`
+	Seed        string     `json:"seed,omitempty"`
+	EntriesHash string     `json:"entries_hash,omitempty"`
+	Entries     int        `json:"entries"`
+	Winners     int        `json:"winners"`
+	Units       int        `json:"units"`
+	DrawnAt     *time.Time `json:"drawn_at,omitempty"`
+	DrawnBy     string     `json:"drawn_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// LotterySeedHash returns the commitment published for a lottery seed: the hex encoded SHA-256
+// of its bytes.
+func LotterySeedHash(seed []byte) string {
+	sum := sha256.Sum256(seed)
+	return hex.EncodeToString(sum[:])
+}
+
+// LotteryEntriesHash returns the fingerprint of the entries of a lottery: the hex encoded SHA-256
+// of their user IDs in ascending order, each followed by a newline.
+func LotteryEntriesHash(entries []*LotteryEntry) string {
+	users := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		users = append(users, entry.UserID)
+	}
+	slices.Sort(users)
+	h := sha256.New()
+	for _, user := range users {
+		h.Write([]byte(user + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LotteryTicket returns the draw ticket of a user: the hex encoded SHA-256 of the seed's bytes,
+// followed by the bytes of the entries hash and the user ID.
+func LotteryTicket(seed, entriesHash []byte, userID string) string {
+	h := sha256.New()
+	h.Write(seed)
+	h.Write(entriesHash)
+	h.Write([]byte(userID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DrawOrder sorts lottery entries into the order they are drawn in, sets their ranks and returns
+// the entries hash the tickets were made with. Entries are drawn by ascending ticket, so the order
+// only depends on the seed and on who entered, not on when or in which order they did. Every entry
+// is then granted in turn if the stock and quota it asks for are still there, and loses otherwise.
+func DrawOrder(seed string, entries []*LotteryEntry) (string, error) {
+	raw, err := hex.DecodeString(seed)
+	if err != nil {
+		return "", fmt.Errorf("invalid lottery seed: %w", err)
+	}
+	entriesHash := LotteryEntriesHash(entries)
+	rawEntries, _ := hex.DecodeString(entriesHash)
+
+	tickets := make(map[*LotteryEntry]string, len(entries))
+	for _, entry := range entries {
+		tickets[entry] = LotteryTicket(raw, rawEntries, entry.UserID)
+	}
+	slices.SortFunc(entries, func(a, b *LotteryEntry) int {
+		if c := strings.Compare(tickets[a], tickets[b]); c != 0 {
+			return c
+		}
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	for i, entry := range entries {
+		entry.Rank = i + 1
+	}
+	return entriesHash, nil
+}
+
+// CheckEntry returns why the sale does not take lottery entries at the given time, if it does not.
+// Entries are taken until the sale starts; the draw happens then.
+func (s *Sale) CheckEntry(now time.Time) error {
+	if s.Mode != SaleModeLottery {
+		return ErrNotLottery
+	}
+	if s.Status != SaleScheduled || !now.Before(s.StartsAt) {
+		return ErrLotteryClosed
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testSeed = "5f3c0e6a9b1d2e4f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7"
+
+func lotteryEntries(users ...string) []*LotteryEntry {
+	entries := make([]*LotteryEntry, 0, len(users))
+	for _, user := range users {
+		entries = append(entries, &LotteryEntry{UserID: user})
+	}
+	return entries
+}
+
+func drawnUsers(entries []*LotteryEntry) []string {
+	users := make([]string, len(entries))
+	for i, entry := range entries {
+		users[i] = entry.UserID
+	}
+	return users
+}
+
+// TestDrawOrderVerification repeats a draw the way the README tells auditors to.
+func TestDrawOrderVerification(t *testing.T) {
+	entries := lotteryEntries("carol", "alice", "dave", "bob", "erin")
+	entriesHash, err := DrawOrder(testSeed, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var listing strings.Builder
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		listing.WriteString(user + "\n")
+	}
+	sum := sha256.Sum256([]byte(listing.String()))
+	if want := hex.EncodeToString(sum[:]); entriesHash != want {
+		t.Fatalf("entries hash = %s, want %s", entriesHash, want)
+	}
+
+	seed, _ := hex.DecodeString(testSeed)
+	rawHash, _ := hex.DecodeString(entriesHash)
+	for i := 1; i < len(entries); i++ {
+		prev := LotteryTicket(seed, rawHash, entries[i-1].UserID)
+		next := LotteryTicket(seed, rawHash, entries[i].UserID)
+		if prev > next {
+			t.Errorf("entry %s drawn before %s with a higher ticket", entries[i-1].UserID, entries[i].UserID)
+		}
+	}
+	for i, entry := range entries {
+		if entry.Rank != i+1 {
+			t.Errorf("entry %s has rank %d, want %d", entry.UserID, entry.Rank, i+1)
+		}
+	}
+}
+
+func TestDrawOrderIgnoresEntryOrder(t *testing.T) {
+	first := lotteryEntries("alice", "bob", "carol", "dave")
+	second := lotteryEntries("dave", "carol", "bob", "alice")
+	firstHash, err := DrawOrder(testSeed, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondHash, err := DrawOrder(testSeed, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if firstHash != secondHash {
+		t.Errorf("entries hash depends on the entry order: %s and %s", firstHash, secondHash)
+	}
+	if !slices.Equal(drawnUsers(first), drawnUsers(second)) {
+		t.Errorf("draw order depends on the entry order: %v and %v", drawnUsers(first), drawnUsers(second))
+	}
+}
+
+func TestDrawOrderDependsOnEntrySet(t *testing.T) {
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"}
+	closed := lotteryEntries(users...)
+	closedHash, err := DrawOrder(testSeed, closed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := lotteryEntries(append(slices.Clone(users), "mallory")...)
+	extraHash, err := DrawOrder(testSeed, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if closedHash == extraHash {
+		t.Fatal("adding an entry did not change the entries hash")
+	}
+	// Every ticket changes with the entry set, so knowing the seed alone does not tell the order
+	seed, _ := hex.DecodeString(testSeed)
+	closedRaw, _ := hex.DecodeString(closedHash)
+	extraRaw, _ := hex.DecodeString(extraHash)
+	for _, user := range users {
+		if LotteryTicket(seed, closedRaw, user) == LotteryTicket(seed, extraRaw, user) {
+			t.Errorf("ticket of %s does not depend on the entry set", user)
+		}
+	}
+}
+
+func TestDrawOrderRejectsInvalidSeed(t *testing.T) {
+	if _, err := DrawOrder("not hex", lotteryEntries("alice")); err == nil {
+		t.Fatal("DrawOrder accepted a seed that is not hex")
+	}
+}
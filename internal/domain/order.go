@@ -0,0 +1,143 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidOrder        = errors.New("invalid order")
+	ErrOrderNotFound       = errors.New("order not found")
+	ErrOrderNotCancellable = errors.New("order cannot be cancelled")
+)
+
+// OrderStatus is the state of an order after its purchase.
+type OrderStatus string
+
+const (
+	// OrderPending orders wait for their sale to be settled.
+	OrderPending OrderStatus = "pending"
+	// OrderConfirmed orders were kept when their sale settled.
+	OrderConfirmed OrderStatus = "confirmed"
+	// OrderCancelled orders were rejected when their sale settled or was aborted, or cancelled by their customer.
+	OrderCancelled OrderStatus = "cancelled"
+)
+
+// Order events recorded in the audit trail of an order.
+const (
+	OrderEventPurchased       = "purchased"
+	OrderEventConfirmed       = "confirmed"
+	OrderEventCancelled       = "cancelled"
+	OrderEventDiscarded       = "discarded"
+	OrderEventRefundRequested = "refund_requested"
+	OrderEventRefunded        = "refunded"
+	OrderEventUnpaid          = "unpaid"
+)
+
+// OrderEvent is an entry in the audit trail of an order: what happened to it, who did it and why.
+// Actor is "user:<id>" for customers, "admin" for operators and the node ID for background work.
+type OrderEvent struct {
+	ID        int64     `json:"id"`
+	OrderID   int64     `json:"order_id"`
+	Event     string    `json:"event"`
+	Actor     string    `json:"actor"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserActor is the audit trail actor of a customer.
+func UserActor(userID string) string {
+	return "user:" + userID
+}
+
+// AdminActor is the audit trail actor of operators using the admin API.
+const AdminActor = "admin"
+
+// Cancellation is the outcome of cancelling an order. Orders cancelled before their sale settled
+// release their units and have their payment voided; Refund is only set for orders that were
+// already confirmed.
+type Cancellation struct {
+	Order   *Order   `json:"order"`
+	Payment *Payment `json:"payment,omitempty"`
+	Refund  *Refund  `json:"refund,omitempty"`
+}
+
+// OrderLine is a quantity of a single catalog item in a reservation or an order.
+// UnitPrice and Currency are the catalog price of the item when it was reserved.
+type OrderLine struct {
+	ItemID    string `json:"item_id"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit_price"`
+	Currency  string `json:"currency,omitempty"`
+}
+
+// Order is a purchased reservation with the items it holds and their total price,
+// in the minor unit of Currency.
+type Order struct {
+	ID        int64       `json:"id"`
+	SaleID    int64       `json:"sale_id"`
+	UserID    string      `json:"user_id"`
+	Code      string      `json:"code"`
+	Status    OrderStatus `json:"status"`
+	Lines     []OrderLine `json:"lines"`
+	Total     int64       `json:"total"`
+	Currency  string      `json:"currency"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Units returns the number of units the lines add up to.
+func Units(lines []OrderLine) int {
+	units := 0
+	for _, line := range lines {
+		units += line.Quantity
+	}
+	return units
+}
+
+// Total returns the price of the lines in the minor unit of their currency.
+func Total(lines []OrderLine) int64 {
+	var total int64
+	for _, line := range lines {
+		total += line.UnitPrice * int64(line.Quantity)
+	}
+	return total
+}
+
+// PriceLines returns a copy of lines with the current catalog price of every item.
+// All items of an order have to be priced in the same currency.
+func PriceLines(lines []OrderLine, catalog map[string]*CatalogItem) ([]OrderLine, error) {
+	priced := make([]OrderLine, len(lines))
+	for i, line := range lines {
+		item, ok := catalog[line.ItemID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownItem, line.ItemID)
+		}
+		if i > 0 && item.Currency != priced[0].Currency {
+			return nil, fmt.Errorf("%w: items are priced in %s and %s", ErrInvalidOrder, priced[0].Currency, item.Currency)
+		}
+		priced[i] = OrderLine{ItemID: line.ItemID, Quantity: line.Quantity, UnitPrice: item.Price, Currency: item.Currency}
+	}
+	return priced, nil
+}
+
+// ValidateLines checks that lines name every item once with a positive quantity.
+func ValidateLines(lines []OrderLine) error {
+	if len(lines) == 0 {
+		return fmt.Errorf("%w: at least one item is required", ErrInvalidOrder)
+	}
+	seen := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		if line.ItemID == "" {
+			return fmt.Errorf("%w: item_id is required", ErrInvalidOrder)
+		}
+		if line.Quantity <= 0 {
+			return fmt.Errorf("%w: quantity of %s must be positive", ErrInvalidOrder, line.ItemID)
+		}
+		if seen[line.ItemID] {
+			return fmt.Errorf("%w: %s is listed more than once", ErrInvalidOrder, line.ItemID)
+		}
+		seen[line.ItemID] = true
+	}
+	return nil
+}
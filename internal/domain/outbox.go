@@ -0,0 +1,23 @@
+package domain
+
+// Outbox event kinds.
+const (
+	// OutboxPurchase counts the units of a purchase as sold, per item and for the user, unless
+	// claiming its reservation counted them already, in which case it only confirms the claim.
+	OutboxPurchase = "purchase"
+	// OutboxCancel takes the units of a cancelled order off the sold counts and returns them to stock.
+	OutboxCancel = "cancel"
+)
+
+// OutboxEvent is a Redis side-effect recorded in the same transaction as the Postgres
+// change that caused it, and applied to Redis until it is acknowledged. Code is the
+// reservation a purchase was claimed from, if any.
+type OutboxEvent struct {
+	ID       int64       `json:"id"`
+	SaleID   int64       `json:"sale_id"`
+	Kind     string      `json:"kind"`
+	UserID   string      `json:"user_id"`
+	Lines    []OrderLine `json:"lines"`
+	Code     string      `json:"code,omitempty"`
+	Attempts int         `json:"attempts"`
+}
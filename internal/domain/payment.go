@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrPaymentDeclined = errors.New("payment was declined")
+	ErrPaymentNotFound = errors.New("payment not found")
+)
+
+// PaymentStatus is the state of the payment of an order at the payment provider.
+type PaymentStatus string
+
+const (
+	// PaymentAuthorized payments hold the amount on the customer's account without charging it.
+	PaymentAuthorized PaymentStatus = "authorized"
+	// PaymentCaptured payments were charged once their order was confirmed.
+	PaymentCaptured PaymentStatus = "captured"
+	// PaymentVoided payments were released without charging the customer.
+	PaymentVoided PaymentStatus = "voided"
+	// PaymentRefunded payments were charged and paid back.
+	PaymentRefunded PaymentStatus = "refunded"
+)
+
+// Payment is an authorization taken at the payment provider for the purchase of a reservation.
+// OrderID is zero until the order it pays for is recorded.
+type Payment struct {
+	ID              int64         `json:"id"`
+	SaleID          int64         `json:"sale_id"`
+	OrderID         int64         `json:"order_id,omitempty"`
+	Code            string        `json:"code"`
+	UserID          string        `json:"user_id"`
+	Amount          int64         `json:"amount"`
+	Currency        string        `json:"currency"`
+	AuthorizationID string        `json:"authorization_id"`
+	Status          PaymentStatus `json:"status"`
+	CreatedAt       time.Time     `json:"created_at"`
+}
+
+// RefundStatus is the state of a refund request.
+type RefundStatus string
+
+const (
+	// RefundRequested refunds wait for the payment settler to pay them back.
+	RefundRequested RefundStatus = "requested"
+	// RefundCompleted refunds were paid back to the customer.
+	RefundCompleted RefundStatus = "refunded"
+	// RefundNotCharged refunds needed no money back, as their payment was voided instead of captured.
+	RefundNotCharged RefundStatus = "not_charged"
+)
+
+// Refund is a request to pay back the amount of a confirmed order that was cancelled.
+// PaymentID is zero for orders purchased without a recorded payment, whose refunds are left to operators.
+type Refund struct {
+	ID              int64         `json:"id"`
+	OrderID         int64         `json:"order_id"`
+	PaymentID       int64         `json:"payment_id,omitempty"`
+	AuthorizationID string        `json:"-"`
+	PaymentStatus   PaymentStatus `json:"-"`
+	Amount          int64         `json:"amount"`
+	Currency        string        `json:"currency"`
+	Status          RefundStatus  `json:"status"`
+	Reason          string        `json:"reason,omitempty"`
+	RequestedAt     time.Time     `json:"requested_at"`
+}
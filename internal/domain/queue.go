@@ -0,0 +1,34 @@
+package domain
+
+import "errors"
+
+var (
+	ErrNoWaitingRoom     = errors.New("sale has no waiting room")
+	ErrTicketNotFound    = errors.New("queue ticket not found")
+	ErrAdmissionRequired = errors.New("a valid admission token is required")
+)
+
+// TicketStatus is the state of a ticket in the waiting room of a sale.
+type TicketStatus string
+
+const (
+	// TicketWaiting tickets wait for their turn.
+	TicketWaiting TicketStatus = "waiting"
+	// TicketAdmitted tickets carry an admission token that lets their user check out.
+	TicketAdmitted TicketStatus = "admitted"
+	// TicketExpired tickets were admitted but their admission token expired unused; their user has to queue again.
+	TicketExpired TicketStatus = "expired"
+)
+
+// QueueTicket is a user's place in the waiting room of a sale. Position counts the tickets to be
+// admitted up to and including this one; it is zero once the ticket is admitted.
+type QueueTicket struct {
+	Ticket               string       `json:"ticket"`
+	SaleID               int64        `json:"sale_id"`
+	Status               TicketStatus `json:"status"`
+	Position             int64        `json:"position"`
+	EstimatedWaitSeconds int64        `json:"estimated_wait_seconds"`
+	AdmissionToken       string       `json:"admission_token,omitempty"`
+	// AdmissionExpiresIn is how many seconds the admission token is still valid for.
+	AdmissionExpiresIn int64 `json:"admission_expires_in,omitempty"`
+}
@@ -0,0 +1,46 @@
+package domain
+
+import "time"
+
+// DefaultRateLimitRoute names the rate limit applied to routes without one of their own.
+const DefaultRateLimitRoute = "default"
+
+// RateLimit allows every client at most Requests requests to a route in any sliding Window.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// RateLimitDecision is the outcome of counting a request against a rate limit. Remaining is the
+// number of requests left in the current window and ResetAfter how long until the oldest request
+// counted leaves it, which is also how long a rejected client has to wait before retrying.
+type RateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration
+}
+
+// Tighter returns whichever of two decisions is more restrictive: a rejection over an allowance,
+// the longer wait among rejections, and the fewer remaining requests among allowances.
+func (d *RateLimitDecision) Tighter(other *RateLimitDecision) *RateLimitDecision {
+	switch {
+	case d == nil:
+		return other
+	case other == nil:
+		return d
+	case d.Allowed != other.Allowed:
+		if d.Allowed {
+			return other
+		}
+		return d
+	case !d.Allowed:
+		if other.ResetAfter > d.ResetAfter {
+			return other
+		}
+		return d
+	case other.Remaining < d.Remaining:
+		return other
+	}
+	return d
+}
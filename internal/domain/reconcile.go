@@ -0,0 +1,81 @@
+package domain
+
+import "time"
+
+// Reservation is a live, unpurchased reservation of one or more items.
+type Reservation struct {
+	Code      string      `json:"code"`
+	UserID    string      `json:"user_id"`
+	Lines     []OrderLine `json:"lines"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// SaleState is the part of a sale's state that Redis mirrors: how many units of each item
+// are sold and still available, how many units each user bought and which reservations are live.
+type SaleState struct {
+	SaleID        int64
+	SoldItems     map[string]int64
+	Stock         map[string]int64
+	SoldCount     int64
+	UserPurchases map[string]int64
+	Reservations  map[string]Reservation
+	// PendingOutboxEvents are purchase events already reflected in this state but not yet
+	// acknowledged; they must not be applied again on top of a rebuilt state.
+	PendingOutboxEvents []int64
+}
+
+// CountMismatch is a counter whose value in Redis differs from the one derived from Postgres.
+type CountMismatch struct {
+	Expected int64 `json:"expected"`
+	Actual   int64 `json:"actual"`
+}
+
+// SaleDrift lists the differences between the Redis state of a sale and the state derived from Postgres.
+type SaleDrift struct {
+	SaleID              int64                    `json:"sale_id"`
+	SoldItems           map[string]CountMismatch `json:"sold_items,omitempty"`
+	Stock               map[string]CountMismatch `json:"stock,omitempty"`
+	SoldCount           *CountMismatch           `json:"sold_count,omitempty"`
+	UserPurchases       map[string]CountMismatch `json:"user_purchases,omitempty"`
+	MissingReservations []Reservation            `json:"missing_reservations,omitempty"`
+	StaleReservations   []Reservation            `json:"stale_reservations,omitempty"`
+	PendingOutboxEvents []int64                  `json:"pending_outbox_events,omitempty"`
+}
+
+// Count returns the number of individual differences in the drift.
+func (d *SaleDrift) Count() int {
+	n := len(d.SoldItems) + len(d.Stock) + len(d.UserPurchases) +
+		len(d.MissingReservations) + len(d.StaleReservations)
+	if d.SoldCount != nil {
+		n++
+	}
+	return n
+}
+
+// PurchaseSample is a line of a purchase read from Postgres together with the units sold of its item,
+// the user's purchased units and the units sold by the sale at the time it was read, used to spot-check
+// Redis. ItemAvailable is the catalog stock of the item less its units sold, or nil when the item is
+// not in the catalog.
+type PurchaseSample struct {
+	SaleID        int64
+	Code          string
+	UserID        string
+	ItemID        string
+	ItemSold      int64
+	UserPurchases int64
+	SoldCount     int64
+	ItemAvailable *int64
+}
+
+// PurchaseObservation is what Redis holds for a sampled purchase. ItemReserved counts the units of
+// the item in reservations, which are taken from its stock but not sold; HasStock is false until the
+// stock of the item was initialized by its first reservation.
+type PurchaseObservation struct {
+	ItemSold        int64
+	UserPurchases   int64
+	SoldCount       int64
+	ItemStock       int64
+	ItemReserved    int64
+	HasStock        bool
+	ReservationLive bool
+}
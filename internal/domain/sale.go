@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrSaleNotFound  = errors.New("sale not found")
+	ErrSaleNotActive = errors.New("sale is not active")
+	ErrSaleFinalized = errors.New("sale has already been finalized")
+	ErrSaleStarted   = errors.New("sale has already started")
+	ErrInvalidSale   = errors.New("invalid sale")
+	ErrLeaseLost     = errors.New("lease was lost to another node")
+)
+
+// Sale is a single flash sale event with its own time window and limits.
+// Status is its stage in the lifecycle, SettlementPolicy decides what happens to its
+// pending purchases once it ends and FinalizedBy names the node that finalized it.
+// AdmissionRate is how many users per second its waiting room admits to checkout;
+// zero means the sale has no waiting room. Mode decides whether its units go to the first
+// users to check out or to the winners of a lottery.
+type Sale struct {
+	ID                        int64            `json:"id"`
+	Name                      string           `json:"name"`
+	StartsAt                  time.Time        `json:"starts_at"`
+	EndsAt                    time.Time        `json:"ends_at"`
+	ItemQuota                 int              `json:"item_quota"`
+	PerUserLimit              int              `json:"per_user_limit"`
+	MaxConcurrentReservations int              `json:"max_concurrent_reservations"`
+	CreatedAt                 time.Time        `json:"created_at"`
+	Status                    SaleStatus       `json:"status"`
+	FinalizedAt               *time.Time       `json:"finalized_at,omitempty"`
+	FinalizedBy               string           `json:"finalized_by,omitempty"`
+	SettlementPolicy          SettlementPolicy `json:"settlement_policy"`
+	SettlementThreshold       int              `json:"settlement_threshold,omitempty"`
+	AdmissionRate             int              `json:"admission_rate,omitempty"`
+	Mode                      SaleMode         `json:"mode"`
+}
+
+// SaleLimits are the quantity limits a sale enforces on reservations and purchases.
+type SaleLimits struct {
+	ItemQuota                 int
+	PerUserLimit              int
+	MaxConcurrentReservations int
+}
+
+// Limits returns the quantity limits of the sale.
+func (s *Sale) Limits() SaleLimits {
+	return SaleLimits{
+		ItemQuota:                 s.ItemQuota,
+		PerUserLimit:              s.PerUserLimit,
+		MaxConcurrentReservations: s.MaxConcurrentReservations,
+	}
+}
+
+// ApplyDefaults fills every unset limit of the sale from the given defaults
+// and falls back to the default settlement policy and mode.
+func (s *Sale) ApplyDefaults(defaults SaleLimits) {
+	if s.SettlementPolicy == "" {
+		s.SettlementPolicy = DefaultSettlementPolicy
+	}
+	if s.Mode == "" {
+		s.Mode = DefaultSaleMode
+	}
+	if s.ItemQuota == 0 {
+		s.ItemQuota = defaults.ItemQuota
+	}
+	if s.PerUserLimit == 0 {
+		s.PerUserLimit = defaults.PerUserLimit
+	}
+	if s.MaxConcurrentReservations == 0 {
+		s.MaxConcurrentReservations = defaults.MaxConcurrentReservations
+	}
+}
+
+// inWindow reports whether the given time falls within the sale's window.
+func (s *Sale) inWindow(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// Validate checks that the sale definition is internally consistent.
+func (s *Sale) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidSale)
+	}
+	if s.StartsAt.IsZero() || s.EndsAt.IsZero() {
+		return fmt.Errorf("%w: start and end times are required", ErrInvalidSale)
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("%w: end must be after its start", ErrInvalidSale)
+	}
+	if s.ItemQuota <= 0 {
+		return fmt.Errorf("%w: item quota must be positive", ErrInvalidSale)
+	}
+	if s.PerUserLimit <= 0 {
+		return fmt.Errorf("%w: per-user limit must be positive", ErrInvalidSale)
+	}
+	if s.PerUserLimit > s.ItemQuota {
+		return fmt.Errorf("%w: per-user limit must not exceed the item quota", ErrInvalidSale)
+	}
+	if s.MaxConcurrentReservations <= 0 {
+		return fmt.Errorf("%w: concurrent reservation limit must be positive", ErrInvalidSale)
+	}
+	if s.AdmissionRate < 0 {
+		return fmt.Errorf("%w: admission rate must not be negative", ErrInvalidSale)
+	}
+	switch s.Mode {
+	case SaleModeFirstCome:
+	case SaleModeLottery:
+		if s.AdmissionRate > 0 {
+			return fmt.Errorf("%w: lottery sales have no waiting room", ErrInvalidSale)
+		}
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidSale, s.Mode)
+	}
+	return nil
+}
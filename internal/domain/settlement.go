@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrSettlementNotFound = errors.New("sale has not been settled yet")
+
+// SettlementPolicy names the rule that decides the fate of a sale's pending purchases
+// when the sale is finalized.
+type SettlementPolicy string
+
+// Built-in settlement policies.
+const (
+	// SettlementAllOrNothing confirms the purchases only if the sale sold exactly its quota
+	// and deletes them otherwise.
+	SettlementAllOrNothing SettlementPolicy = "all_or_nothing"
+	// SettlementAllOrNothingCancel is SettlementAllOrNothing, but keeps the rejected purchases
+	// as cancelled instead of deleting them.
+	SettlementAllOrNothingCancel SettlementPolicy = "all_or_nothing_cancel"
+	// SettlementConfirmSold confirms whatever was sold.
+	SettlementConfirmSold SettlementPolicy = "confirm_sold"
+	// SettlementThreshold confirms the purchases if at least the sale's settlement threshold
+	// was sold and cancels them otherwise.
+	SettlementThreshold SettlementPolicy = "threshold"
+)
+
+// DefaultSettlementPolicy applies to sales created without a policy.
+const DefaultSettlementPolicy = SettlementAllOrNothing
+
+// SettlementOutcome is what happened to the pending purchases of a finalized sale.
+type SettlementOutcome string
+
+const (
+	SettlementConfirmed SettlementOutcome = "confirmed"
+	SettlementCancelled SettlementOutcome = "cancelled"
+	SettlementDeleted   SettlementOutcome = "deleted"
+)
+
+// Settlement records how a sale was finalized: Purchases is the number of orders that were
+// pending and Units the number of items they held.
+type Settlement struct {
+	ID        int64             `json:"id"`
+	SaleID    int64             `json:"sale_id"`
+	Policy    SettlementPolicy  `json:"policy"`
+	Threshold int               `json:"threshold,omitempty"`
+	Outcome   SettlementOutcome `json:"outcome"`
+	Purchases int               `json:"purchases"`
+	Units     int               `json:"units"`
+	SettledBy string            `json:"settled_by"`
+	SettledAt time.Time         `json:"settled_at"`
+}
@@ -0,0 +1,43 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrAlreadyWaitlisted = errors.New("user is already on the waitlist of this item")
+	ErrNotWaitlisted     = errors.New("user is not on the waitlist of this item")
+	ErrItemAvailable     = errors.New("item is still available, check it out instead")
+)
+
+// WaitlistStatus is the state of a waitlist entry.
+type WaitlistStatus string
+
+const (
+	// WaitlistWaiting entries wait for units of their item to come free.
+	WaitlistWaiting WaitlistStatus = "waiting"
+	// WaitlistReserved entries were given a reservation their user can purchase.
+	WaitlistReserved WaitlistStatus = "reserved"
+	// WaitlistLeft entries were withdrawn by their user.
+	WaitlistLeft WaitlistStatus = "left"
+	// WaitlistDropped entries could not be served any more, e.g. because their user reached the
+	// sale's limits in the meantime.
+	WaitlistDropped WaitlistStatus = "dropped"
+)
+
+// WaitlistEntry is a user waiting for units of a sold out item. Entries of an item are served in
+// the order they joined; Position is the place of a waiting entry in that order, starting at 1.
+// Code is the reservation code of a served entry.
+type WaitlistEntry struct {
+	ID         int64          `json:"id"`
+	SaleID     int64          `json:"sale_id"`
+	ItemID     string         `json:"item_id"`
+	UserID     string         `json:"user_id"`
+	Quantity   int            `json:"quantity"`
+	Status     WaitlistStatus `json:"status"`
+	Position   int            `json:"position,omitempty"`
+	Code       string         `json:"code,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	ReservedAt *time.Time     `json:"reserved_at,omitempty"`
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminOnly guards an admin endpoint with the configured bearer token.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			respondWithError(w, http.StatusForbidden, "Admin API is disabled")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handlePauseSale(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	sale, err := s.service.PauseSale(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sale)
+}
+
+func (s *Server) handleResumeSale(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	sale, err := s.service.ResumeSale(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sale)
+}
+
+func (s *Server) handleAbortSale(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	sale, cancelled, err := s.service.AbortSale(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, AbortResponse{Sale: sale, CancelledPurchases: cancelled})
+}
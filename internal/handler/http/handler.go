@@ -6,33 +6,106 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
+	"flash/internal/auth"
+	"flash/internal/domain"
 	"flash/internal/service"
 )
 
 type FlashSaleService interface {
-	CreateReservation(ctx context.Context, userID, itemID string) (string, error)
-	ProcessPurchase(ctx context.Context, code string) (*service.PurchaseResult, error)
-	GetCurrentStatus() *service.Status
+	CreateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error)
+	GetSale(ctx context.Context, id int64) (*domain.Sale, error)
+	ListSales(ctx context.Context) ([]*domain.Sale, error)
+	UpdateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error)
+	DeleteSale(ctx context.Context, id int64) error
+	GetSettlement(ctx context.Context, saleID int64) (*domain.Settlement, error)
+	PauseSale(ctx context.Context, saleID int64) (*domain.Sale, error)
+	ResumeSale(ctx context.Context, saleID int64) (*domain.Sale, error)
+	AbortSale(ctx context.Context, saleID int64) (*domain.Sale, int64, error)
+	ListCatalogItems(ctx context.Context, saleID int64) ([]*domain.CatalogItem, error)
+	PutCatalogItem(ctx context.Context, item *domain.CatalogItem) (*domain.CatalogItem, error)
+	DeleteCatalogItem(ctx context.Context, saleID int64, sku string) error
+	CreateReservation(ctx context.Context, saleID int64, admissionToken string, lines []domain.OrderLine) (string, error)
+	ProcessPurchase(ctx context.Context, saleID int64, code string) (*service.PurchaseResult, error)
+	CancelOrder(ctx context.Context, orderID int64, userID, reason string) (*domain.Cancellation, error)
+	ListOrderEvents(ctx context.Context, orderID int64) ([]*domain.OrderEvent, error)
+	JoinQueue(ctx context.Context, saleID int64, userID string) (*domain.QueueTicket, error)
+	GetQueueTicket(ctx context.Context, saleID int64, ticket string) (*domain.QueueTicket, error)
+	EnterLottery(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine) (*domain.LotteryEntry, error)
+	GetLotteryEntry(ctx context.Context, saleID int64, userID string) (*domain.LotteryEntry, error)
+	ListLotteryEntries(ctx context.Context, saleID int64) ([]*domain.LotteryEntry, error)
+	GetLottery(ctx context.Context, saleID int64) (*domain.Lottery, error)
+	JoinWaitlist(ctx context.Context, saleID int64, userID, admissionToken, itemID string, quantity int) (*domain.WaitlistEntry, error)
+	LeaveWaitlist(ctx context.Context, saleID int64, userID, itemID string) error
+	ListWaitlistEntries(ctx context.Context, saleID int64, userID string) ([]*domain.WaitlistEntry, error)
+	GetStatus(saleID int64) *service.Status
+	SaleStatus(ctx context.Context, sale *domain.Sale) *service.Status
+	BeginIdempotentRequest(ctx context.Context, scope, key, fingerprint string) (*domain.IdempotencyRecord, error)
+	CompleteIdempotentRequest(ctx context.Context, scope, key, fingerprint string, statusCode int, body []byte) error
+	AbortIdempotentRequest(ctx context.Context, scope, key string)
+	CheckRateLimit(ctx context.Context, route string, clients []string) *domain.RateLimitDecision
 	// Expose other service methods if needed
 }
 
 type Server struct {
-	httpServer *http.Server
-	service    FlashSaleService
+	httpServer        *http.Server
+	service           FlashSaleService
+	adminToken        string
+	trustForwardedFor bool
+	verifier          *auth.Verifier
 }
 
-func NewServer(addr string, svc FlashSaleService) (*Server, error) {
+// ServerOptions configures a Server.
+type ServerOptions struct {
+	// AdminToken is the bearer token the admin endpoints require; empty disables them.
+	AdminToken string
+	// TrustForwardedFor takes the client address for rate limits from X-Forwarded-For;
+	// only set it behind a proxy that sets the header.
+	TrustForwardedFor bool
+	// Verifier authenticates users from their bearer tokens; nil trusts the user_id query parameter.
+	Verifier *auth.Verifier
+}
+
+func NewServer(addr string, svc FlashSaleService, opts ServerOptions) (*Server, error) {
 	mux := http.NewServeMux()
 	server := &Server{
-		service: svc,
+		service:           svc,
+		adminToken:        opts.AdminToken,
+		trustForwardedFor: opts.TrustForwardedFor,
+		verifier:          opts.Verifier,
 	}
 
-	mux.HandleFunc("/checkout", server.handleCheckout)
-	mux.HandleFunc("/purchase", server.handlePurchase)
-	mux.HandleFunc("/status", server.handleStatus)
+	mux.HandleFunc("/checkout", server.authenticated(server.rateLimited("checkout", server.idempotent(service.IdempotencyScopeCheckout, server.handleCheckout))))
+	mux.HandleFunc("/purchase", server.authenticated(server.rateLimited("purchase", server.idempotent(service.IdempotencyScopePurchase, server.handlePurchase))))
+	mux.HandleFunc("/status", server.rateLimited("status", server.handleStatus))
+	mux.HandleFunc("GET /sales", server.rateLimited("sales", server.handleListSales))
+	mux.HandleFunc("POST /sales", server.adminOnly(server.handleCreateSale))
+	mux.HandleFunc("GET /sales/{id}", server.rateLimited("sales", server.handleGetSale))
+	mux.HandleFunc("PUT /sales/{id}", server.adminOnly(server.handleUpdateSale))
+	mux.HandleFunc("DELETE /sales/{id}", server.adminOnly(server.handleDeleteSale))
+	mux.HandleFunc("GET /sales/{id}/items", server.rateLimited("sales", server.handleListCatalogItems))
+	mux.HandleFunc("PUT /sales/{id}/items/{sku}", server.adminOnly(server.handlePutCatalogItem))
+	mux.HandleFunc("DELETE /sales/{id}/items/{sku}", server.adminOnly(server.handleDeleteCatalogItem))
+	mux.HandleFunc("GET /sales/{id}/settlement", server.rateLimited("sales", server.handleGetSettlement))
+	mux.HandleFunc("POST /sales/{id}/queue", server.authenticated(server.rateLimited("queue", server.handleJoinQueue)))
+	mux.HandleFunc("GET /sales/{id}/queue/{ticket}", server.rateLimited("queue", server.handleGetQueueTicket))
+	mux.HandleFunc("GET /sales/{id}/lottery", server.rateLimited("lottery", server.handleGetLottery))
+	mux.HandleFunc("POST /sales/{id}/lottery/entries", server.authenticated(server.rateLimited("lottery", server.handleEnterLottery)))
+	mux.HandleFunc("GET /sales/{id}/lottery/entries/{user}", server.authenticated(server.rateLimited("lottery", server.handleGetLotteryEntry)))
+	mux.HandleFunc("GET /sales/{id}/waitlist", server.authenticated(server.rateLimited("waitlist", server.handleListWaitlistEntries)))
+	mux.HandleFunc("POST /sales/{id}/waitlist/{sku}", server.authenticated(server.rateLimited("waitlist", server.handleJoinWaitlist)))
+	mux.HandleFunc("DELETE /sales/{id}/waitlist/{sku}", server.authenticated(server.rateLimited("waitlist", server.handleLeaveWaitlist)))
+	mux.HandleFunc("POST /admin/sales/{id}/pause", server.adminOnly(server.handlePauseSale))
+	mux.HandleFunc("POST /admin/sales/{id}/resume", server.adminOnly(server.handleResumeSale))
+	mux.HandleFunc("POST /admin/sales/{id}/abort", server.adminOnly(server.handleAbortSale))
+	mux.HandleFunc("GET /admin/sales/{id}/lottery/entries", server.adminOnly(server.handleListLotteryEntries))
+	mux.HandleFunc("POST /orders/{id}/cancel", server.authenticated(server.rateLimited("orders", server.handleCancelOrder)))
+	mux.HandleFunc("POST /admin/orders/{id}/cancel", server.adminOnly(server.handleAdminCancelOrder))
+	mux.HandleFunc("GET /admin/orders/{id}/events", server.adminOnly(server.handleListOrderEvents))
 
+	// The global token bucket sheds load before any per-client limit is looked up in Redis
 	handlerWithMiddleware := recoverMiddleware(requestThrottlingMiddleware(2000, 5000)(mux))
 
 	return &Server{
@@ -69,25 +142,22 @@ func (s *Server) handleCheckout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := r.URL.Query().Get("user_id")
-	itemID := r.URL.Query().Get("id")
-	if userID == "" || itemID == "" {
-		s.service.GetCurrentStatus().IncrementFailedCheckouts()
-		respondWithError(w, http.StatusBadRequest, "Missing user_id or id parameters")
+	saleID, err := strconv.ParseInt(r.URL.Query().Get("sale_id"), 10, 64)
+	userID := requestUser(r)
+	lines, linesErr := checkoutLines(r)
+	if err != nil || userID == "" || linesErr != nil {
+		if err == nil {
+			s.service.GetStatus(saleID).IncrementFailedCheckouts()
+		}
+		respondWithError(w, http.StatusBadRequest, "Missing sale_id, user_id or items parameters")
 		return
 	}
 
-	code, err := s.service.CreateReservation(r.Context(), userID, itemID)
+	code, err := s.service.CreateReservation(r.Context(), saleID, admissionToken(r), lines)
 	if err != nil {
 		log.Printf("Reservation error: %v", err)
-		s.service.GetCurrentStatus().IncrementFailedCheckouts()
-		// Map service errors to HTTP status codes
-		switch err.Error() {
-		case ErrItemReserved, ErrSaleSoldOut, ErrItemAlreadySold, ErrPurchaseLimitExceeded, ErrConcurrentReservationExceeded:
-			respondWithError(w, http.StatusBadRequest, err.Error())
-		default:
-			respondWithError(w, http.StatusInternalServerError, ErrInternalServer)
-		}
+		s.service.GetStatus(saleID).IncrementFailedCheckouts()
+		respondWithServiceError(w, err)
 		return
 	}
 
@@ -97,53 +167,303 @@ func (s *Server) handleCheckout(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// checkoutLines reads the items of a checkout: a JSON body with a list of lines, or a single
+// item given by the id and optional quantity query parameters.
+func checkoutLines(r *http.Request) ([]domain.OrderLine, error) {
+	if itemID := r.URL.Query().Get("id"); itemID != "" {
+		quantity := 1
+		if raw := r.URL.Query().Get("quantity"); raw != "" {
+			var err error
+			if quantity, err = strconv.Atoi(raw); err != nil {
+				return nil, err
+			}
+		}
+		return []domain.OrderLine{{ItemID: itemID, Quantity: quantity}}, nil
+	}
+
+	var req CheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req.Items, nil
+}
+
 func (s *Server) handlePurchase(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
+	saleID, err := strconv.ParseInt(r.URL.Query().Get("sale_id"), 10, 64)
 	code := r.URL.Query().Get("code")
-	if code == "" {
-		s.service.GetCurrentStatus().IncrementFailedPurchases()
-		respondWithError(w, http.StatusBadRequest, "Missing code parameter")
+	if err != nil || code == "" {
+		if err == nil {
+			s.service.GetStatus(saleID).IncrementFailedPurchases()
+		}
+		respondWithError(w, http.StatusBadRequest, "Missing sale_id or code parameters")
 		return
 	}
 
-	result, err := s.service.ProcessPurchase(r.Context(), code)
+	result, err := s.service.ProcessPurchase(r.Context(), saleID, code)
 	if err != nil {
 		log.Printf("Purchase processing error: %v", err)
-		s.service.GetCurrentStatus().IncrementFailedPurchases()
-		if err.Error() == ErrReservationNotFound {
-			respondWithError(w, http.StatusBadRequest, err.Error())
-		} else {
-			respondWithError(w, http.StatusInternalServerError, ErrInternalServer)
-		}
+		s.service.GetStatus(saleID).IncrementFailedPurchases()
+		respondWithServiceError(w, err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, PurchaseResponse{
-		Message: "success",
-		User:    result.UserID,
-		Item:    result.ItemID,
+		Message:  "success",
+		Sale:     result.SaleID,
+		Order:    result.OrderID,
+		User:     result.UserID,
+		Items:    result.Lines,
+		Total:    result.Total,
+		Currency: result.Currency,
+		Payment:  result.Payment,
 	})
 }
 
+// handleStatus reports a single sale when sale_id is given, otherwise every sale.
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
-	status := s.service.GetCurrentStatus()
-	now := time.Now()
-	nextHour := now.Truncate(time.Hour).Add(time.Hour)
+	if raw := r.URL.Query().Get("sale_id"); raw != "" {
+		saleID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid sale_id parameter")
+			return
+		}
+		sale, err := s.service.GetSale(r.Context(), saleID)
+		if err != nil {
+			respondWithServiceError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, s.saleStatus(r.Context(), sale))
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, StatusResponse{
-		SecondsRemaining:    int(nextHour.Sub(now).Seconds()),
+	sales, err := s.service.ListSales(r.Context())
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	statuses := make([]StatusResponse, 0, len(sales))
+	for _, sale := range sales {
+		statuses = append(statuses, s.saleStatus(r.Context(), sale))
+	}
+	respondWithJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) saleStatus(ctx context.Context, sale *domain.Sale) StatusResponse {
+	status := s.service.SaleStatus(ctx, sale)
+
+	secondsRemaining := 0
+	if remaining := time.Until(sale.EndsAt); remaining > 0 && sale.FinalizedAt == nil {
+		secondsRemaining = int(remaining.Seconds())
+	}
+
+	return StatusResponse{
+		SaleID:              sale.ID,
+		SaleName:            sale.Name,
+		SecondsRemaining:    secondsRemaining,
 		SuccessfulCheckouts: status.GetSuccessfulCheckouts(),
 		FailedCheckouts:     status.GetFailedCheckouts(),
 		SuccessfulPurchases: status.GetSuccessfulPurchases(),
 		FailedPurchases:     status.GetFailedPurchases(),
 		ScheduledGoods:      status.GetScheduledGoods(),
 		PurchasedGoods:      status.GetPurchasedGoods(),
-		SaleStatus:          status.SaleStatusText(),
-	})
+		ExpiredReservations: status.GetExpiredReservations(),
+		Inconsistencies:     status.GetInconsistenciesDetected(),
+		Repairs:             status.GetInconsistenciesRepaired(),
+		CancelledOrders:     status.GetCancelledOrders(),
+		SaleStatus:          string(sale.Status),
+	}
+}
+
+func (s *Server) handleListSales(w http.ResponseWriter, r *http.Request) {
+	sales, err := s.service.ListSales(r.Context())
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	if sales == nil {
+		sales = []*domain.Sale{}
+	}
+	respondWithJSON(w, http.StatusOK, sales)
+}
+
+func (s *Server) handleCreateSale(w http.ResponseWriter, r *http.Request) {
+	var req SaleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	sale, err := s.service.CreateSale(r.Context(), req.toSale(0))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, sale)
+}
+
+func (s *Server) handleGetSale(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	sale, err := s.service.GetSale(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sale)
+}
+
+func (s *Server) handleUpdateSale(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	var req SaleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	sale, err := s.service.UpdateSale(r.Context(), req.toSale(saleID))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sale)
+}
+
+func (s *Server) handleDeleteSale(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	if err := s.service.DeleteSale(r.Context(), saleID); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetSettlement(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	settlement, err := s.service.GetSettlement(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settlement)
+}
+
+func (s *Server) handleListCatalogItems(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	items, err := s.service.ListCatalogItems(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	if items == nil {
+		items = []*domain.CatalogItem{}
+	}
+	respondWithJSON(w, http.StatusOK, items)
+}
+
+func (s *Server) handlePutCatalogItem(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	var req CatalogItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	item, err := s.service.PutCatalogItem(r.Context(), req.toCatalogItem(saleID, r.PathValue("sku")))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, item)
+}
+
+func (s *Server) handleDeleteCatalogItem(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	if err := s.service.DeleteCatalogItem(r.Context(), saleID, r.PathValue("sku")); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondWithServiceError maps domain errors to client errors and hides everything else.
+func respondWithServiceError(w http.ResponseWriter, err error) {
+	if status, ok := domainErrorStatus(err); ok {
+		respondWithError(w, status, err.Error())
+		return
+	}
+	log.Printf("Internal service error: %v", err)
+	respondWithError(w, http.StatusInternalServerError, ErrInternalServer)
+}
+
+// domainErrorStatus maps business failures from the domain package to HTTP status codes.
+func domainErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, domain.ErrOutOfStock), errors.Is(err, domain.ErrSaleSoldOut), errors.Is(err, domain.ErrPurchaseLimitExceeded),
+		errors.Is(err, domain.ErrConcurrentReservationExceeded), errors.Is(err, domain.ErrReservationNotFound):
+		return http.StatusBadRequest, true
+	case errors.Is(err, domain.ErrSaleNotFound), errors.Is(err, domain.ErrSettlementNotFound),
+		errors.Is(err, domain.ErrUnknownItem), errors.Is(err, domain.ErrOrderNotFound), errors.Is(err, domain.ErrTicketNotFound),
+		errors.Is(err, domain.ErrEntryNotFound), errors.Is(err, domain.ErrNotWaitlisted):
+		return http.StatusNotFound, true
+	case errors.Is(err, domain.ErrInvalidSale), errors.Is(err, domain.ErrInvalidItem), errors.Is(err, domain.ErrInvalidOrder):
+		return http.StatusBadRequest, true
+	case errors.Is(err, domain.ErrSaleNotActive), errors.Is(err, domain.ErrSaleFinalized), errors.Is(err, domain.ErrSaleStarted),
+		errors.Is(err, domain.ErrSalePaused), errors.Is(err, domain.ErrInvalidTransition),
+		errors.Is(err, domain.ErrIdempotencyKeyInProgress), errors.Is(err, domain.ErrDuplicatePurchase),
+		errors.Is(err, domain.ErrOrderNotCancellable), errors.Is(err, domain.ErrNoWaitingRoom),
+		errors.Is(err, domain.ErrNotLottery), errors.Is(err, domain.ErrLotterySale), errors.Is(err, domain.ErrLotteryClosed),
+		errors.Is(err, domain.ErrDuplicateEntry), errors.Is(err, domain.ErrAlreadyWaitlisted),
+		errors.Is(err, domain.ErrItemAvailable):
+		return http.StatusConflict, true
+	case errors.Is(err, domain.ErrAdmissionRequired), errors.Is(err, domain.ErrReservationNotOwned):
+		return http.StatusForbidden, true
+	case errors.Is(err, domain.ErrUnauthenticated):
+		return http.StatusUnauthorized, true
+	case errors.Is(err, domain.ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity, true
+	case errors.Is(err, domain.ErrPaymentDeclined):
+		return http.StatusPaymentRequired, true
+	}
+	return 0, false
 }
 
 // Helper and Middleware functions
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength keeps client supplied keys within a sane size for Redis and Postgres.
+const maxIdempotencyKeyLength = 255
+
+// responseRecorder passes a response through while keeping a copy for idempotent replay.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent replays the stored response of requests repeated with the same Idempotency-Key.
+// Requests without the header are processed as usual. Server errors are not stored so that
+// the client can retry them.
+func (s *Server) idempotent(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondWithError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		// Keys are chosen by clients, so every user gets their own; nobody replays another user's response
+		if userID := requestUser(r); userID != "" {
+			key = userID + ":" + key
+		}
+
+		fingerprint, err := requestFingerprint(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		record, err := s.service.BeginIdempotentRequest(r.Context(), scope, key, fingerprint)
+		if err != nil {
+			respondWithServiceError(w, err)
+			return
+		}
+		if record != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status >= http.StatusInternalServerError || rec.status == 0 {
+			s.service.AbortIdempotentRequest(r.Context(), scope, key)
+			return
+		}
+		if err := s.service.CompleteIdempotentRequest(r.Context(), scope, key, fingerprint, rec.status, rec.body.Bytes()); err != nil {
+			log.Printf("Storing idempotent response for key %s failed: %v", key, err)
+		}
+	}
+}
+
+// requestFingerprint identifies the parameters of a request so a reused key with
+// different parameters can be rejected.
+func requestFingerprint(r *http.Request) (string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"?"+r.URL.Query().Encode()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
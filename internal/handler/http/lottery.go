@@ -0,0 +1,85 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"flash/internal/domain"
+)
+
+// handleEnterLottery enters the user of the request into the lottery of a sale.
+// The items are given like those of a checkout.
+func (s *Server) handleEnterLottery(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+	userID := requestUser(r)
+	lines, linesErr := checkoutLines(r)
+	if userID == "" || linesErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Missing user_id or items parameters")
+		return
+	}
+
+	entry, err := s.service.EnterLottery(r.Context(), saleID, userID, lines)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, entry)
+}
+
+// handleGetLotteryEntry reports the outcome of a user's entry, with the reservation code once it won.
+// Authenticated users only see their own entry.
+func (s *Server) handleGetLotteryEntry(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+	if s.verifier != nil && r.PathValue("user") != requestUser(r) {
+		respondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	entry, err := s.service.GetLotteryEntry(r.Context(), saleID, r.PathValue("user"))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, entry)
+}
+
+func (s *Server) handleGetLottery(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	lottery, err := s.service.GetLottery(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, lottery)
+}
+
+func (s *Server) handleListLotteryEntries(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	entries, err := s.service.ListLotteryEntries(r.Context(), saleID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []*domain.LotteryEntry{}
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
@@ -1,14 +1,14 @@
 package http
 
-// Custom error types for specific business logic failures
+import (
+	"time"
+
+	"flash/internal/domain"
+)
+
+// Error messages generated by the HTTP layer itself; business failures come from the domain package.
 var (
-	ErrItemReserved                  = "item already reserved"
-	ErrPurchaseLimitExceeded         = "purchase limit of 10 items exceeded for this user"
-	ErrConcurrentReservationExceeded = "concurrent reservation limit exceeded for this user"
-	ErrItemAlreadySold               = "item has already been sold"
-	ErrSaleSoldOut                   = "sale completed, items sold out"
-	ErrReservationNotFound           = "Reservation not found or expired"
-	ErrInternalServer                = "Internal server error"
+	ErrInternalServer = "Internal server error"
 )
 
 type CheckoutResponse struct {
@@ -16,13 +16,32 @@ type CheckoutResponse struct {
 	Code    string `json:"code"`
 }
 
+// CheckoutRequest is the body of a checkout of several items or quantities.
+type CheckoutRequest struct {
+	Items []domain.OrderLine `json:"items"`
+}
+
+// PurchaseResponse reports a successful purchase; Total is in the minor unit of Currency.
+// Payment is the state of its payment, authorized until the sale settles.
 type PurchaseResponse struct {
-	Message string `json:"message"`
-	User    string `json:"user"`
-	Item    string `json:"item"`
+	Message  string               `json:"message"`
+	Sale     int64                `json:"sale"`
+	Order    int64                `json:"order"`
+	User     string               `json:"user"`
+	Items    []domain.OrderLine   `json:"items"`
+	Total    int64                `json:"total"`
+	Currency string               `json:"currency"`
+	Payment  domain.PaymentStatus `json:"payment"`
+}
+
+// CancelOrderRequest is the optional body of an order cancellation.
+type CancelOrderRequest struct {
+	Reason string `json:"reason"`
 }
 
 type StatusResponse struct {
+	SaleID              int64  `json:"sale_id"`
+	SaleName            string `json:"sale_name"`
 	SecondsRemaining    int    `json:"seconds_remaining"`
 	SuccessfulCheckouts uint64 `json:"successful_checkouts"`
 	FailedCheckouts     uint64 `json:"failed_checkouts"`
@@ -30,9 +49,71 @@ type StatusResponse struct {
 	FailedPurchases     uint64 `json:"failed_purchases"`
 	ScheduledGoods      uint64 `json:"scheduled_goods"`
 	PurchasedGoods      uint64 `json:"purchased_goods"`
+	ExpiredReservations uint64 `json:"expired_reservations"`
+	Inconsistencies     uint64 `json:"inconsistencies_detected"`
+	Repairs             uint64 `json:"inconsistencies_repaired"`
+	CancelledOrders     uint64 `json:"cancelled_orders"`
 	SaleStatus          string `json:"sale_status"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
+
+// AbortResponse is the body of a successful sale abort.
+type AbortResponse struct {
+	Sale               *domain.Sale `json:"sale"`
+	CancelledPurchases int64        `json:"cancelled_purchases"`
+}
+
+// SaleRequest is the body of sale create and update requests.
+// Limits that are omitted fall back to the configured defaults, the settlement policy to all_or_nothing
+// and the mode to first_come.
+type SaleRequest struct {
+	Name                      string    `json:"name"`
+	StartsAt                  time.Time `json:"starts_at"`
+	EndsAt                    time.Time `json:"ends_at"`
+	ItemQuota                 int       `json:"item_quota"`
+	PerUserLimit              int       `json:"per_user_limit"`
+	MaxConcurrentReservations int       `json:"max_concurrent_reservations"`
+	SettlementPolicy          string    `json:"settlement_policy"`
+	SettlementThreshold       int       `json:"settlement_threshold"`
+	AdmissionRate             int       `json:"admission_rate"`
+	Mode                      string    `json:"mode"`
+}
+
+func (r SaleRequest) toSale(id int64) *domain.Sale {
+	return &domain.Sale{
+		ID:                        id,
+		Name:                      r.Name,
+		StartsAt:                  r.StartsAt,
+		EndsAt:                    r.EndsAt,
+		ItemQuota:                 r.ItemQuota,
+		PerUserLimit:              r.PerUserLimit,
+		MaxConcurrentReservations: r.MaxConcurrentReservations,
+		SettlementPolicy:          domain.SettlementPolicy(r.SettlementPolicy),
+		SettlementThreshold:       r.SettlementThreshold,
+		AdmissionRate:             r.AdmissionRate,
+		Mode:                      domain.SaleMode(r.Mode),
+	}
+}
+
+// CatalogItemRequest is the body of a catalog item create or replace request; the SKU comes from the path.
+// Price is in the minor unit of Currency.
+type CatalogItemRequest struct {
+	Name     string `json:"name"`
+	Stock    int    `json:"stock"`
+	Price    int64  `json:"price"`
+	Currency string `json:"currency"`
+}
+
+func (r CatalogItemRequest) toCatalogItem(saleID int64, sku string) *domain.CatalogItem {
+	return &domain.CatalogItem{
+		SaleID:   saleID,
+		SKU:      sku,
+		Name:     r.Name,
+		Stock:    r.Stock,
+		Price:    r.Price,
+		Currency: r.Currency,
+	}
+}
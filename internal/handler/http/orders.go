@@ -0,0 +1,65 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"flash/internal/domain"
+)
+
+// handleCancelOrder cancels an order of the user of the request.
+func (s *Server) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	userID := requestUser(r)
+	if userID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing user_id parameter")
+		return
+	}
+	s.cancelOrder(w, r, userID)
+}
+
+// handleAdminCancelOrder cancels any order on behalf of its customer.
+func (s *Server) handleAdminCancelOrder(w http.ResponseWriter, r *http.Request) {
+	s.cancelOrder(w, r, "")
+}
+
+func (s *Server) cancelOrder(w http.ResponseWriter, r *http.Request, userID string) {
+	orderID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order id")
+		return
+	}
+	// The reason is optional, and so is the body
+	var req CancelOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	cancellation, err := s.service.CancelOrder(r.Context(), orderID, userID, req.Reason)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cancellation)
+}
+
+func (s *Server) handleListOrderEvents(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order id")
+		return
+	}
+
+	events, err := s.service.ListOrderEvents(r.Context(), orderID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	if events == nil {
+		events = []*domain.OrderEvent{}
+	}
+	respondWithJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// admissionTokenHeader carries the waiting room admission token of a checkout.
+const admissionTokenHeader = "X-Admission-Token"
+
+// handleJoinQueue gives the user of the request a ticket in the waiting room of a sale.
+func (s *Server) handleJoinQueue(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+	userID := requestUser(r)
+	if userID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing user_id parameter")
+		return
+	}
+
+	ticket, err := s.service.JoinQueue(r.Context(), saleID, userID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ticket)
+}
+
+// handleGetQueueTicket reports the position of a ticket, and its admission token once admitted.
+func (s *Server) handleGetQueueTicket(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+
+	ticket, err := s.service.GetQueueTicket(r.Context(), saleID, r.PathValue("ticket"))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ticket)
+}
+
+// admissionToken reads the admission token of a checkout from its header or, for clients that
+// cannot set headers, the admission_token query parameter.
+func admissionToken(r *http.Request) string {
+	if token := r.Header.Get(admissionTokenHeader); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("admission_token")
+}
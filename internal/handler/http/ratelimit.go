@@ -0,0 +1,85 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// rateLimited limits the requests every client makes to a route. A request is counted against its
+// authenticated user, its client address and its API key, whichever it carries, and is rejected with 429 once any
+// of them used up the route's limit. Responses of limited routes carry the X-RateLimit-* headers of
+// the most restrictive of these limits.
+func (s *Server) rateLimited(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decision := s.service.CheckRateLimit(r.Context(), route, s.rateLimitClients(r))
+		if decision == nil {
+			next(w, r)
+			return
+		}
+
+		reset := strconv.FormatInt(ceilSeconds(decision.ResetAfter), 10)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("X-RateLimit-Reset", reset)
+		if !decision.Allowed {
+			w.Header().Set("Retry-After", reset)
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimitClients returns the clients a request is counted against. API keys are hashed so that
+// they are not kept in Redis in the clear.
+func (s *Server) rateLimitClients(r *http.Request) []string {
+	var clients []string
+	if userID := requestUser(r); userID != "" {
+		clients = append(clients, "user:"+userID)
+	}
+	if ip := s.clientIP(r); ip != "" {
+		clients = append(clients, "ip:"+ip)
+	}
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		clients = append(clients, "key:"+hex.EncodeToString(sum[:]))
+	}
+	return clients
+}
+
+// clientIP returns the address a request came from. Behind a trusted proxy that is the last
+// address of X-Forwarded-For, the one the proxy saw; earlier ones are up to the client.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.trustForwardedFor {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			last := forwarded[len(forwarded)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds rounds a duration up to whole seconds, and to at least one.
+func ceilSeconds(d time.Duration) int64 {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
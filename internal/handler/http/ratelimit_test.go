@@ -0,0 +1,87 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// rateLimitService answers every rate limit check with the same decision.
+type rateLimitService struct {
+	FlashSaleService
+	decision *domain.RateLimitDecision
+}
+
+func (s *rateLimitService) CheckRateLimit(ctx context.Context, route string, clients []string) *domain.RateLimitDecision {
+	return s.decision
+}
+
+func TestRateLimitedRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		decision   *domain.RateLimitDecision
+		wantStatus int
+		wantReset  string
+	}{
+		{name: "not limited", wantStatus: http.StatusOK},
+		{
+			name:       "allowed",
+			decision:   &domain.RateLimitDecision{Allowed: true, Limit: 3, Remaining: 2, ResetAfter: time.Second},
+			wantStatus: http.StatusOK,
+			wantReset:  "1",
+		},
+		{
+			name:       "rejected with less than a second left",
+			decision:   &domain.RateLimitDecision{Limit: 3, ResetAfter: time.Millisecond},
+			wantStatus: http.StatusTooManyRequests,
+			wantReset:  "1",
+		},
+		{
+			name:       "rejected with part of a second left",
+			decision:   &domain.RateLimitDecision{Limit: 3, ResetAfter: 1500 * time.Millisecond},
+			wantStatus: http.StatusTooManyRequests,
+			wantReset:  "2",
+		},
+		{
+			name:       "rejected with whole seconds left",
+			decision:   &domain.RateLimitDecision{Limit: 3, ResetAfter: time.Minute},
+			wantStatus: http.StatusTooManyRequests,
+			wantReset:  "60",
+		},
+		{
+			name:       "rejected at the window edge",
+			decision:   &domain.RateLimitDecision{Limit: 3},
+			wantStatus: http.StatusTooManyRequests,
+			wantReset:  "1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{service: &rateLimitService{decision: tt.decision}}
+			handler := server.rateLimited("checkout", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(http.MethodPost, "/checkout", nil))
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if got := recorder.Header().Get("X-RateLimit-Reset"); got != tt.wantReset {
+				t.Errorf("X-RateLimit-Reset = %q, want %q", got, tt.wantReset)
+			}
+			wantRetry := ""
+			if tt.wantStatus == http.StatusTooManyRequests {
+				wantRetry = tt.wantReset
+			}
+			if got := recorder.Header().Get("Retry-After"); got != wantRetry {
+				t.Errorf("Retry-After = %q, want %q", got, wantRetry)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"flash/internal/domain"
+)
+
+// handleJoinWaitlist puts the user of the request on the waitlist of an item,
+// for the units given by the optional quantity parameter, 1 by default.
+func (s *Server) handleJoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+	userID := requestUser(r)
+	quantity := 1
+	if raw := r.URL.Query().Get("quantity"); raw != "" {
+		quantity, err = strconv.Atoi(raw)
+	}
+	if userID == "" || err != nil {
+		respondWithError(w, http.StatusBadRequest, "Missing user_id or invalid quantity parameter")
+		return
+	}
+
+	entry, err := s.service.JoinWaitlist(r.Context(), saleID, userID, admissionToken(r), r.PathValue("sku"), quantity)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, entry)
+}
+
+func (s *Server) handleLeaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+	userID := requestUser(r)
+	if userID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing user_id parameter")
+		return
+	}
+
+	if err := s.service.LeaveWaitlist(r.Context(), saleID, userID, r.PathValue("sku")); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListWaitlistEntries lists the waitlist entries of the user of the request.
+func (s *Server) handleListWaitlistEntries(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sale id")
+		return
+	}
+	userID := requestUser(r)
+	if userID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing user_id parameter")
+		return
+	}
+
+	entries, err := s.service.ListWaitlistEntries(r.Context(), saleID, userID)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []*domain.WaitlistEntry{}
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
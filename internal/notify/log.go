@@ -0,0 +1,24 @@
+// Package notify holds the channels notifications reach users through.
+package notify
+
+import (
+	"context"
+	"log"
+
+	"flash/internal/service"
+)
+
+// LogNotifier writes notifications to the log instead of delivering them, for local development
+// and until a real channel is configured.
+type LogNotifier struct{}
+
+var _ service.Notifier = (*LogNotifier)(nil)
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, notification service.Notification) error {
+	log.Printf("Notify user %s about sale %d (%s): %s", notification.UserID, notification.SaleID, notification.Kind, notification.Message)
+	return nil
+}
@@ -0,0 +1,152 @@
+// Package payment holds the payment providers purchases can be charged through.
+package payment
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand/v2"
+	"sync"
+	"time"
+
+	"flash/internal/domain"
+	"flash/internal/service"
+)
+
+// FakeOptions configures a FakeProvider.
+type FakeOptions struct {
+	// Latency is added to every authorization to mimic a real provider.
+	Latency time.Duration
+	// DeclineRate is the share of authorizations, between 0 and 1, that are declined at random.
+	DeclineRate float64
+}
+
+// FakeProvider is an in-memory payment provider for local development and load tests.
+// It charges nobody. Authorizations live as long as the process; those it does not know,
+// e.g. taken by another replica or before a restart, are trusted to be for the amount
+// they are captured or refunded with.
+type FakeProvider struct {
+	opts FakeOptions
+
+	mu             sync.Mutex
+	authorizations map[string]*fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	amount   int64
+	refunded int64
+	status   domain.PaymentStatus
+	// refunds holds the keys of the refunds paid back so far
+	refunds map[string]bool
+}
+
+var _ service.PaymentProvider = (*FakeProvider)(nil)
+
+func NewFakeProvider(opts FakeOptions) *FakeProvider {
+	return &FakeProvider{
+		opts:           opts,
+		authorizations: make(map[string]*fakeAuthorization),
+	}
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, req service.PaymentRequest) (string, error) {
+	if p.opts.Latency > 0 {
+		select {
+		case <-time.After(p.opts.Latency):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if req.Amount < 0 {
+		return "", fmt.Errorf("%w: negative amount", domain.ErrPaymentDeclined)
+	}
+	if p.opts.DeclineRate > 0 && mathrand.Float64() < p.opts.DeclineRate {
+		return "", fmt.Errorf("%w: insufficient funds", domain.ErrPaymentDeclined)
+	}
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := "fake_" + hex.EncodeToString(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authorizations[id] = &fakeAuthorization{amount: req.Amount, status: domain.PaymentAuthorized}
+	return id, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, authorizationID string, amount int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	auth := p.authorization(authorizationID, amount, domain.PaymentAuthorized)
+	switch auth.status {
+	case domain.PaymentCaptured:
+		return nil
+	case domain.PaymentAuthorized:
+		if amount > auth.amount {
+			return fmt.Errorf("capture of %d exceeds the authorized %d", amount, auth.amount)
+		}
+		auth.amount = amount
+		auth.status = domain.PaymentCaptured
+		return nil
+	default:
+		return fmt.Errorf("cannot capture a %s authorization", auth.status)
+	}
+}
+
+func (p *FakeProvider) Void(ctx context.Context, authorizationID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	auth := p.authorization(authorizationID, 0, domain.PaymentAuthorized)
+	switch auth.status {
+	case domain.PaymentVoided:
+		return nil
+	case domain.PaymentAuthorized:
+		auth.status = domain.PaymentVoided
+		return nil
+	default:
+		return fmt.Errorf("cannot void a %s authorization", auth.status)
+	}
+}
+
+// Refund pays back up to the captured amount, in one or several refunds. A refund whose key
+// was paid back already succeeds without paying it again.
+func (p *FakeProvider) Refund(ctx context.Context, authorizationID, key string, amount int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	auth := p.authorization(authorizationID, amount, domain.PaymentCaptured)
+	if auth.refunds[key] {
+		return nil
+	}
+	if auth.status != domain.PaymentCaptured && auth.status != domain.PaymentRefunded {
+		return fmt.Errorf("cannot refund a %s authorization", auth.status)
+	}
+	if auth.refunded+amount > auth.amount {
+		return fmt.Errorf("refund of %d exceeds the remaining %d", amount, auth.amount-auth.refunded)
+	}
+	auth.refunded += amount
+	if auth.refunds == nil {
+		auth.refunds = make(map[string]bool)
+	}
+	auth.refunds[key] = true
+	if auth.refunded == auth.amount {
+		auth.status = domain.PaymentRefunded
+	}
+	return nil
+}
+
+// authorization returns a known authorization, or adopts an unknown one with the given amount and status.
+// p.mu must be held.
+func (p *FakeProvider) authorization(id string, amount int64, status domain.PaymentStatus) *fakeAuthorization {
+	auth, ok := p.authorizations[id]
+	if !ok {
+		auth = &fakeAuthorization{amount: amount, status: status}
+		p.authorizations[id] = auth
+	}
+	return auth
+}
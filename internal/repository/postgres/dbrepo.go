@@ -2,9 +2,15 @@ package postgres
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
+	"flash/internal/domain"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -16,80 +22,976 @@ func NewPostgresRepository(db *pgxpool.Pool) *PostgresRepository {
 	return &PostgresRepository{db: db}
 }
 
-func (r *PostgresRepository) SaveCheckoutAttempt(ctx context.Context, userID, itemID, code string) error {
-	sql := `INSERT INTO checkout_attempts (user_id, item_id, code) VALUES ($1, $2, $3)`
-	_, err := r.db.Exec(ctx, sql, userID, itemID, code)
+// uniqueViolation is the SQLSTATE Postgres reports when a unique constraint is violated.
+const uniqueViolation = "23505"
+
+const saleColumns = `id, name, starts_at, ends_at, item_quota, per_user_limit, max_concurrent_reservations,
+	status, created_at, finalized_at, COALESCE(finalized_by, ''), settlement_policy, settlement_threshold, admission_rate, mode`
+
+func scanSale(row pgx.Row) (*domain.Sale, error) {
+	var sale domain.Sale
+	err := row.Scan(&sale.ID, &sale.Name, &sale.StartsAt, &sale.EndsAt,
+		&sale.ItemQuota, &sale.PerUserLimit, &sale.MaxConcurrentReservations, &sale.Status, &sale.CreatedAt, &sale.FinalizedAt, &sale.FinalizedBy,
+		&sale.SettlementPolicy, &sale.SettlementThreshold, &sale.AdmissionRate, &sale.Mode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrSaleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sale, nil
+}
+
+func (r *PostgresRepository) CreateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error) {
+	sql := `INSERT INTO sales_events (name, starts_at, ends_at, item_quota, per_user_limit, max_concurrent_reservations,
+		settlement_policy, settlement_threshold, admission_rate, mode)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING ` + saleColumns
+	return scanSale(r.db.QueryRow(ctx, sql, sale.Name, sale.StartsAt, sale.EndsAt,
+		sale.ItemQuota, sale.PerUserLimit, sale.MaxConcurrentReservations, sale.SettlementPolicy, sale.SettlementThreshold,
+		sale.AdmissionRate, sale.Mode))
+}
+
+func (r *PostgresRepository) GetSale(ctx context.Context, id int64) (*domain.Sale, error) {
+	sql := `SELECT ` + saleColumns + ` FROM sales_events WHERE id = $1`
+	return scanSale(r.db.QueryRow(ctx, sql, id))
+}
+
+func (r *PostgresRepository) ListSales(ctx context.Context) ([]*domain.Sale, error) {
+	sql := `SELECT ` + saleColumns + ` FROM sales_events ORDER BY starts_at, id`
+	return r.querySales(ctx, sql)
+}
+
+// ListActiveSales returns sales that have started and are not finalized yet, including
+// those whose window closed but which still await finalization.
+func (r *PostgresRepository) ListActiveSales(ctx context.Context, now time.Time) ([]*domain.Sale, error) {
+	sql := `SELECT ` + saleColumns + ` FROM sales_events WHERE starts_at <= $1 AND finalized_at IS NULL ORDER BY starts_at, id`
+	return r.querySales(ctx, sql, now)
+}
+
+// ListSalesToOpen returns scheduled sales whose window has started and not ended yet.
+func (r *PostgresRepository) ListSalesToOpen(ctx context.Context, now time.Time) ([]*domain.Sale, error) {
+	sql := `SELECT ` + saleColumns + ` FROM sales_events WHERE status = 'scheduled' AND starts_at <= $1 AND ends_at > $1 ORDER BY starts_at, id`
+	return r.querySales(ctx, sql, now)
+}
+
+// ListSalesToFinalize returns sales whose window has closed but which have not been finalized yet.
+func (r *PostgresRepository) ListSalesToFinalize(ctx context.Context, now time.Time) ([]*domain.Sale, error) {
+	sql := `SELECT ` + saleColumns + ` FROM sales_events WHERE ends_at <= $1 AND finalized_at IS NULL ORDER BY ends_at, id`
+	return r.querySales(ctx, sql, now)
+}
+
+func (r *PostgresRepository) querySales(ctx context.Context, sql string, args ...any) ([]*domain.Sale, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sales query error: %w", err)
+	}
+	defer rows.Close()
+
+	var sales []*domain.Sale
+	for rows.Next() {
+		sale, err := scanSale(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sales scan error: %w", err)
+		}
+		sales = append(sales, sale)
+	}
+	return sales, rows.Err()
+}
+
+func (r *PostgresRepository) UpdateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error) {
+	sql := `UPDATE sales_events SET name = $2, starts_at = $3, ends_at = $4, item_quota = $5, per_user_limit = $6,
+		max_concurrent_reservations = $7, settlement_policy = $8, settlement_threshold = $9, admission_rate = $10,
+		mode = $11 WHERE id = $1 AND finalized_at IS NULL RETURNING ` + saleColumns
+	updated, err := scanSale(r.db.QueryRow(ctx, sql, sale.ID, sale.Name, sale.StartsAt, sale.EndsAt,
+		sale.ItemQuota, sale.PerUserLimit, sale.MaxConcurrentReservations, sale.SettlementPolicy, sale.SettlementThreshold,
+		sale.AdmissionRate, sale.Mode))
+	if errors.Is(err, domain.ErrSaleNotFound) {
+		// Distinguish a missing sale from one that can no longer be changed
+		if _, getErr := r.GetSale(ctx, sale.ID); getErr == nil {
+			return nil, domain.ErrSaleFinalized
+		}
+	}
+	return updated, err
+}
+
+// TransitionSale moves a sale to the given status if the lifecycle allows it from the status
+// the sale is in. The check and the update are a single statement, so concurrent transitions
+// of the same sale cannot both succeed from the same status.
+func (r *PostgresRepository) TransitionSale(ctx context.Context, saleID int64, to domain.SaleStatus) (*domain.Sale, error) {
+	sql := `UPDATE sales_events SET status = $2 WHERE id = $1 AND status = ANY($3) RETURNING ` + saleColumns
+	sale, err := scanSale(r.db.QueryRow(ctx, sql, saleID, string(to), statusNames(to.Predecessors())))
+	if errors.Is(err, domain.ErrSaleNotFound) {
+		return nil, r.transitionError(ctx, saleID, to)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sale transition error: %w", err)
+	}
+	return sale, nil
+}
+
+// transitionError explains why a guarded transition of a sale matched no row.
+func (r *PostgresRepository) transitionError(ctx context.Context, saleID int64, to domain.SaleStatus) error {
+	current, err := r.GetSale(ctx, saleID)
+	if err != nil {
+		return err
+	}
+	return domain.TransitionError(current.Status, to)
+}
+
+func statusNames(statuses []domain.SaleStatus) []string {
+	names := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		names = append(names, string(status))
+	}
+	return names
+}
+
+// AbortSale cancels a sale that has not started settling together with its pending purchases,
+// and marks it as finalized by nodeID. It returns the sale and the number of cancelled purchases.
+func (r *PostgresRepository) AbortSale(ctx context.Context, saleID int64, nodeID string) (*domain.Sale, int64, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("transaction begin error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sqlCancelSale := `UPDATE sales_events SET status = 'cancelled', finalized_at = now(), finalized_by = $2
+		WHERE id = $1 AND status = ANY($3) RETURNING ` + saleColumns
+	sale, err := scanSale(tx.QueryRow(ctx, sqlCancelSale, saleID, nodeID, statusNames(domain.SaleCancelled.Predecessors())))
+	if errors.Is(err, domain.ErrSaleNotFound) {
+		return nil, 0, r.transitionError(ctx, saleID, domain.SaleCancelled)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("sale cancellation error: %w", err)
+	}
+
+	if err := insertPendingOrderEvents(ctx, tx, saleID, domain.OrderEventCancelled, domain.AdminActor, "sale aborted"); err != nil {
+		return nil, 0, err
+	}
+	sqlCancelSales := `UPDATE sales SET status = 'cancelled', cancelled_at = now() WHERE status = 'pending' AND sale_id = $1`
+	tag, err := tx.Exec(ctx, sqlCancelSales, saleID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("sales cancellation error: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, 0, fmt.Errorf("transaction commit error: %w", err)
+	}
+	return sale, tag.RowsAffected(), nil
+}
+
+// MarkSoldOut moves an open sale to sold_out once the units of its pending and confirmed purchases
+// reach its quota. It reports whether the sale was moved.
+func (r *PostgresRepository) MarkSoldOut(ctx context.Context, saleID int64) (bool, error) {
+	sql := `UPDATE sales_events SET status = 'sold_out' WHERE id = $1 AND status = 'open'
+		AND item_quota <= (SELECT COALESCE(SUM(l.quantity), 0) FROM sales s JOIN order_lines l ON l.order_id = s.id
+			WHERE s.sale_id = $1 AND s.status IN ('pending', 'confirmed'))`
+	tag, err := r.db.Exec(ctx, sql, saleID)
+	if err != nil {
+		return false, fmt.Errorf("sale sold out mark error: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PostgresRepository) DeleteSale(ctx context.Context, id int64) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM sales_events WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("sale delete error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrSaleNotFound
+	}
+	return nil
+}
+
+const catalogItemColumns = `sale_id, sku, name, stock, price, currency`
+
+func scanCatalogItem(row pgx.Row) (*domain.CatalogItem, error) {
+	var item domain.CatalogItem
+	err := row.Scan(&item.SaleID, &item.SKU, &item.Name, &item.Stock, &item.Price, &item.Currency)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrUnknownItem
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// ListCatalogItems returns the catalog of a sale ordered by SKU.
+func (r *PostgresRepository) ListCatalogItems(ctx context.Context, saleID int64) ([]*domain.CatalogItem, error) {
+	sql := `SELECT ` + catalogItemColumns + ` FROM catalog_items WHERE sale_id = $1 ORDER BY sku`
+	rows, err := r.db.Query(ctx, sql, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("catalog query error: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*domain.CatalogItem
+	for rows.Next() {
+		item, err := scanCatalogItem(rows)
+		if err != nil {
+			return nil, fmt.Errorf("catalog scan error: %w", err)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// SaveCatalogItem creates a catalog item or replaces the name, stock and price of an existing one.
+func (r *PostgresRepository) SaveCatalogItem(ctx context.Context, item *domain.CatalogItem) (*domain.CatalogItem, error) {
+	sql := `INSERT INTO catalog_items (sale_id, sku, name, stock, price, currency) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sale_id, sku) DO UPDATE
+		SET name = EXCLUDED.name, stock = EXCLUDED.stock, price = EXCLUDED.price, currency = EXCLUDED.currency
+		RETURNING ` + catalogItemColumns
+	saved, err := scanCatalogItem(r.db.QueryRow(ctx, sql, item.SaleID, item.SKU, item.Name, item.Stock, item.Price, item.Currency))
+	if err != nil {
+		return nil, fmt.Errorf("catalog item save error: %w", err)
+	}
+	return saved, nil
+}
+
+func (r *PostgresRepository) DeleteCatalogItem(ctx context.Context, saleID int64, sku string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM catalog_items WHERE sale_id = $1 AND sku = $2`, saleID, sku)
+	if err != nil {
+		return fmt.Errorf("catalog item delete error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrUnknownItem
+	}
+	return nil
+}
+
+func (r *PostgresRepository) SaveCheckoutAttempt(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine, code string) error {
+	encoded, err := json.Marshal(lines)
+	if err != nil {
+		return err
+	}
+	sql := `INSERT INTO checkout_attempts (sale_id, user_id, lines, code) VALUES ($1, $2, $3, $4)`
+	_, err = r.db.Exec(ctx, sql, saleID, userID, encoded, code)
 	return err
 }
 
-func (r *PostgresRepository) ProcessPurchase(ctx context.Context, userID, itemID, code string) error {
+// ProcessPurchase records a pending order with its lines together with the outbox events that bring
+// Redis in line with it, so the Redis side-effects can never be lost once the purchase is committed.
+// The authorized payment is linked to the order; should it have been voided in the meantime,
+// nothing is recorded.
+func (r *PostgresRepository) ProcessPurchase(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine, code string,
+	payment *domain.Payment) (*domain.Order, []*domain.OutboxEvent, error) {
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("transaction begin error: %w", err)
+		return nil, nil, fmt.Errorf("transaction begin error: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	sqlInsertSale := `INSERT INTO sales (user_id, item_id, status) VALUES ($1, $2, 'pending')`
-	if _, err := tx.Exec(ctx, sqlInsertSale, userID, itemID); err != nil {
-		return fmt.Errorf("sales insert error: %w", err)
+	// A shared lock on the sale makes an abort or finalization wait for in-flight purchases,
+	// and purchases that come after it see the sale's new status
+	var status domain.SaleStatus
+	sqlStatus := `SELECT status FROM sales_events WHERE id = $1 FOR SHARE`
+	if err := tx.QueryRow(ctx, sqlStatus, saleID).Scan(&status); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, domain.ErrSaleNotFound
+		}
+		return nil, nil, fmt.Errorf("sale status query error: %w", err)
+	}
+	if status != domain.SaleOpen && status != domain.SalePaused && status != domain.SaleSoldOut {
+		return nil, nil, domain.ErrSaleNotActive
+	}
+
+	order := &domain.Order{
+		SaleID: saleID,
+		UserID: userID,
+		Code:   code,
+		Status: domain.OrderPending,
+		Lines:  lines,
+		Total:  domain.Total(lines),
+	}
+	if len(lines) > 0 {
+		order.Currency = lines[0].Currency
+	}
+	sqlInsertSale := `INSERT INTO sales (sale_id, user_id, code, status, total, currency) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, purchased_at`
+	err = tx.QueryRow(ctx, sqlInsertSale, saleID, userID, code, order.Status, order.Total, order.Currency).Scan(&order.ID, &order.CreatedAt)
+	if err != nil {
+		// The unique index on code catches a double-spend that slipped past Redis
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return nil, nil, domain.ErrDuplicatePurchase
+		}
+		return nil, nil, fmt.Errorf("sales insert error: %w", err)
+	}
+
+	var (
+		itemIDs    = make([]string, len(lines))
+		quantities = make([]int32, len(lines))
+		prices     = make([]int64, len(lines))
+		currencies = make([]string, len(lines))
+	)
+	for i, line := range lines {
+		itemIDs[i], quantities[i], prices[i], currencies[i] = line.ItemID, int32(line.Quantity), line.UnitPrice, line.Currency
+	}
+	sqlInsertLines := `INSERT INTO order_lines (order_id, item_id, quantity, unit_price, currency)
+		SELECT $1, item_id, quantity, unit_price, currency
+		FROM unnest($2::text[], $3::int[], $4::bigint[], $5::text[]) AS l(item_id, quantity, unit_price, currency)`
+	if _, err := tx.Exec(ctx, sqlInsertLines, order.ID, itemIDs, quantities, prices, currencies); err != nil {
+		return nil, nil, fmt.Errorf("order lines insert error: %w", err)
+	}
+
+	sqlLinkPayment := `UPDATE payments SET order_id = $2, updated_at = now() WHERE id = $1 AND status = 'authorized'`
+	tag, err := tx.Exec(ctx, sqlLinkPayment, payment.ID, order.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("payment link error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, nil, fmt.Errorf("%w: the authorization is no longer valid", domain.ErrPaymentDeclined)
 	}
+	payment.OrderID = order.ID
 
 	sqlUpdateCheckout := `UPDATE checkout_attempts SET used = true WHERE code = $1`
 	if _, err := tx.Exec(ctx, sqlUpdateCheckout, code); err != nil {
-		return fmt.Errorf("checkout update error: %w", err)
+		return nil, nil, fmt.Errorf("checkout update error: %w", err)
+	}
+
+	if err := insertOrderEvent(ctx, tx, order.ID, domain.OrderEventPurchased, domain.UserActor(userID), ""); err != nil {
+		return nil, nil, err
+	}
+
+	event := &domain.OutboxEvent{SaleID: saleID, Kind: domain.OutboxPurchase, UserID: userID, Lines: lines, Code: code}
+	if err := insertOutboxEvent(ctx, tx, event); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("transaction commit error: %w", err)
+	}
+	return order, []*domain.OutboxEvent{event}, nil
+}
+
+const paymentColumns = `id, sale_id, COALESCE(order_id, 0), code, user_id, amount, currency, authorization_id, status, created_at`
+
+// querier runs queries on the pool or within a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func queryPayments(ctx context.Context, q querier, sql string, args ...any) ([]*domain.Payment, error) {
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("payments query error: %w", err)
+	}
+	defer rows.Close()
+
+	var payments []*domain.Payment
+	for rows.Next() {
+		var payment domain.Payment
+		err := rows.Scan(&payment.ID, &payment.SaleID, &payment.OrderID, &payment.Code, &payment.UserID,
+			&payment.Amount, &payment.Currency, &payment.AuthorizationID, &payment.Status, &payment.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("payments scan error: %w", err)
+		}
+		payments = append(payments, &payment)
+	}
+	return payments, rows.Err()
+}
+
+// SavePayment records an authorization taken for the purchase of a reservation.
+func (r *PostgresRepository) SavePayment(ctx context.Context, payment *domain.Payment) error {
+	sql := `INSERT INTO payments (sale_id, code, user_id, amount, currency, authorization_id, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	err := r.db.QueryRow(ctx, sql, payment.SaleID, payment.Code, payment.UserID, payment.Amount, payment.Currency,
+		payment.AuthorizationID, payment.Status).Scan(&payment.ID, &payment.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("payment insert error: %w", err)
+	}
+	return nil
+}
+
+// UpdatePaymentStatus records what actor did with a payment at the provider, in the audit trail
+// of its order too.
+func (r *PostgresRepository) UpdatePaymentStatus(ctx context.Context, id int64, status domain.PaymentStatus, actor string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("transaction begin error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID *int64
+	sql := `UPDATE payments SET status = $2, updated_at = now() WHERE id = $1 RETURNING order_id`
+	if err := tx.QueryRow(ctx, sql, id, status).Scan(&orderID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrPaymentNotFound
+		}
+		return fmt.Errorf("payment update error: %w", err)
+	}
+	if orderID != nil {
+		if err := insertOrderEvent(ctx, tx, *orderID, "payment_"+string(status), actor, ""); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("transaction commit error: %w", err)
+	}
+	return nil
+}
+
+// ListPaymentsToCapture returns authorized payments whose order was confirmed.
+func (r *PostgresRepository) ListPaymentsToCapture(ctx context.Context, limit int) ([]*domain.Payment, error) {
+	sql := `SELECT ` + paymentColumns + ` FROM payments p
+		WHERE p.status = 'authorized' AND EXISTS (SELECT 1 FROM sales s WHERE s.id = p.order_id AND s.status = 'confirmed')
+		ORDER BY p.id LIMIT $1`
+	return queryPayments(ctx, r.db, sql, limit)
+}
+
+// ListPaymentsToVoid returns authorized payments whose order was cancelled or deleted, and those
+// authorized before orphanedBefore that never got an order because their purchase failed.
+func (r *PostgresRepository) ListPaymentsToVoid(ctx context.Context, orphanedBefore time.Time, limit int) ([]*domain.Payment, error) {
+	sql := `SELECT ` + paymentColumns + ` FROM payments p
+		WHERE p.status = 'authorized' AND CASE
+			WHEN p.order_id IS NULL THEN p.created_at < $1
+			ELSE NOT EXISTS (SELECT 1 FROM sales s WHERE s.id = p.order_id AND s.status IN ('pending', 'confirmed'))
+		END
+		ORDER BY p.id LIMIT $2`
+	return queryPayments(ctx, r.db, sql, orphanedBefore, limit)
+}
+
+// FlagUnpaidOrders finds confirmed orders whose payment was voided, so their customer is not charged,
+// records an unpaid event in their audit trail and returns their payments. Every order is flagged once.
+func (r *PostgresRepository) FlagUnpaidOrders(ctx context.Context, actor string, limit int) ([]*domain.Payment, error) {
+	sql := `WITH unpaid AS (
+			SELECT p.* FROM payments p JOIN sales s ON s.id = p.order_id
+			WHERE p.status = 'voided' AND s.status = 'confirmed'
+				AND NOT EXISTS (SELECT 1 FROM payments q WHERE q.order_id = s.id AND q.status <> 'voided')
+				AND NOT EXISTS (SELECT 1 FROM order_events e WHERE e.order_id = s.id AND e.event = $1)
+			ORDER BY p.id LIMIT $3
+		), flagged AS (
+			INSERT INTO order_events (order_id, event, actor, detail)
+			SELECT order_id, $1, $2, 'payment ' || id || ' was voided' FROM unpaid
+		)
+		SELECT ` + paymentColumns + ` FROM unpaid ORDER BY id`
+	return queryPayments(ctx, r.db, sql, domain.OrderEventUnpaid, actor, limit)
+}
+
+func insertOutboxEvent(ctx context.Context, tx pgx.Tx, event *domain.OutboxEvent) error {
+	payload, err := json.Marshal(outboxPayload{UserID: event.UserID, Lines: event.Lines, Code: event.Code})
+	if err != nil {
+		return err
+	}
+	sql := `INSERT INTO outbox (sale_id, kind, payload) VALUES ($1, $2, $3) RETURNING id`
+	if err := tx.QueryRow(ctx, sql, event.SaleID, event.Kind, payload).Scan(&event.ID); err != nil {
+		return fmt.Errorf("outbox insert error: %w", err)
+	}
+	return nil
+}
+
+// outboxPayload is the JSON stored in the payload column of the outbox table.
+// ItemID is only set on events recorded before purchases had lines.
+type outboxPayload struct {
+	UserID string             `json:"user_id"`
+	Lines  []domain.OrderLine `json:"lines"`
+	ItemID string             `json:"item_id,omitempty"`
+	Code   string             `json:"code,omitempty"`
+}
+
+// ListPendingOutboxEvents returns the oldest events that were not acknowledged yet.
+func (r *PostgresRepository) ListPendingOutboxEvents(ctx context.Context, limit int) ([]*domain.OutboxEvent, error) {
+	sql := `SELECT id, sale_id, kind, payload, attempts FROM outbox WHERE processed_at IS NULL ORDER BY id LIMIT $1`
+	rows, err := r.db.Query(ctx, sql, limit)
+	if err != nil {
+		return nil, fmt.Errorf("outbox query error: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*domain.OutboxEvent
+	for rows.Next() {
+		var (
+			event   domain.OutboxEvent
+			payload []byte
+			data    outboxPayload
+		)
+		if err := rows.Scan(&event.ID, &event.SaleID, &event.Kind, &payload, &event.Attempts); err != nil {
+			return nil, fmt.Errorf("outbox scan error: %w", err)
+		}
+		if err := json.Unmarshal(payload, &data); err != nil {
+			return nil, fmt.Errorf("outbox payload error for event %d: %w", event.ID, err)
+		}
+		event.UserID, event.Lines, event.Code = data.UserID, data.Lines, data.Code
+		if len(event.Lines) == 0 && data.ItemID != "" {
+			// Recorded before purchases had lines
+			event.Lines = []domain.OrderLine{{ItemID: data.ItemID, Quantity: 1}}
+		}
+		events = append(events, &event)
 	}
+	return events, rows.Err()
+}
 
-	return tx.Commit(ctx)
+// AckOutboxEvent marks an event as applied to Redis.
+func (r *PostgresRepository) AckOutboxEvent(ctx context.Context, id int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE outbox SET processed_at = now(), attempts = attempts + 1 WHERE id = $1`, id)
+	return err
 }
 
-func (r *PostgresRepository) FinalizeSales(ctx context.Context) (int, error) {
+// FailOutboxEvent records a failed attempt to apply an event; it stays pending for the next retry.
+func (r *PostgresRepository) FailOutboxEvent(ctx context.Context, id int64, reason string) error {
+	_, err := r.db.Exec(ctx, `UPDATE outbox SET attempts = attempts + 1, last_error = $2 WHERE id = $1`, id, reason)
+	return err
+}
+
+// FinalizeToken returns the latest fencing token a finalization of the sale recorded, or 0 if none did.
+func (r *PostgresRepository) FinalizeToken(ctx context.Context, saleID int64) (int64, error) {
+	var token int64
+	err := r.db.QueryRow(ctx, `SELECT finalize_token FROM sales_events WHERE id = $1`, saleID).Scan(&token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, domain.ErrSaleNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("sale finalize token query error: %w", err)
+	}
+	return token, nil
+}
+
+// FinalizeSale settles the pending purchases of a settling sale with the outcome settle decides
+// for them, records the settlement and marks the sale as settled by nodeID.
+//
+// token is the fencing token of the finalization lease. It is recorded before any work starts,
+// and the work only commits while it is still the latest one, so a node whose lease expired
+// mid-run cannot finalize after another node took over.
+func (r *PostgresRepository) FinalizeSale(ctx context.Context, saleID int64, nodeID string, token int64,
+	settle func(sale *domain.Sale, pendingUnits int) (domain.SettlementOutcome, error)) (*domain.Settlement, error) {
+	sqlClaim := `UPDATE sales_events SET finalize_token = $2 WHERE id = $1 AND finalize_token < $2 AND finalized_at IS NULL`
+	tag, err := r.db.Exec(ctx, sqlClaim, saleID, token)
+	if err != nil {
+		return nil, fmt.Errorf("sale finalization claim error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		current, err := r.GetSale(ctx, saleID)
+		if err != nil {
+			return nil, err
+		}
+		if current.FinalizedAt != nil {
+			return nil, domain.ErrSaleFinalized
+		}
+		return nil, domain.ErrLeaseLost
+	}
+
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("transaction begin error: %w", err)
+		return nil, fmt.Errorf("transaction begin error: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	now := time.Now()
-	prevHourStart := now.Truncate(time.Hour).Add(-time.Hour)
-	prevHourEnd := prevHourStart.Add(time.Hour)
+	// Lock the sale row so concurrent finalizations of the same sale serialize
+	var currentToken int64
+	sqlLock := `SELECT finalize_token FROM sales_events WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRow(ctx, sqlLock, saleID).Scan(&currentToken); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, domain.ErrSaleNotFound
+		}
+		return nil, fmt.Errorf("sale lock error: %w", err)
+	}
+	if currentToken != token {
+		return nil, domain.ErrLeaseLost
+	}
+	// Read the sale under the lock so the latest settlement policy applies
+	sale, err := scanSale(tx.QueryRow(ctx, `SELECT `+saleColumns+` FROM sales_events WHERE id = $1`, saleID))
+	if err != nil {
+		return nil, err
+	}
+	if sale.FinalizedAt != nil {
+		return nil, domain.ErrSaleFinalized
+	}
+	if sale.Status != domain.SaleSettling {
+		return nil, domain.TransitionError(sale.Status, domain.SaleSettled)
+	}
 
-	var pendingCount int
-	sqlCount := `SELECT COUNT(*) FROM sales WHERE status = 'pending' AND purchased_at >= $1 AND purchased_at < $2`
-	if err := tx.QueryRow(ctx, sqlCount, prevHourStart, prevHourEnd).Scan(&pendingCount); err != nil {
-		return 0, fmt.Errorf("pending sales count error: %w", err)
+	var pendingCount, pendingUnits int
+	sqlCount := `SELECT COUNT(DISTINCT s.id), COALESCE(SUM(l.quantity), 0)
+		FROM sales s LEFT JOIN order_lines l ON l.order_id = s.id WHERE s.status = 'pending' AND s.sale_id = $1`
+	if err := tx.QueryRow(ctx, sqlCount, saleID).Scan(&pendingCount, &pendingUnits); err != nil {
+		return nil, fmt.Errorf("pending sales count error: %w", err)
 	}
 
-	if pendingCount == 10000 {
-		sqlConfirm := `UPDATE sales SET status = 'confirmed', committed_at = now() WHERE status = 'pending' AND purchased_at >= $1 AND purchased_at < $2`
-		if _, err := tx.Exec(ctx, sqlConfirm, prevHourStart, prevHourEnd); err != nil {
-			return 0, fmt.Errorf("sales confirmation error: %w", err)
+	outcome, err := settle(sale, pendingUnits)
+	if err != nil {
+		return nil, err
+	}
+	orderEvent := map[domain.SettlementOutcome]string{
+		domain.SettlementConfirmed: domain.OrderEventConfirmed,
+		domain.SettlementCancelled: domain.OrderEventCancelled,
+		domain.SettlementDeleted:   domain.OrderEventDiscarded,
+	}[outcome]
+	if orderEvent != "" {
+		detail := "settlement policy " + string(sale.SettlementPolicy)
+		if err := insertPendingOrderEvents(ctx, tx, saleID, orderEvent, nodeID, detail); err != nil {
+			return nil, err
+		}
+	}
+	switch outcome {
+	case domain.SettlementConfirmed:
+		sqlConfirm := `UPDATE sales SET status = 'confirmed', committed_at = now() WHERE status = 'pending' AND sale_id = $1`
+		if _, err := tx.Exec(ctx, sqlConfirm, saleID); err != nil {
+			return nil, fmt.Errorf("sales confirmation error: %w", err)
 		}
-	} else {
-		sqlDelete := `DELETE FROM sales WHERE status = 'pending' AND purchased_at >= $1 AND purchased_at < $2`
-		if _, err := tx.Exec(ctx, sqlDelete, prevHourStart, prevHourEnd); err != nil {
-			return 0, fmt.Errorf("pending sales deletion error: %w", err)
+	case domain.SettlementCancelled:
+		sqlCancel := `UPDATE sales SET status = 'cancelled', cancelled_at = now() WHERE status = 'pending' AND sale_id = $1`
+		if _, err := tx.Exec(ctx, sqlCancel, saleID); err != nil {
+			return nil, fmt.Errorf("sales cancellation error: %w", err)
 		}
+	case domain.SettlementDeleted:
+		sqlDelete := `DELETE FROM sales WHERE status = 'pending' AND sale_id = $1`
+		if _, err := tx.Exec(ctx, sqlDelete, saleID); err != nil {
+			return nil, fmt.Errorf("pending sales deletion error: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown settlement outcome %q", outcome)
+	}
+
+	settlement := &domain.Settlement{
+		SaleID:    saleID,
+		Policy:    sale.SettlementPolicy,
+		Threshold: sale.SettlementThreshold,
+		Outcome:   outcome,
+		Purchases: pendingCount,
+		Units:     pendingUnits,
+		SettledBy: nodeID,
+	}
+	sqlSettlement := `INSERT INTO settlements (sale_id, policy, threshold, outcome, purchases, units, settled_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, settled_at`
+	err = tx.QueryRow(ctx, sqlSettlement, saleID, settlement.Policy, settlement.Threshold, settlement.Outcome,
+		settlement.Purchases, settlement.Units, settlement.SettledBy).Scan(&settlement.ID, &settlement.SettledAt)
+	if err != nil {
+		return nil, fmt.Errorf("settlement insert error: %w", err)
+	}
+
+	sqlFinalize := `UPDATE sales_events SET status = 'settled', finalized_at = now(), finalized_by = $2 WHERE id = $1`
+	if _, err := tx.Exec(ctx, sqlFinalize, saleID, nodeID); err != nil {
+		return nil, fmt.Errorf("sale finalization mark error: %w", err)
 	}
 
 	if err := tx.Commit(ctx); err != nil {
-		return 0, fmt.Errorf("transaction commit error: %w", err)
+		return nil, fmt.Errorf("transaction commit error: %w", err)
+	}
+
+	return settlement, nil
+}
+
+// GetSettlement returns the settlement recorded when a sale was finalized.
+func (r *PostgresRepository) GetSettlement(ctx context.Context, saleID int64) (*domain.Settlement, error) {
+	var settlement domain.Settlement
+	sql := `SELECT id, sale_id, policy, threshold, outcome, purchases, units, settled_by, settled_at FROM settlements WHERE sale_id = $1`
+	err := r.db.QueryRow(ctx, sql, saleID).Scan(&settlement.ID, &settlement.SaleID, &settlement.Policy, &settlement.Threshold,
+		&settlement.Outcome, &settlement.Purchases, &settlement.Units, &settlement.SettledBy, &settlement.SettledAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrSettlementNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("settlement query error: %w", err)
+	}
+	return &settlement, nil
+}
+
+// LoadSaleState derives from a single consistent snapshot the state Redis should hold for a sale:
+// sold and available units per item, per-user purchase counts and the reservations that have not expired yet.
+func (r *PostgresRepository) LoadSaleState(ctx context.Context, saleID int64, reservationTimeout time.Duration) (*domain.SaleState, error) {
+	tx, err := r.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("transaction begin error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	state := &domain.SaleState{
+		SaleID:        saleID,
+		SoldItems:     make(map[string]int64),
+		Stock:         make(map[string]int64),
+		UserPurchases: make(map[string]int64),
+		Reservations:  make(map[string]domain.Reservation),
+	}
+
+	sqlSold := `SELECT s.user_id, l.item_id, l.quantity FROM sales s JOIN order_lines l ON l.order_id = s.id
+		WHERE s.sale_id = $1 AND s.status IN ('pending', 'confirmed')`
+	rows, err := tx.Query(ctx, sqlSold, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("sold items query error: %w", err)
+	}
+	for rows.Next() {
+		var (
+			userID, itemID string
+			quantity       int64
+		)
+		if err := rows.Scan(&userID, &itemID, &quantity); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("sold items scan error: %w", err)
+		}
+		state.SoldItems[itemID] += quantity
+		state.SoldCount += quantity
+		state.UserPurchases[userID] += quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sold items query error: %w", err)
+	}
+
+	// Every unused checkout that has not expired is a live reservation, and so is every lottery win
+	// not purchased yet, which is held until the sale ends
+	sqlReservations := `SELECT c.code, c.user_id, c.lines, c.created_at::timestamptz + make_interval(secs => $2)
+		FROM checkout_attempts c
+		WHERE c.sale_id = $1 AND NOT c.used
+			AND c.created_at::timestamptz + make_interval(secs => $2) > now()
+			AND NOT EXISTS (SELECT 1 FROM sales s WHERE s.code = c.code)
+		UNION ALL
+		SELECT e.code, e.user_id, e.lines, v.ends_at
+		FROM lottery_entries e JOIN sales_events v ON v.id = e.sale_id
+		WHERE e.sale_id = $1 AND e.status = 'won' AND v.ends_at > now()
+			AND NOT EXISTS (SELECT 1 FROM sales s WHERE s.code = e.code)`
+	rows, err = tx.Query(ctx, sqlReservations, saleID, reservationTimeout.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("reservations query error: %w", err)
+	}
+	for rows.Next() {
+		var res domain.Reservation
+		if err := rows.Scan(&res.Code, &res.UserID, &res.Lines, &res.ExpiresAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("reservations scan error: %w", err)
+		}
+		state.Reservations[res.Code] = res
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reservations query error: %w", err)
+	}
+
+	// Whatever is neither sold nor reserved is available
+	rows, err = tx.Query(ctx, `SELECT sku, stock FROM catalog_items WHERE sale_id = $1`, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("catalog query error: %w", err)
+	}
+	for rows.Next() {
+		var (
+			sku   string
+			stock int64
+		)
+		if err := rows.Scan(&sku, &stock); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("catalog scan error: %w", err)
+		}
+		state.Stock[sku] = stock - state.SoldItems[sku]
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog query error: %w", err)
 	}
+	for _, res := range state.Reservations {
+		for _, line := range res.Lines {
+			if _, ok := state.Stock[line.ItemID]; ok {
+				state.Stock[line.ItemID] -= int64(line.Quantity)
+			}
+		}
+	}
+
+	sqlOutbox := `SELECT id FROM outbox WHERE sale_id = $1 AND processed_at IS NULL`
+	rows, err = tx.Query(ctx, sqlOutbox, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("outbox query error: %w", err)
+	}
+	state.PendingOutboxEvents, err = pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("outbox scan error: %w", err)
+	}
+
+	return state, nil
+}
+
+// SamplePurchases returns up to limit random purchase lines of a sale with the units sold of their
+// item, the user's current purchased units, the units sold by the sale and the units of the item left.
+// Lines whose user or item has outbox events still pending are skipped, as Redis is expected to lag behind them.
+func (r *PostgresRepository) SamplePurchases(ctx context.Context, saleID int64, limit int) ([]*domain.PurchaseSample, error) {
+	sql := `SELECT s.code, s.user_id, l.item_id, sold.units,
+			(SELECT COALESCE(SUM(ul.quantity), 0) FROM sales u JOIN order_lines ul ON ul.order_id = u.id
+				WHERE u.sale_id = s.sale_id AND u.user_id = s.user_id AND u.status IN ('pending', 'confirmed')),
+			(SELECT COALESCE(SUM(al.quantity), 0) FROM sales a JOIN order_lines al ON al.order_id = a.id
+				WHERE a.sale_id = $1 AND a.status IN ('pending', 'confirmed')),
+			c.stock - sold.units
+		FROM sales s JOIN order_lines l ON l.order_id = s.id
+			LEFT JOIN catalog_items c ON c.sale_id = s.sale_id AND c.sku = l.item_id
+			CROSS JOIN LATERAL (SELECT COALESCE(SUM(il.quantity), 0) AS units FROM sales i
+				JOIN order_lines il ON il.order_id = i.id
+				WHERE i.sale_id = s.sale_id AND il.item_id = l.item_id AND i.status IN ('pending', 'confirmed')) sold
+		WHERE s.sale_id = $1 AND s.status IN ('pending', 'confirmed') AND s.code IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM outbox o WHERE o.sale_id = s.sale_id AND o.processed_at IS NULL
+				AND (o.payload->>'user_id' = s.user_id
+					OR o.payload->'lines' @> jsonb_build_array(jsonb_build_object('item_id', l.item_id))
+					OR o.payload->>'item_id' = l.item_id))
+		ORDER BY random() LIMIT $2`
+	rows, err := r.db.Query(ctx, sql, saleID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("purchase sample query error: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []*domain.PurchaseSample
+	for rows.Next() {
+		sample := &domain.PurchaseSample{SaleID: saleID}
+		err := rows.Scan(&sample.Code, &sample.UserID, &sample.ItemID, &sample.ItemSold, &sample.UserPurchases,
+			&sample.SoldCount, &sample.ItemAvailable)
+		if err != nil {
+			return nil, fmt.Errorf("purchase sample scan error: %w", err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+// GetIdempotencyRecord returns the stored outcome of a request, or nil if there is none.
+func (r *PostgresRepository) GetIdempotencyRecord(ctx context.Context, scope, key string) (*domain.IdempotencyRecord, error) {
+	record := domain.IdempotencyRecord{Completed: true}
+	sql := `SELECT fingerprint, status_code, body FROM idempotency_keys WHERE scope = $1 AND key = $2`
+	err := r.db.QueryRow(ctx, sql, scope, key).Scan(&record.Fingerprint, &record.StatusCode, &record.Body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("idempotency record query error: %w", err)
+	}
+	return &record, nil
+}
 
-	return pendingCount, nil
+// SaveIdempotencyRecord persists the outcome of a completed request. The first stored outcome wins.
+func (r *PostgresRepository) SaveIdempotencyRecord(ctx context.Context, scope, key string, record *domain.IdempotencyRecord) error {
+	sql := `INSERT INTO idempotency_keys (scope, key, fingerprint, status_code, body) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (scope, key) DO NOTHING`
+	_, err := r.db.Exec(ctx, sql, scope, key, record.Fingerprint, record.StatusCode, record.Body)
+	return err
 }
 
 func InitDB(ctx context.Context, dbPool *pgxpool.Pool) error {
 	queries := []string{
+		`CREATE TABLE IF NOT EXISTS sales_events (
+			id BIGSERIAL PRIMARY KEY, name TEXT NOT NULL,
+			starts_at TIMESTAMPTZ NOT NULL, ends_at TIMESTAMPTZ NOT NULL,
+			item_quota INTEGER NOT NULL, per_user_limit INTEGER NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(), finalized_at TIMESTAMPTZ,
+			CHECK (ends_at > starts_at)
+		)`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS max_concurrent_reservations INTEGER NOT NULL DEFAULT 10`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS finalized_by TEXT`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS finalize_token BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'scheduled'`,
+		// Sales finalized before the status column existed were all settled and still carry its default;
+		// aborted sales are finalized too and must stay cancelled.
+		`UPDATE sales_events SET status = 'settled' WHERE finalized_at IS NOT NULL AND status = 'scheduled'`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS settlement_policy TEXT NOT NULL DEFAULT 'all_or_nothing'`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS settlement_threshold INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS admission_rate INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE sales_events ADD COLUMN IF NOT EXISTS mode TEXT NOT NULL DEFAULT 'first_come'`,
+		`CREATE INDEX IF NOT EXISTS sales_events_window_idx ON sales_events(ends_at) WHERE finalized_at IS NULL`,
 		`CREATE TABLE IF NOT EXISTS checkout_attempts (
 			id SERIAL PRIMARY KEY, user_id TEXT NOT NULL, item_id TEXT NOT NULL,
 			code TEXT NOT NULL UNIQUE, created_at TIMESTAMP DEFAULT NOW(), used BOOLEAN DEFAULT FALSE
 		)`,
+		`ALTER TABLE checkout_attempts ADD COLUMN IF NOT EXISTS sale_id BIGINT REFERENCES sales_events(id) ON DELETE CASCADE`,
+		`ALTER TABLE checkout_attempts ADD COLUMN IF NOT EXISTS lines JSONB`,
+		`UPDATE checkout_attempts SET lines = jsonb_build_array(jsonb_build_object('item_id', item_id, 'quantity', 1))
+			WHERE lines IS NULL`,
+		`ALTER TABLE checkout_attempts ALTER COLUMN lines SET NOT NULL`,
+		`ALTER TABLE checkout_attempts ALTER COLUMN item_id DROP NOT NULL`,
 		`CREATE TABLE IF NOT EXISTS sales (
 			id SERIAL PRIMARY KEY, user_id TEXT NOT NULL, item_id TEXT NOT NULL, status VARCHAR(20) NOT NULL,
 			purchased_at TIMESTAMP DEFAULT NOW(), committed_at TIMESTAMP
 		)`,
+		`ALTER TABLE sales ADD COLUMN IF NOT EXISTS sale_id BIGINT REFERENCES sales_events(id)`,
 		`CREATE INDEX IF NOT EXISTS sales_status_idx ON sales(status)`,
 		`CREATE INDEX IF NOT EXISTS sales_purchased_idx ON sales(purchased_at)`,
+		`CREATE INDEX IF NOT EXISTS sales_sale_status_idx ON sales(sale_id, status)`,
+		`ALTER TABLE sales ADD COLUMN IF NOT EXISTS code TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS sales_code_key ON sales(code)`,
+		`DROP INDEX IF EXISTS sales_sale_item_key`,
+		`DROP INDEX IF EXISTS sales_sale_item_idx`,
+		`CREATE INDEX IF NOT EXISTS sales_sale_user_idx ON sales(sale_id, user_id)`,
+		`CREATE TABLE IF NOT EXISTS order_lines (
+			order_id INTEGER NOT NULL REFERENCES sales(id) ON DELETE CASCADE, item_id TEXT NOT NULL,
+			quantity INTEGER NOT NULL CHECK (quantity > 0), PRIMARY KEY (order_id, item_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS order_lines_item_idx ON order_lines(item_id)`,
+		`ALTER TABLE order_lines ADD COLUMN IF NOT EXISTS unit_price BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE order_lines ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sales ADD COLUMN IF NOT EXISTS total BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE sales ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sales ALTER COLUMN item_id DROP NOT NULL`,
+		`INSERT INTO order_lines (order_id, item_id, quantity) SELECT id, item_id, 1 FROM sales WHERE item_id IS NOT NULL
+			ON CONFLICT DO NOTHING`,
+		`UPDATE sales SET item_id = NULL WHERE item_id IS NOT NULL`,
+		`CREATE TABLE IF NOT EXISTS catalog_items (
+			sale_id BIGINT NOT NULL REFERENCES sales_events(id) ON DELETE CASCADE, sku TEXT NOT NULL,
+			name TEXT NOT NULL, stock INTEGER NOT NULL CHECK (stock >= 0), created_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (sale_id, sku)
+		)`,
+		`ALTER TABLE catalog_items ADD COLUMN IF NOT EXISTS price BIGINT NOT NULL DEFAULT 0 CHECK (price >= 0)`,
+		`ALTER TABLE catalog_items ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS payments (
+			id BIGSERIAL PRIMARY KEY, sale_id BIGINT NOT NULL REFERENCES sales_events(id) ON DELETE CASCADE,
+			order_id INTEGER, code TEXT NOT NULL, user_id TEXT NOT NULL, amount BIGINT NOT NULL, currency TEXT NOT NULL,
+			authorization_id TEXT NOT NULL, status TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(), updated_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS payments_authorized_idx ON payments(id) WHERE status = 'authorized'`,
+		`CREATE INDEX IF NOT EXISTS payments_order_idx ON payments(order_id)`,
+		`ALTER TABLE sales ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ`,
+		`CREATE TABLE IF NOT EXISTS order_events (
+			id BIGSERIAL PRIMARY KEY, order_id INTEGER NOT NULL, event TEXT NOT NULL, actor TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '', created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS order_events_order_idx ON order_events(order_id, id)`,
+		`CREATE TABLE IF NOT EXISTS refunds (
+			id BIGSERIAL PRIMARY KEY, order_id INTEGER NOT NULL UNIQUE, payment_id BIGINT REFERENCES payments(id),
+			amount BIGINT NOT NULL, currency TEXT NOT NULL, status TEXT NOT NULL, reason TEXT NOT NULL DEFAULT '',
+			requested_at TIMESTAMPTZ DEFAULT NOW(), processed_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS refunds_requested_idx ON refunds(id) WHERE status = 'requested'`,
+		`CREATE TABLE IF NOT EXISTS lotteries (
+			sale_id BIGINT PRIMARY KEY REFERENCES sales_events(id) ON DELETE CASCADE,
+			seed TEXT NOT NULL, seed_hash TEXT NOT NULL, entries INTEGER NOT NULL DEFAULT 0,
+			winners INTEGER NOT NULL DEFAULT 0, units INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ DEFAULT NOW(), drawn_at TIMESTAMPTZ, drawn_by TEXT
+		)`,
+		`ALTER TABLE lotteries ADD COLUMN IF NOT EXISTS entries_hash TEXT`,
+		`CREATE TABLE IF NOT EXISTS lottery_entries (
+			id BIGSERIAL PRIMARY KEY, sale_id BIGINT NOT NULL REFERENCES sales_events(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL, lines JSONB NOT NULL, status TEXT NOT NULL, rank INTEGER, code TEXT UNIQUE,
+			created_at TIMESTAMPTZ DEFAULT NOW(), drawn_at TIMESTAMPTZ, notified_at TIMESTAMPTZ,
+			UNIQUE (sale_id, user_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS lottery_entries_notify_idx ON lottery_entries(id)
+			WHERE status <> 'entered' AND notified_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS waitlist_entries (
+			id BIGSERIAL PRIMARY KEY, sale_id BIGINT NOT NULL REFERENCES sales_events(id) ON DELETE CASCADE,
+			item_id TEXT NOT NULL, user_id TEXT NOT NULL, quantity INTEGER NOT NULL CHECK (quantity > 0),
+			status TEXT NOT NULL, code TEXT UNIQUE, created_at TIMESTAMPTZ DEFAULT NOW(),
+			reserved_at TIMESTAMPTZ, notified_at TIMESTAMPTZ
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS waitlist_entries_waiting_key ON waitlist_entries(sale_id, item_id, user_id)
+			WHERE status = 'waiting'`,
+		`CREATE INDEX IF NOT EXISTS waitlist_entries_queue_idx ON waitlist_entries(sale_id, item_id, id) WHERE status = 'waiting'`,
+		`CREATE INDEX IF NOT EXISTS waitlist_entries_notify_idx ON waitlist_entries(id)
+			WHERE status = 'reserved' AND notified_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS outbox (
+			id BIGSERIAL PRIMARY KEY, sale_id BIGINT NOT NULL, kind TEXT NOT NULL, payload JSONB NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0, last_error TEXT,
+			created_at TIMESTAMPTZ DEFAULT NOW(), processed_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox(id) WHERE processed_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS settlements (
+			id BIGSERIAL PRIMARY KEY, sale_id BIGINT NOT NULL UNIQUE REFERENCES sales_events(id) ON DELETE CASCADE,
+			policy TEXT NOT NULL, threshold INTEGER NOT NULL DEFAULT 0, outcome TEXT NOT NULL, purchases INTEGER NOT NULL,
+			settled_by TEXT NOT NULL, settled_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`ALTER TABLE settlements ADD COLUMN IF NOT EXISTS units INTEGER`,
+		`UPDATE settlements SET units = purchases WHERE units IS NULL`,
+		`ALTER TABLE settlements ALTER COLUMN units SET NOT NULL`,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			scope TEXT NOT NULL, key TEXT NOT NULL, fingerprint TEXT NOT NULL,
+			status_code INTEGER NOT NULL, body BYTEA NOT NULL, created_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (scope, key)
+		)`,
 	}
 	for _, q := range queries {
 		if _, err := dbPool.Exec(ctx, q); err != nil {
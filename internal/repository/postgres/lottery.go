@@ -0,0 +1,189 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"flash/internal/domain"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// CreateLottery records the seed of a lottery sale's draw, unless the sale has one already,
+// and returns the lottery as stored.
+func (r *PostgresRepository) CreateLottery(ctx context.Context, saleID int64, seed, seedHash string) (*domain.Lottery, error) {
+	sql := `INSERT INTO lotteries (sale_id, seed, seed_hash) VALUES ($1, $2, $3) ON CONFLICT (sale_id) DO NOTHING`
+	if _, err := r.db.Exec(ctx, sql, saleID, seed, seedHash); err != nil {
+		return nil, fmt.Errorf("lottery insert error: %w", err)
+	}
+	return r.GetLottery(ctx, saleID)
+}
+
+// GetLottery returns the lottery of a sale, or domain.ErrNotLottery if it has none.
+func (r *PostgresRepository) GetLottery(ctx context.Context, saleID int64) (*domain.Lottery, error) {
+	lottery := domain.Lottery{SaleID: saleID}
+	sql := `SELECT seed, seed_hash, COALESCE(entries_hash, ''), entries, winners, units, drawn_at, COALESCE(drawn_by, ''), created_at
+		FROM lotteries WHERE sale_id = $1`
+	err := r.db.QueryRow(ctx, sql, saleID).Scan(&lottery.Seed, &lottery.SeedHash, &lottery.EntriesHash, &lottery.Entries,
+		&lottery.Winners, &lottery.Units, &lottery.DrawnAt, &lottery.DrawnBy, &lottery.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrNotLottery
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lottery query error: %w", err)
+	}
+	return &lottery, nil
+}
+
+// ListLotteriesToDraw returns open lottery sales whose draw is due and has not completed yet.
+func (r *PostgresRepository) ListLotteriesToDraw(ctx context.Context, now time.Time) ([]*domain.Sale, error) {
+	sql := `SELECT ` + saleColumns + ` FROM sales_events
+		WHERE mode = 'lottery' AND status = 'open' AND starts_at <= $1 AND ends_at > $1
+			AND id NOT IN (SELECT sale_id FROM lotteries WHERE drawn_at IS NOT NULL)
+		ORDER BY starts_at, id`
+	return r.querySales(ctx, sql, now)
+}
+
+// CompleteLotteryDraw records that every entry of a lottery was drawn, together with the hash of
+// the entries the draw was made from and the number of entries, winners and units won.
+func (r *PostgresRepository) CompleteLotteryDraw(ctx context.Context, saleID int64, nodeID, entriesHash string) (*domain.Lottery, error) {
+	sql := `UPDATE lotteries SET drawn_at = now(), drawn_by = $2, entries_hash = $3,
+			entries = (SELECT COUNT(*) FROM lottery_entries WHERE sale_id = $1),
+			winners = (SELECT COUNT(*) FROM lottery_entries WHERE sale_id = $1 AND status = 'won'),
+			units = (SELECT COALESCE(SUM((l->>'quantity')::int), 0)
+				FROM lottery_entries e, jsonb_array_elements(e.lines) l WHERE e.sale_id = $1 AND e.status = 'won')
+		WHERE sale_id = $1 AND drawn_at IS NULL`
+	if _, err := r.db.Exec(ctx, sql, saleID, nodeID, entriesHash); err != nil {
+		return nil, fmt.Errorf("lottery draw update error: %w", err)
+	}
+	return r.GetLottery(ctx, saleID)
+}
+
+const entryColumns = `id, sale_id, user_id, lines, status, COALESCE(rank, 0), COALESCE(code, ''), created_at, drawn_at`
+
+func scanEntry(row pgx.Row) (*domain.LotteryEntry, error) {
+	var entry domain.LotteryEntry
+	err := row.Scan(&entry.ID, &entry.SaleID, &entry.UserID, &entry.Lines, &entry.Status, &entry.Rank, &entry.Code,
+		&entry.CreatedAt, &entry.DrawnAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// SaveLotteryEntry records a new entry. A user can enter a lottery once; a second entry
+// returns domain.ErrDuplicateEntry. Entries are only taken while the sale is scheduled and has not
+// started; later ones return domain.ErrLotteryClosed.
+func (r *PostgresRepository) SaveLotteryEntry(ctx context.Context, entry *domain.LotteryEntry) error {
+	encoded, err := json.Marshal(entry.Lines)
+	if err != nil {
+		return err
+	}
+	// The shared lock on the sale makes opening it, and so the draw, wait for the entry
+	sql := `INSERT INTO lottery_entries (sale_id, user_id, lines, status)
+		SELECT $1::bigint, $2::text, $3::jsonb, $4::text WHERE EXISTS (
+			SELECT 1 FROM sales_events WHERE id = $1 AND status = 'scheduled' AND starts_at > now() FOR SHARE)
+		RETURNING id, created_at`
+	err = r.db.QueryRow(ctx, sql, entry.SaleID, entry.UserID, encoded, entry.Status).Scan(&entry.ID, &entry.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.ErrLotteryClosed
+	}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return domain.ErrDuplicateEntry
+		}
+		return fmt.Errorf("lottery entry insert error: %w", err)
+	}
+	return nil
+}
+
+// GetLotteryEntry returns the entry of a user in a lottery.
+func (r *PostgresRepository) GetLotteryEntry(ctx context.Context, saleID int64, userID string) (*domain.LotteryEntry, error) {
+	sql := `SELECT ` + entryColumns + ` FROM lottery_entries WHERE sale_id = $1 AND user_id = $2`
+	entry, err := scanEntry(r.db.QueryRow(ctx, sql, saleID, userID))
+	if err != nil && !errors.Is(err, domain.ErrEntryNotFound) {
+		return nil, fmt.Errorf("lottery entry query error: %w", err)
+	}
+	return entry, err
+}
+
+// ListLotteryEntries returns every entry of a lottery, in draw order once drawn.
+func (r *PostgresRepository) ListLotteryEntries(ctx context.Context, saleID int64) ([]*domain.LotteryEntry, error) {
+	sql := `SELECT ` + entryColumns + ` FROM lottery_entries WHERE sale_id = $1 ORDER BY rank NULLS LAST, id`
+	return r.queryEntries(ctx, sql, saleID)
+}
+
+// ListClosedLotteryEntries returns every entry of a lottery to draw it from, once its sale is no
+// longer scheduled. Locking the sale waits for entries that are still being saved, and entries
+// saved afterwards find the sale open and are turned away, so the list is final.
+func (r *PostgresRepository) ListClosedLotteryEntries(ctx context.Context, saleID int64) ([]*domain.LotteryEntry, error) {
+	var status domain.SaleStatus
+	err := r.db.QueryRow(ctx, `SELECT status FROM sales_events WHERE id = $1 FOR UPDATE`, saleID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrSaleNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sale status query error: %w", err)
+	}
+	if status == domain.SaleScheduled {
+		return nil, domain.ErrSaleNotActive
+	}
+	return r.ListLotteryEntries(ctx, saleID)
+}
+
+// ListEntriesToNotify returns drawn entries whose users have not been told the outcome yet.
+func (r *PostgresRepository) ListEntriesToNotify(ctx context.Context, limit int) ([]*domain.LotteryEntry, error) {
+	sql := `SELECT ` + entryColumns + ` FROM lottery_entries WHERE status <> 'entered' AND notified_at IS NULL
+		ORDER BY id LIMIT $1`
+	return r.queryEntries(ctx, sql, limit)
+}
+
+func (r *PostgresRepository) queryEntries(ctx context.Context, sql string, args ...any) ([]*domain.LotteryEntry, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("lottery entries query error: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*domain.LotteryEntry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("lottery entries scan error: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// UpdateLotteryEntry stores the rank, code and status of an entry during the draw.
+// An entry that is no longer entered is stamped as drawn.
+func (r *PostgresRepository) UpdateLotteryEntry(ctx context.Context, entry *domain.LotteryEntry) error {
+	sql := `UPDATE lottery_entries SET rank = $2, code = NULLIF($3, ''), status = $4,
+		drawn_at = CASE WHEN $4 = 'entered' THEN NULL ELSE now() END
+		WHERE id = $1 RETURNING drawn_at`
+	err := r.db.QueryRow(ctx, sql, entry.ID, entry.Rank, entry.Code, entry.Status).Scan(&entry.DrawnAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.ErrEntryNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("lottery entry update error: %w", err)
+	}
+	return nil
+}
+
+// MarkEntryNotified records that the user of an entry was told the outcome of the draw.
+func (r *PostgresRepository) MarkEntryNotified(ctx context.Context, entryID int64) error {
+	if _, err := r.db.Exec(ctx, `UPDATE lottery_entries SET notified_at = now() WHERE id = $1`, entryID); err != nil {
+		return fmt.Errorf("lottery entry update error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"flash/internal/domain"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// insertOrderEvent appends an entry to the audit trail of an order.
+func insertOrderEvent(ctx context.Context, tx pgx.Tx, orderID int64, event, actor, detail string) error {
+	sql := `INSERT INTO order_events (order_id, event, actor, detail) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(ctx, sql, orderID, event, actor, detail); err != nil {
+		return fmt.Errorf("order event insert error: %w", err)
+	}
+	return nil
+}
+
+// insertPendingOrderEvents appends the same entry to the audit trail of every pending order of a sale,
+// before they are settled or cancelled together.
+func insertPendingOrderEvents(ctx context.Context, tx pgx.Tx, saleID int64, event, actor, detail string) error {
+	sql := `INSERT INTO order_events (order_id, event, actor, detail)
+		SELECT id, $2, $3, $4 FROM sales WHERE status = 'pending' AND sale_id = $1`
+	if _, err := tx.Exec(ctx, sql, saleID, event, actor, detail); err != nil {
+		return fmt.Errorf("order events insert error: %w", err)
+	}
+	return nil
+}
+
+// ListOrderEvents returns the audit trail of an order, oldest first.
+func (r *PostgresRepository) ListOrderEvents(ctx context.Context, orderID int64) ([]*domain.OrderEvent, error) {
+	sql := `SELECT id, order_id, event, actor, detail, created_at FROM order_events WHERE order_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, sql, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("order events query error: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*domain.OrderEvent
+	for rows.Next() {
+		var event domain.OrderEvent
+		if err := rows.Scan(&event.ID, &event.OrderID, &event.Event, &event.Actor, &event.Detail, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("order events scan error: %w", err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		// Orders from before the audit trail have none; tell them from orders that never existed
+		var exists bool
+		if err := r.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM sales WHERE id = $1)`, orderID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("order query error: %w", err)
+		}
+		if !exists {
+			return nil, domain.ErrOrderNotFound
+		}
+	}
+	return events, nil
+}
+
+// getOrderForUpdate loads an order with its lines and locks it for the rest of the transaction.
+func getOrderForUpdate(ctx context.Context, tx pgx.Tx, orderID int64) (*domain.Order, error) {
+	order := &domain.Order{ID: orderID}
+	sql := `SELECT sale_id, user_id, COALESCE(code, ''), status, total, currency, purchased_at
+		FROM sales WHERE id = $1 FOR UPDATE`
+	err := tx.QueryRow(ctx, sql, orderID).Scan(&order.SaleID, &order.UserID, &order.Code, &order.Status,
+		&order.Total, &order.Currency, &order.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("order query error: %w", err)
+	}
+	if order.Lines, err = queryOrderLines(ctx, tx, orderID); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// GetOrderByCode returns the order placed with a reservation code, with its lines.
+func (r *PostgresRepository) GetOrderByCode(ctx context.Context, code string) (*domain.Order, error) {
+	order := &domain.Order{Code: code}
+	sql := `SELECT id, sale_id, user_id, status, total, currency, purchased_at FROM sales WHERE code = $1`
+	err := r.db.QueryRow(ctx, sql, code).Scan(&order.ID, &order.SaleID, &order.UserID, &order.Status,
+		&order.Total, &order.Currency, &order.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("order query error: %w", err)
+	}
+	if order.Lines, err = queryOrderLines(ctx, r.db, order.ID); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func queryOrderLines(ctx context.Context, q querier, orderID int64) ([]domain.OrderLine, error) {
+	sql := `SELECT item_id, quantity, unit_price, currency FROM order_lines WHERE order_id = $1 ORDER BY item_id`
+	rows, err := q.Query(ctx, sql, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("order lines query error: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []domain.OrderLine
+	for rows.Next() {
+		var line domain.OrderLine
+		if err := rows.Scan(&line.ItemID, &line.Quantity, &line.UnitPrice, &line.Currency); err != nil {
+			return nil, fmt.Errorf("order lines scan error: %w", err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// CancelOrder cancels an order on behalf of actor. When userID is not empty the order has to belong
+// to that user; other users' orders are reported as not found.
+//
+// A pending order is cancelled together with an outbox event that releases its units in Redis,
+// and its payment is returned so it can be voided. A confirmed order is cancelled with a refund
+// request for its total. Every step is recorded in the order's audit trail.
+func (r *PostgresRepository) CancelOrder(ctx context.Context, orderID int64, userID, actor, reason string) (*domain.Cancellation, []*domain.OutboxEvent, error) {
+	// The sale is locked before the order, in the same order purchases and finalization take
+	// their locks, so a cancellation cannot deadlock with them
+	var saleID int64
+	err := r.db.QueryRow(ctx, `SELECT sale_id FROM sales WHERE id = $1`, orderID).Scan(&saleID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, domain.ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("order query error: %w", err)
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transaction begin error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM sales_events WHERE id = $1 FOR SHARE`, saleID); err != nil {
+		return nil, nil, fmt.Errorf("sale lock error: %w", err)
+	}
+	order, err := getOrderForUpdate(ctx, tx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userID != "" && order.UserID != userID {
+		return nil, nil, domain.ErrOrderNotFound
+	}
+
+	payments, err := queryPayments(ctx, tx, `SELECT `+paymentColumns+` FROM payments p WHERE p.order_id = $1`, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	cancellation := &domain.Cancellation{Order: order}
+	if len(payments) > 0 {
+		cancellation.Payment = payments[0]
+	}
+
+	var events []*domain.OutboxEvent
+	switch order.Status {
+	case domain.OrderPending:
+		event := &domain.OutboxEvent{SaleID: order.SaleID, Kind: domain.OutboxCancel, UserID: order.UserID, Lines: order.Lines}
+		if err := insertOutboxEvent(ctx, tx, event); err != nil {
+			return nil, nil, err
+		}
+		events = append(events, event)
+	case domain.OrderConfirmed:
+		refund := &domain.Refund{
+			OrderID:  order.ID,
+			Amount:   order.Total,
+			Currency: order.Currency,
+			Status:   domain.RefundRequested,
+			Reason:   reason,
+		}
+		var paymentID *int64
+		if cancellation.Payment != nil {
+			refund.PaymentID = cancellation.Payment.ID
+			paymentID = &refund.PaymentID
+		}
+		sqlRefund := `INSERT INTO refunds (order_id, payment_id, amount, currency, status, reason)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, requested_at`
+		err := tx.QueryRow(ctx, sqlRefund, refund.OrderID, paymentID, refund.Amount, refund.Currency, refund.Status, refund.Reason).
+			Scan(&refund.ID, &refund.RequestedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("refund insert error: %w", err)
+		}
+		cancellation.Refund = refund
+	default:
+		return nil, nil, fmt.Errorf("%w: it is %s", domain.ErrOrderNotCancellable, order.Status)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE sales SET status = 'cancelled', cancelled_at = now() WHERE id = $1`, orderID); err != nil {
+		return nil, nil, fmt.Errorf("order cancellation error: %w", err)
+	}
+	if err := insertOrderEvent(ctx, tx, orderID, domain.OrderEventCancelled, actor, reason); err != nil {
+		return nil, nil, err
+	}
+	if cancellation.Refund != nil {
+		if err := insertOrderEvent(ctx, tx, orderID, domain.OrderEventRefundRequested, actor, ""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("transaction commit error: %w", err)
+	}
+	order.Status = domain.OrderCancelled
+	return cancellation, events, nil
+}
+
+// ListRefundsToProcess returns requested refunds whose payment was captured, and so has to be paid back,
+// or voided, and so needs no money back. Refunds of orders placed without a payment need no money back
+// either; they are returned with no payment ID.
+func (r *PostgresRepository) ListRefundsToProcess(ctx context.Context, limit int) ([]*domain.Refund, error) {
+	sql := `SELECT f.id, f.order_id, COALESCE(f.payment_id, 0), COALESCE(p.authorization_id, ''), COALESCE(p.status, ''),
+			f.amount, f.currency, f.status, f.reason, f.requested_at
+		FROM refunds f LEFT JOIN payments p ON p.id = f.payment_id
+		WHERE f.status = 'requested' AND (f.payment_id IS NULL OR p.status IN ('captured', 'voided'))
+		ORDER BY f.id LIMIT $1`
+	rows, err := r.db.Query(ctx, sql, limit)
+	if err != nil {
+		return nil, fmt.Errorf("refunds query error: %w", err)
+	}
+	defer rows.Close()
+
+	var refunds []*domain.Refund
+	for rows.Next() {
+		var refund domain.Refund
+		err := rows.Scan(&refund.ID, &refund.OrderID, &refund.PaymentID, &refund.AuthorizationID, &refund.PaymentStatus,
+			&refund.Amount, &refund.Currency, &refund.Status, &refund.Reason, &refund.RequestedAt)
+		if err != nil {
+			return nil, fmt.Errorf("refunds scan error: %w", err)
+		}
+		refunds = append(refunds, &refund)
+	}
+	return refunds, rows.Err()
+}
+
+// CompleteRefund records the outcome of a refund request, marks a paid back payment as refunded
+// and adds the refund to the order's audit trail.
+func (r *PostgresRepository) CompleteRefund(ctx context.Context, refund *domain.Refund, status domain.RefundStatus, actor string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("transaction begin error: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `UPDATE refunds SET status = $2, processed_at = now() WHERE id = $1 AND status = 'requested'`
+	tag, err := tx.Exec(ctx, sql, refund.ID, status)
+	if err != nil {
+		return fmt.Errorf("refund update error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		// Completed before, e.g. by a settler that lost its lease
+		return nil
+	}
+	detail := ""
+	if status == domain.RefundCompleted {
+		sqlPayment := `UPDATE payments SET status = 'refunded', updated_at = now() WHERE id = $1`
+		if _, err := tx.Exec(ctx, sqlPayment, refund.PaymentID); err != nil {
+			return fmt.Errorf("payment update error: %w", err)
+		}
+	} else if refund.PaymentID == 0 {
+		detail = "order had no payment, nothing was charged"
+	} else {
+		detail = "payment was voided, nothing was charged"
+	}
+	if err := insertOrderEvent(ctx, tx, refund.OrderID, domain.OrderEventRefunded, actor, detail); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("transaction commit error: %w", err)
+	}
+	return nil
+}
+
+// MarkAvailable moves a sold out sale back to open once cancellations brought the units of its
+// pending and confirmed purchases below its quota. It reports whether the sale was moved.
+func (r *PostgresRepository) MarkAvailable(ctx context.Context, saleID int64) (bool, error) {
+	sql := `UPDATE sales_events SET status = 'open' WHERE id = $1 AND status = 'sold_out' AND ends_at > now()
+		AND item_quota > (SELECT COALESCE(SUM(l.quantity), 0) FROM sales s JOIN order_lines l ON l.order_id = s.id
+			WHERE s.sale_id = $1 AND s.status IN ('pending', 'confirmed'))`
+	tag, err := r.db.Exec(ctx, sql, saleID)
+	if err != nil {
+		return false, fmt.Errorf("sale availability mark error: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
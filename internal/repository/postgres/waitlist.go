@@ -0,0 +1,152 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"flash/internal/domain"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// waitlistColumns selects a waitlist entry of the table aliased w, with the position of waiting entries.
+const waitlistColumns = `w.id, w.sale_id, w.item_id, w.user_id, w.quantity, w.status,
+	CASE WHEN w.status = 'waiting' THEN (SELECT COUNT(*) FROM waitlist_entries a
+		WHERE a.sale_id = w.sale_id AND a.item_id = w.item_id AND a.status = 'waiting' AND a.id <= w.id) ELSE 0 END,
+	COALESCE(w.code, ''), w.created_at, w.reserved_at`
+
+func scanWaitlistEntry(row pgx.Row) (*domain.WaitlistEntry, error) {
+	var entry domain.WaitlistEntry
+	err := row.Scan(&entry.ID, &entry.SaleID, &entry.ItemID, &entry.UserID, &entry.Quantity, &entry.Status,
+		&entry.Position, &entry.Code, &entry.CreatedAt, &entry.ReservedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// JoinWaitlist puts a user at the end of the waitlist of an item and returns the entry with its position.
+// A user waits for an item at most once at a time; joining again returns domain.ErrAlreadyWaitlisted.
+func (r *PostgresRepository) JoinWaitlist(ctx context.Context, saleID int64, itemID, userID string, quantity int) (*domain.WaitlistEntry, error) {
+	sql := `WITH w AS (
+			INSERT INTO waitlist_entries (sale_id, item_id, user_id, quantity, status) VALUES ($1, $2, $3, $4, 'waiting')
+			RETURNING *
+		)
+		SELECT w.id, w.sale_id, w.item_id, w.user_id, w.quantity, w.status,
+			(SELECT COUNT(*) FROM waitlist_entries a WHERE a.sale_id = w.sale_id AND a.item_id = w.item_id
+				AND a.status = 'waiting' AND a.id < w.id) + 1,
+			'', w.created_at, w.reserved_at
+		FROM w`
+	entry, err := scanWaitlistEntry(r.db.QueryRow(ctx, sql, saleID, itemID, userID, quantity))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return nil, domain.ErrAlreadyWaitlisted
+		}
+		return nil, fmt.Errorf("waitlist insert error: %w", err)
+	}
+	return entry, nil
+}
+
+// LeaveWaitlist withdraws the waiting entry of a user for an item.
+func (r *PostgresRepository) LeaveWaitlist(ctx context.Context, saleID int64, itemID, userID string) error {
+	sql := `UPDATE waitlist_entries SET status = 'left' WHERE sale_id = $1 AND item_id = $2 AND user_id = $3 AND status = 'waiting'`
+	tag, err := r.db.Exec(ctx, sql, saleID, itemID, userID)
+	if err != nil {
+		return fmt.Errorf("waitlist update error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotWaitlisted
+	}
+	return nil
+}
+
+// ListUserWaitlistEntries returns the waitlist entries of a user in a sale, newest first.
+func (r *PostgresRepository) ListUserWaitlistEntries(ctx context.Context, saleID int64, userID string) ([]*domain.WaitlistEntry, error) {
+	sql := `SELECT ` + waitlistColumns + ` FROM waitlist_entries w WHERE w.sale_id = $1 AND w.user_id = $2 ORDER BY w.id DESC`
+	return r.queryWaitlistEntries(ctx, sql, saleID, userID)
+}
+
+// ListWaitlist returns the first waiting entries of an item, in the order they are served.
+func (r *PostgresRepository) ListWaitlist(ctx context.Context, saleID int64, itemID string, limit int) ([]*domain.WaitlistEntry, error) {
+	sql := `SELECT ` + waitlistColumns + ` FROM waitlist_entries w
+		WHERE w.sale_id = $1 AND w.item_id = $2 AND w.status = 'waiting' ORDER BY w.id LIMIT $3`
+	return r.queryWaitlistEntries(ctx, sql, saleID, itemID, limit)
+}
+
+// ListWaitlistEntriesToNotify returns served entries whose users have not been told yet.
+func (r *PostgresRepository) ListWaitlistEntriesToNotify(ctx context.Context, limit int) ([]*domain.WaitlistEntry, error) {
+	sql := `SELECT ` + waitlistColumns + ` FROM waitlist_entries w
+		WHERE w.status = 'reserved' AND w.notified_at IS NULL ORDER BY w.id LIMIT $1`
+	return r.queryWaitlistEntries(ctx, sql, limit)
+}
+
+func (r *PostgresRepository) queryWaitlistEntries(ctx context.Context, sql string, args ...any) ([]*domain.WaitlistEntry, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("waitlist query error: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*domain.WaitlistEntry
+	for rows.Next() {
+		entry, err := scanWaitlistEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("waitlist scan error: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CountWaitlisted returns how many users wait for every item of a sale that ever had a waitlist,
+// including those nobody waits for any more.
+func (r *PostgresRepository) CountWaitlisted(ctx context.Context, saleID int64) (map[string]int, error) {
+	sql := `SELECT item_id, COUNT(*) FILTER (WHERE status = 'waiting') FROM waitlist_entries WHERE sale_id = $1 GROUP BY item_id`
+	rows, err := r.db.Query(ctx, sql, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("waitlist count error: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			itemID string
+			count  int
+		)
+		if err := rows.Scan(&itemID, &count); err != nil {
+			return nil, fmt.Errorf("waitlist count scan error: %w", err)
+		}
+		counts[itemID] = count
+	}
+	return counts, rows.Err()
+}
+
+// UpdateWaitlistEntry records that a waiting entry was served with a reservation or dropped.
+// Entries that are no longer waiting, e.g. because their user left meanwhile, are not changed;
+// it reports whether the entry was.
+func (r *PostgresRepository) UpdateWaitlistEntry(ctx context.Context, entry *domain.WaitlistEntry) (bool, error) {
+	sql := `UPDATE waitlist_entries SET status = $2, code = NULLIF($3, ''),
+		reserved_at = CASE WHEN $2 = 'reserved' THEN now() END
+		WHERE id = $1 AND status = 'waiting' RETURNING reserved_at`
+	err := r.db.QueryRow(ctx, sql, entry.ID, entry.Status, entry.Code).Scan(&entry.ReservedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("waitlist update error: %w", err)
+	}
+	entry.Position = 0
+	return true, nil
+}
+
+// MarkWaitlistEntryNotified records that the user of a served entry was told about the reservation.
+func (r *PostgresRepository) MarkWaitlistEntryNotified(ctx context.Context, entryID int64) error {
+	if _, err := r.db.Exec(ctx, `UPDATE waitlist_entries SET notified_at = now() WHERE id = $1`, entryID); err != nil {
+		return fmt.Errorf("waitlist update error: %w", err)
+	}
+	return nil
+}
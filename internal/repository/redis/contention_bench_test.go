@@ -0,0 +1,275 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	mrand "math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"flash/internal/domain"
+	"flash/pkg/database"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// The contention benchmarks run against an in-memory Redis unless BENCH_REDIS_ADDR (and
+// BENCH_REDIS_PASSWORD) name a real one, which gives the numbers that matter:
+//
+//	BENCH_REDIS_ADDR=localhost:6379 go test ./internal/repository/redis -run '^$' -bench Contention -cpu 8
+//
+// On a real Redis they use the keyspace of sale benchSaleID and delete it before and after.
+const (
+	benchSaleID     = 900000
+	benchUsers      = 200
+	benchItems      = 50
+	benchStock      = 100
+	benchQuantity   = 3
+	benchClaimers   = 64
+	benchTimeout    = 10 * time.Minute
+	benchContention = 16
+)
+
+var benchLimits = domain.SaleLimits{ItemQuota: 1000, PerUserLimit: 10, MaxConcurrentReservations: 10}
+
+type reserveFunc func(ctx context.Context, userID string, item *domain.CatalogItem, quantity int, code string) error
+
+func newBenchRepository(b *testing.B) (*RedisRepository, *redis.Client) {
+	b.Helper()
+	ctx := context.Background()
+	var client *redis.Client
+	if addr := os.Getenv("BENCH_REDIS_ADDR"); addr != "" {
+		var err error
+		if client, err = database.NewRedisClient(ctx, addr, os.Getenv("BENCH_REDIS_PASSWORD")); err != nil {
+			b.Fatalf("Redis connection error: %v", err)
+		}
+		clearBenchSale(b, client)
+		b.Cleanup(func() { clearBenchSale(b, client) })
+	} else {
+		client = redis.NewClient(&redis.Options{Addr: miniredis.RunT(b).Addr()})
+	}
+	b.Cleanup(func() { client.Close() })
+
+	repo := NewRedisRepository(client, benchTimeout)
+	if err := repo.LoadScripts(ctx); err != nil {
+		b.Fatal(err)
+	}
+	return repo, client
+}
+
+func clearBenchSale(b *testing.B, client *redis.Client) {
+	ctx := context.Background()
+	iter := client.Scan(ctx, 0, salePrefix(benchSaleID)+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		if err := client.Del(ctx, iter.Val()).Err(); err != nil {
+			b.Fatalf("Clearing benchmark keys failed: %v", err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		b.Fatalf("Clearing benchmark keys failed: %v", err)
+	}
+}
+
+// BenchmarkContentionReserve runs the same randomized workload through the Lua reservation script
+// and through the optimistic WATCH/MULTI loop it replaced. Besides the time per reservation attempt
+// it reports the share of attempts that reserved and that failed for anything but a sale limit,
+// such as running out of WATCH retries, and fails when a sale limit was overshot.
+func BenchmarkContentionReserve(b *testing.B) {
+	b.Run("lua", func(b *testing.B) {
+		repo, client := newBenchRepository(b)
+		benchmarkReserve(b, client, func(ctx context.Context, userID string, item *domain.CatalogItem, quantity int, code string) error {
+			lines := []domain.OrderLine{{ItemID: item.SKU, Quantity: quantity}}
+			return repo.CreateReservation(ctx, benchSaleID, benchLimits, userID, lines, map[string]*domain.CatalogItem{item.SKU: item}, code)
+		})
+	})
+	b.Run("watch", func(b *testing.B) {
+		_, client := newBenchRepository(b)
+		benchmarkReserve(b, client, func(ctx context.Context, userID string, item *domain.CatalogItem, quantity int, code string) error {
+			return watchReserve(ctx, client, userID, item, quantity, code)
+		})
+	})
+}
+
+func benchmarkReserve(b *testing.B, client *redis.Client, reserve reserveFunc) {
+	ctx := context.Background()
+	items := make([]*domain.CatalogItem, benchItems)
+	for i := range items {
+		sku := fmt.Sprintf("sku%d", i)
+		items[i] = &domain.CatalogItem{SaleID: benchSaleID, SKU: sku, Name: sku, Stock: benchStock}
+	}
+
+	var reserved, failed int64
+	// Many more clients than CPUs, like the connections of a busy sale
+	b.SetParallelism(benchContention)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			userID := fmt.Sprintf("user%d", mrand.IntN(benchUsers))
+			item := items[mrand.IntN(len(items))]
+			err := reserve(ctx, userID, item, 1+mrand.IntN(benchQuantity), newBenchCode())
+			switch {
+			case err == nil:
+				atomic.AddInt64(&reserved, 1)
+			case !isLimitError(err):
+				atomic.AddInt64(&failed, 1)
+			}
+		}
+	})
+	b.StopTimer()
+
+	b.ReportMetric(float64(reserved)/float64(b.N), "reserved/op")
+	b.ReportMetric(float64(failed)/float64(b.N), "failed/op")
+	verifyBenchLimits(b, client)
+}
+
+// verifyBenchLimits fails the benchmark when the reservations it made overshot a sale limit.
+func verifyBenchLimits(b *testing.B, client *redis.Client) {
+	ctx := context.Background()
+	reserved, _ := client.Get(ctx, reservedUnitsKey(benchSaleID)).Int64()
+	if reserved > int64(benchLimits.ItemQuota) {
+		b.Errorf("%d units reserved, over the quota of %d", reserved, benchLimits.ItemQuota)
+	}
+
+	iter := client.Scan(ctx, 0, userReservationsKey(benchSaleID, "*"), 0).Iterator()
+	for iter.Next(ctx) {
+		if held := client.ZCard(ctx, iter.Val()).Val(); held > int64(benchLimits.MaxConcurrentReservations) {
+			b.Errorf("%s holds %d reservations, over the limit of %d", iter.Val(), held, benchLimits.MaxConcurrentReservations)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		b.Fatal(err)
+	}
+
+	iter = client.Scan(ctx, 0, itemStockKey(benchSaleID, "*"), 0).Iterator()
+	for iter.Next(ctx) {
+		if left, err := client.Get(ctx, iter.Val()).Int64(); err == nil && left < 0 {
+			b.Errorf("%s is %d, oversold", iter.Val(), left)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkContentionClaim races many clients for the same reservation code, one round per
+// iteration, and fails unless every round has exactly one winner.
+func BenchmarkContentionClaim(b *testing.B) {
+	repo, _ := newBenchRepository(b)
+	ctx := context.Background()
+	// Claimed units stay reserved until their purchase is applied, so the quota must not run out
+	limits := domain.SaleLimits{ItemQuota: math.MaxInt32, PerUserLimit: 1, MaxConcurrentReservations: 1}
+
+	for round := 0; round < b.N; round++ {
+		b.StopTimer()
+		code := newBenchCode()
+		userID := fmt.Sprintf("user%d", round)
+		item := &domain.CatalogItem{SaleID: benchSaleID, SKU: fmt.Sprintf("sku%d", round), Stock: 1}
+		lines := []domain.OrderLine{{ItemID: item.SKU, Quantity: 1}}
+		if err := repo.CreateReservation(ctx, benchSaleID, limits, userID, lines, map[string]*domain.CatalogItem{item.SKU: item}, code); err != nil {
+			b.Fatalf("round %d: reservation failed: %v", round, err)
+		}
+		b.StartTimer()
+
+		var (
+			winners int64
+			wg      sync.WaitGroup
+			start   = make(chan struct{})
+		)
+		for w := 0; w < benchClaimers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				gotUser, gotLines, err := repo.ClaimReservation(ctx, benchSaleID, code)
+				switch {
+				case err == nil:
+					if gotUser != userID || len(gotLines) != 1 || gotLines[0] != lines[0] {
+						b.Errorf("round %d: claim returned %s/%v, want %s/%v", round, gotUser, gotLines, userID, lines)
+					}
+					atomic.AddInt64(&winners, 1)
+				case !errors.Is(err, domain.ErrReservationNotFound):
+					b.Errorf("round %d: unexpected claim error: %v", round, err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if winners != 1 {
+			b.Fatalf("round %d: %d claims succeeded, want exactly 1", round, winners)
+		}
+	}
+}
+
+// watchReserve is an optimistic WATCH/MULTI reservation, the approach reserveScript replaced,
+// kept as the baseline for BenchmarkContentionReserve.
+func watchReserve(ctx context.Context, client *redis.Client, userID string, item *domain.CatalogItem, quantity int, code string) error {
+	expireAt := float64(time.Now().Add(benchTimeout).Unix())
+	globalKey := globalReservationsKey(benchSaleID)
+	userKey := userReservationsKey(benchSaleID, userID)
+	stockKey := itemStockKey(benchSaleID, item.SKU)
+	purchasesKey := userPurchasesKey(benchSaleID, userID)
+	reservedKey := reservedUnitsKey(benchSaleID)
+	lines := fmt.Sprintf(`[{"item_id":%q,"quantity":%d}]`, item.SKU, quantity)
+
+	txf := func(tx *redis.Tx) error {
+		reserved, _ := tx.Get(ctx, reservedKey).Int()
+		if reserved+quantity > benchLimits.ItemQuota {
+			return domain.ErrSaleSoldOut
+		}
+		stock, err := tx.Get(ctx, stockKey).Int()
+		if err == redis.Nil {
+			stock = item.Stock
+		} else if err != nil {
+			return err
+		}
+		if stock < quantity {
+			return domain.ErrOutOfStock
+		}
+		purchased, _ := tx.Get(ctx, purchasesKey).Int()
+		if purchased+quantity > benchLimits.PerUserLimit {
+			return domain.PurchaseLimitError(benchLimits.PerUserLimit)
+		}
+		if tx.ZCard(ctx, userKey).Val() >= int64(benchLimits.MaxConcurrentReservations) {
+			return domain.ConcurrentReservationLimitError(benchLimits.MaxConcurrentReservations)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, stockKey, stock-quantity, 0)
+			pipe.IncrBy(ctx, reservedKey, int64(quantity))
+			pipe.ZAdd(ctx, globalKey, &redis.Z{Score: expireAt, Member: code})
+			pipe.ZAdd(ctx, userKey, &redis.Z{Score: expireAt, Member: code})
+			pipe.HSet(ctx, reservationItemsKey(benchSaleID), code, lines)
+			pipe.Set(ctx, reservationKey(benchSaleID, code), userID, benchTimeout)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		err := client.Watch(ctx, txf, stockKey, reservedKey, purchasesKey)
+		if err == nil {
+			return nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return errors.New("item reservation failed after retries")
+}
+
+// isLimitError reports whether a reservation was turned down by a sale limit.
+func isLimitError(err error) bool {
+	return errors.Is(err, domain.ErrOutOfStock) || errors.Is(err, domain.ErrSaleSoldOut) ||
+		errors.Is(err, domain.ErrPurchaseLimitExceeded) || errors.Is(err, domain.ErrConcurrentReservationExceeded)
+}
+
+func newBenchCode() string {
+	return fmt.Sprintf("%016x%016x", mrand.Uint64(), mrand.Uint64())
+}
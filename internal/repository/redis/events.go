@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"flash/internal/domain"
+)
+
+// saleEventsChannel is the pub/sub channel sale changes are announced on to every replica.
+const saleEventsChannel = "flash:sale-events"
+
+// PublishSaleEvent announces a sale change to every subscribed replica.
+func (r *RedisRepository) PublishSaleEvent(ctx context.Context, event *domain.SaleEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Publish(ctx, saleEventsChannel, payload).Err(); err != nil {
+		return fmt.Errorf("redis sale event publish error: %w", err)
+	}
+	return nil
+}
+
+// SubscribeSaleEvents calls handle for every sale change announced by any replica until ctx is done.
+// The subscription is re-established automatically if the connection drops; events published
+// while it is down are lost.
+func (r *RedisRepository) SubscribeSaleEvents(ctx context.Context, handle func(*domain.SaleEvent)) error {
+	pubsub := r.client.Subscribe(ctx, saleEventsChannel)
+	defer pubsub.Close()
+
+	// Wait for the subscription to be confirmed so no event published after this returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("redis sale event subscribe error: %w", err)
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			var event domain.SaleEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("Ignoring malformed sale event %q: %v", msg.Payload, err)
+				continue
+			}
+			handle(&event)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
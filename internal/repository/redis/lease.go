@@ -0,0 +1,52 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Leases elect a single node for a task across replicas. Every acquisition hands out a
+// strictly increasing fencing token, so work done under an expired lease can be rejected
+// by whoever stores its result.
+
+func leaseKey(name string) string {
+	return "lease:{" + name + "}"
+}
+
+func leaseTokenKey(name string) string {
+	return "lease:{" + name + "}:token"
+}
+
+func leaseValue(nodeID string, token int64) string {
+	return fmt.Sprintf("%s:%d", nodeID, token)
+}
+
+// AcquireLease takes the named lease for ttl if nobody holds it.
+// It returns the fencing token and whether the lease was acquired. The token is greater than after,
+// so a holder that keeps the latest token elsewhere still gets a newer one once Redis lost its counter.
+func (r *RedisRepository) AcquireLease(ctx context.Context, name, nodeID string, after int64, ttl time.Duration) (int64, bool, error) {
+	keys := []string{leaseKey(name), leaseTokenKey(name)}
+	token, err := r.runScript(ctx, acquireLeaseScript, keys, nodeID, ttl.Milliseconds(), after).Int64()
+	if err != nil {
+		return 0, false, fmt.Errorf("redis lease acquire error: %w", err)
+	}
+	return token, token > 0, nil
+}
+
+// RenewLease extends a held lease. It returns false when the lease expired or was taken over.
+func (r *RedisRepository) RenewLease(ctx context.Context, name, nodeID string, token int64, ttl time.Duration) (bool, error) {
+	renewed, err := r.runScript(ctx, renewLeaseScript, []string{leaseKey(name)}, leaseValue(nodeID, token), ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis lease renew error: %w", err)
+	}
+	return renewed == 1, nil
+}
+
+// ReleaseLease gives up a held lease so another node does not have to wait for it to expire.
+func (r *RedisRepository) ReleaseLease(ctx context.Context, name, nodeID string, token int64) error {
+	if err := r.runScript(ctx, releaseLeaseScript, []string{leaseKey(name)}, leaseValue(nodeID, token)).Err(); err != nil {
+		return fmt.Errorf("redis lease release error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"flash/internal/domain"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The waiting room of a sale hands out numbered tickets and admits them in order: queue:issued is
+// the number of the last ticket handed out and queue:admitted the number of the last one admitted,
+// which moves forward at the sale's admission rate. Admitted tickets get a short-lived admission
+// token that checkouts have to present.
+
+func queueIssuedKey(saleID int64) string {
+	return salePrefix(saleID) + "queue:issued"
+}
+
+func queueAdmittedKey(saleID int64) string {
+	return salePrefix(saleID) + "queue:admitted"
+}
+
+// queueAdmittedAtKey holds when, in milliseconds, the admission mark last moved forward.
+func queueAdmittedAtKey(saleID int64) string {
+	return salePrefix(saleID) + "queue:admitted_at"
+}
+
+// queueTicketKey holds the number, user and admission token of a ticket.
+func queueTicketKey(saleID int64, ticket string) string {
+	return salePrefix(saleID) + "queue:ticket:" + ticket
+}
+
+// queueUserKey holds the current ticket of a user.
+func queueUserKey(saleID int64, userID string) string {
+	return salePrefix(saleID) + "queue:user:" + userID
+}
+
+// admissionKey holds the user an admission token was issued to.
+func admissionKey(saleID int64, token string) string {
+	return salePrefix(saleID) + "admission:" + token
+}
+
+// JoinQueue puts a user at the end of the waiting room of a sale with the given ticket and returns
+// the ticket the user holds, which is an earlier one if the user is still waiting or admitted.
+// The ticket lives for ttl.
+func (r *RedisRepository) JoinQueue(ctx context.Context, saleID int64, startsAt time.Time, rate int,
+	userID, ticket string, ttl time.Duration) (string, error) {
+	keys := []string{queueIssuedKey(saleID), queueAdmittedKey(saleID), queueAdmittedAtKey(saleID), queueUserKey(saleID, userID)}
+	held, err := r.runScript(ctx, joinQueueScript, keys, time.Now().UnixMilli(), startsAt.UnixMilli(), rate,
+		salePrefix(saleID), ticket, userID, ttl.Milliseconds()).Text()
+	if err != nil {
+		return "", fmt.Errorf("redis queue join error: %w", err)
+	}
+	return held, nil
+}
+
+// QueueStatus returns the place of a ticket in the waiting room of a sale. A ticket whose turn has
+// come is given the admission token, valid for admissionTTL, unless it already has one.
+// The estimated wait is left to the caller.
+func (r *RedisRepository) QueueStatus(ctx context.Context, saleID int64, startsAt time.Time, rate int,
+	ticket, token string, admissionTTL time.Duration) (*domain.QueueTicket, error) {
+	keys := []string{queueIssuedKey(saleID), queueAdmittedKey(saleID), queueAdmittedAtKey(saleID), queueTicketKey(saleID, ticket)}
+	result, err := r.runScript(ctx, queueStatusScript, keys, time.Now().UnixMilli(), startsAt.UnixMilli(), rate,
+		salePrefix(saleID), token, admissionTTL.Milliseconds()).Slice()
+	if err == redis.Nil {
+		return nil, domain.ErrTicketNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("redis queue status error: %w", err)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("invalid queue status script result")
+	}
+
+	status := &domain.QueueTicket{Ticket: ticket, SaleID: saleID}
+	position, ok := result[0].(int64)
+	if !ok {
+		return nil, errors.New("invalid queue status script result")
+	}
+	switch {
+	case position > 0:
+		status.Status = domain.TicketWaiting
+		status.Position = position
+	case len(result) == 3:
+		status.Status = domain.TicketAdmitted
+		status.AdmissionToken, _ = result[1].(string)
+		left, _ := result[2].(int64)
+		status.AdmissionExpiresIn = (left + 999) / 1000
+	default:
+		status.Status = domain.TicketExpired
+	}
+	return status, nil
+}
+
+// CheckAdmission reports whether an admission token of a sale is valid and was issued to the user.
+func (r *RedisRepository) CheckAdmission(ctx context.Context, saleID int64, token, userID string) (bool, error) {
+	holder, err := r.client.Get(ctx, admissionKey(saleID, token)).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("redis admission check error: %w", err)
+	}
+	return holder == userID, nil
+}
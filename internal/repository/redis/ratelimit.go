@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// rateLimitKey holds the sliding window of a client on a route. Every window lives in its own
+// hash slot, so the clients of a busy route spread over a cluster.
+func rateLimitKey(route, client string) string {
+	return "ratelimit:{" + route + ":" + client + "}"
+}
+
+// CountRequest counts a request of a client against the rate limit of a route and reports whether
+// it is allowed.
+func (r *RedisRepository) CountRequest(ctx context.Context, route, client string, limit domain.RateLimit) (*domain.RateLimitDecision, error) {
+	now := time.Now().UnixMilli()
+	// Requests of the same millisecond need distinct members to be counted apart
+	member := strconv.FormatInt(now, 10) + "-" + strconv.FormatUint(rand.Uint64(), 36)
+	result, err := r.runScript(ctx, rateLimitScript, []string{rateLimitKey(route, client)}, now,
+		limit.Window.Milliseconds(), limit.Requests, member).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("redis rate limit error: %w", err)
+	}
+	if len(result) != 3 {
+		return nil, errors.New("invalid rate limit script result")
+	}
+	return &domain.RateLimitDecision{
+		Allowed:    result[0] == 1,
+		Limit:      limit.Requests,
+		Remaining:  int(result[1]),
+		ResetAfter: time.Duration(result[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,88 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// TestRateLimitWindowEdges runs rateLimitScript at chosen times around the edges of a window of
+// one second with a limit of three requests.
+func TestRateLimitWindowEdges(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	key := rateLimitKey("checkout", "user:alice")
+
+	steps := []struct {
+		now       int64
+		allowed   bool
+		remaining int64
+		reset     int64
+	}{
+		{now: 0, allowed: true, remaining: 2, reset: 1000},
+		{now: 100, allowed: true, remaining: 1, reset: 900},
+		{now: 200, allowed: true, remaining: 0, reset: 800},
+		// Rejected requests are not counted, so they do not push the reset back
+		{now: 500, allowed: false, remaining: 0, reset: 500},
+		{now: 999, allowed: false, remaining: 0, reset: 1},
+		// A request leaves the window exactly one window after it was made
+		{now: 1000, allowed: true, remaining: 0, reset: 100},
+		{now: 1001, allowed: false, remaining: 0, reset: 99},
+		{now: 1200, allowed: true, remaining: 1, reset: 800},
+		// After a quiet window the client has its whole limit again
+		{now: 3000, allowed: true, remaining: 2, reset: 1000},
+	}
+	for i, step := range steps {
+		member := strconv.Itoa(i)
+		result, err := repo.runScript(context.Background(), rateLimitScript, []string{key}, step.now, 1000, 3, member).Int64Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []int64{0, step.remaining, step.reset}
+		if step.allowed {
+			want[0] = 1
+		}
+		if result[0] != want[0] || result[1] != want[1] || result[2] != want[2] {
+			t.Errorf("request at %dms = %v, want %v", step.now, result, want)
+		}
+	}
+}
+
+// TestCountRequestResetAfter checks that a rejected client is told to wait until the oldest
+// request it made leaves the window.
+func TestCountRequestResetAfter(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+	limit := domain.RateLimit{Requests: 2, Window: time.Minute}
+
+	for i := 0; i < limit.Requests; i++ {
+		decision, err := repo.CountRequest(ctx, "checkout", "ip:192.0.2.1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decision.Allowed || decision.Remaining != limit.Requests-i-1 {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i+1, decision, limit.Requests-i-1)
+		}
+	}
+	decision, err := repo.CountRequest(ctx, "checkout", "ip:192.0.2.1", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed || decision.Remaining != 0 {
+		t.Fatalf("request over the limit = %+v, want rejected", decision)
+	}
+	if decision.ResetAfter <= limit.Window-time.Second || decision.ResetAfter > limit.Window {
+		t.Errorf("rejected request resets after %v, want just under %v", decision.ResetAfter, limit.Window)
+	}
+
+	// Other clients of the route have their own window
+	other, err := repo.CountRequest(ctx, "checkout", "ip:192.0.2.2", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.Allowed {
+		t.Errorf("request of another client = %+v, want allowed", other)
+	}
+}
@@ -2,12 +2,16 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
+	"flash/internal/domain"
+
 	"github.com/go-redis/redis/v8"
 )
 
@@ -23,120 +27,303 @@ func NewRedisRepository(client *redis.Client, timeout time.Duration) *RedisRepos
 	}
 }
 
-// CreateReservation uses a Redis transaction to atomically reserve an item.
-func (r *RedisRepository) CreateReservation(ctx context.Context, userID, itemID, code string) error {
-	now := float64(time.Now().Unix())
-	expireAt := now + r.timeout.Seconds()
+// Every key is prefixed with the sale it belongs to so concurrent sales never share state.
+// The sale ID is wrapped in a hash tag to keep all keys of a sale in the same cluster slot.
+func salePrefix(saleID int64) string {
+	return fmt.Sprintf("sale:{%d}:", saleID)
+}
 
-	globalKey := "reservations:global"
-	userKey := fmt.Sprintf("reservations:user:%s", userID)
-	itemKey := fmt.Sprintf("item_reservation:%s", itemID)
-	soldItemKey := fmt.Sprintf("item_sold:%s", itemID)
-	userPurchaseCountKey := fmt.Sprintf("user_purchases:%s", userID)
+func globalReservationsKey(saleID int64) string {
+	return salePrefix(saleID) + "reservations:global"
+}
 
-	txf := func(tx *redis.Tx) error {
-		// Check if item has already been sold permanently
-		if tx.Exists(ctx, soldItemKey).Val() == 1 {
-			return errors.New("item has already been sold")
-		}
+func userReservationsKey(saleID int64, userID string) string {
+	return salePrefix(saleID) + "reservations:user:" + userID
+}
 
-		// Check if item was reserved temporarily
-		if tx.Exists(ctx, itemKey).Val() == 1 {
-			return errors.New("item already reserved")
-		}
-		// Check global sale limit
-		if tx.ZCard(ctx, globalKey).Val() >= 10000 {
-			return errors.New("sale completed, items sold out")
-		}
+func reservationKey(saleID int64, code string) string {
+	return salePrefix(saleID) + "reservation:" + code
+}
 
-		// Check total purchase limit for the user
-		// Note: .Int64() returns 0 if key doesn't exist, which is the desired behavior.
-		purchasedCount, _ := tx.Get(ctx, userPurchaseCountKey).Int64()
-		if purchasedCount >= 10 {
-			return errors.New("purchase limit of 10 items exceeded for this user")
-		}
+// reservationItemsKey maps the code of every live reservation to its item, so the units of
+// a reservation can be returned to stock after its own key has expired.
+func reservationItemsKey(saleID int64) string {
+	return salePrefix(saleID) + "reservation_items"
+}
 
-		// Check concurrent reservation limit for the user
-		if tx.ZCard(ctx, userKey).Val() >= 10 {
-			return errors.New("concurrent reservation limit exceeded for this user")
-		}
+// itemStockKey counts the units of an item that are neither reserved nor sold.
+func itemStockKey(saleID int64, itemID string) string {
+	return salePrefix(saleID) + "stock:" + itemID
+}
+
+// reservedUnitsKey counts the units held by the live reservations of a sale.
+func reservedUnitsKey(saleID int64) string {
+	return salePrefix(saleID) + "reserved_units"
+}
+
+// itemSoldKey counts the units of an item that were purchased.
+func itemSoldKey(saleID int64, itemID string) string {
+	return salePrefix(saleID) + "sold:" + itemID
+}
+
+// soldCountKey counts the units of a sale that were purchased, so the quota covers
+// both open reservations and completed purchases.
+func soldCountKey(saleID int64) string {
+	return salePrefix(saleID) + "sold_count"
+}
+
+// expiredCountKey counts the reservations of a sale that expired without being purchased.
+func expiredCountKey(saleID int64) string {
+	return salePrefix(saleID) + "expired_count"
+}
+
+func outboxAppliedKey(saleID, eventID int64) string {
+	return salePrefix(saleID) + "outbox_applied:" + strconv.FormatInt(eventID, 10)
+}
+
+// statsKey holds the status counters of a sale shared by all replicas.
+func statsKey(saleID int64) string {
+	return salePrefix(saleID) + "stats"
+}
+
+func userPurchasesKey(saleID int64, userID string) string {
+	return salePrefix(saleID) + "user_purchases:" + userID
+}
+
+// claimedKey marks a claimed reservation whose units are counted as sold, until its purchase is
+// confirmed by the outbox or the claim is released again. An empty code names a key that is never set.
+func claimedKey(saleID int64, code string) string {
+	return salePrefix(saleID) + "claimed:" + code
+}
+
+// CreateReservation atomically reserves all lines of a checkout within the stock of their items and
+// the sale's limits using reserveScript. The catalog holds the items of the lines.
+func (r *RedisRepository) CreateReservation(ctx context.Context, saleID int64, limits domain.SaleLimits, userID string,
+	lines []domain.OrderLine, catalog map[string]*domain.CatalogItem, code string) error {
+	return r.reserve(ctx, saleID, limits, userID, lines, catalog, code, false)
+}
+
+// CreateWaitlistReservation reserves the lines of a waitlist entry like CreateReservation, except
+// that the waitlist of their items does not hold it back.
+func (r *RedisRepository) CreateWaitlistReservation(ctx context.Context, saleID int64, limits domain.SaleLimits, userID string,
+	lines []domain.OrderLine, catalog map[string]*domain.CatalogItem, code string) error {
+	return r.reserve(ctx, saleID, limits, userID, lines, catalog, code, true)
+}
 
-		// Atomically execute reservation commands
-		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.SetEX(ctx, itemKey, code, r.timeout)
-			pipe.ZAdd(ctx, globalKey, &redis.Z{Score: expireAt, Member: code})
-			pipe.ZAdd(ctx, userKey, &redis.Z{Score: expireAt, Member: code})
-			pipe.Set(ctx, fmt.Sprintf("reservation:%s", code),
-				fmt.Sprintf("%s|%s", userID, itemID),
-				r.timeout)
-			return nil
-		})
+func (r *RedisRepository) reserve(ctx context.Context, saleID int64, limits domain.SaleLimits, userID string,
+	lines []domain.OrderLine, catalog map[string]*domain.CatalogItem, code string, waitlisted bool) error {
+	encoded, err := json.Marshal(lines)
+	if err != nil {
 		return err
 	}
 
-	// Retry transaction if any of the watched keys are modified by another process
-	for i := 0; i < 3; i++ {
-		// Watch all keys that are read before the transaction is executed
-		err := r.client.Watch(ctx, txf, itemKey, soldItemKey, userPurchaseCountKey)
-		if err == nil {
-			return nil // Success
-		}
-		if err == redis.TxFailedErr {
-			continue // Conflict, retry
+	// Scores are in milliseconds so a reservation never leaves the sets before its keys expire
+	now := time.Now()
+	expireAt := now.Add(r.timeout).UnixMilli()
+
+	keys := []string{
+		globalReservationsKey(saleID),
+		soldCountKey(saleID),
+		userPurchasesKey(saleID, userID),
+		userReservationsKey(saleID, userID),
+		reservationKey(saleID, code),
+		expiredCountKey(saleID),
+		reservationItemsKey(saleID),
+		reservedUnitsKey(saleID),
+	}
+	args := []interface{}{
+		code,
+		expireAt,
+		r.timeout.Milliseconds(),
+		limits.ItemQuota,
+		limits.PerUserLimit,
+		limits.MaxConcurrentReservations,
+		userID,
+		now.UnixMilli(),
+		salePrefix(saleID),
+		encoded,
+		domain.Units(lines),
+		waitlisted,
+	}
+	for _, line := range lines {
+		keys = append(keys, itemStockKey(saleID, line.ItemID))
+		args = append(args, line.Quantity, catalog[line.ItemID].Stock)
+	}
+
+	result, err := r.runScript(ctx, reserveScript, keys, args...).Int64Slice()
+	if err != nil {
+		return fmt.Errorf("redis reservation error: %w", err)
+	}
+	if len(result) == 0 {
+		return errors.New("invalid reservation script result")
+	}
+
+	switch result[0] {
+	case reserveOK:
+		return nil
+	case reserveSoldOut:
+		return domain.ErrSaleSoldOut
+	case reserveOutOfStock:
+		if len(result) == 2 && result[1] >= 1 && int(result[1]) <= len(lines) {
+			return fmt.Errorf("%w: %s", domain.ErrOutOfStock, lines[result[1]-1].ItemID)
 		}
-		return err // Other error
+		return domain.ErrOutOfStock
+	case reservePurchaseLimit:
+		return domain.PurchaseLimitError(limits.PerUserLimit)
+	case reserveConcurrentLimit:
+		return domain.ConcurrentReservationLimitError(limits.MaxConcurrentReservations)
+	default:
+		return fmt.Errorf("unexpected reservation script result %d", result[0])
 	}
-	return errors.New("item reservation failed after retries")
 }
 
-func (r *RedisRepository) GetReservation(ctx context.Context, code string) (string, string, error) {
-	reservationKey := fmt.Sprintf("reservation:%s", code)
-	val, err := r.client.Get(ctx, reservationKey).Result()
+// HoldReservation returns the user and lines of a reservation and keeps it alive for at least hold,
+// e.g. while its payment is being authorized. It returns domain.ErrReservationNotFound when the
+// reservation does not exist (anymore). Unless userID is empty, the reservation has to belong to
+// that user; another user's reservation is left alone and domain.ErrReservationNotOwned returned.
+func (r *RedisRepository) HoldReservation(ctx context.Context, saleID int64, code, userID string, hold time.Duration) (string, []domain.OrderLine, error) {
+	keys := []string{reservationKey(saleID, code), globalReservationsKey(saleID), reservationItemsKey(saleID)}
+	holdUntil := time.Now().Add(hold).UnixMilli()
+	result, err := r.runScript(ctx, holdScript, keys, salePrefix(saleID), code, holdUntil, hold.Milliseconds(), userID).StringSlice()
 	if err == redis.Nil {
-		return "", "", errors.New("Reservation not found or expired")
+		return "", nil, domain.ErrReservationNotFound
 	} else if err != nil {
-		return "", "", fmt.Errorf("redis error: %w", err)
+		return "", nil, fmt.Errorf("redis hold error: %w", err)
 	}
+	if len(result) == 1 {
+		return "", nil, domain.ErrReservationNotOwned
+	}
+	return parseReservation(result)
+}
 
-	parts := strings.Split(val, "|")
-	if len(parts) != 2 {
-		return "", "", errors.New("invalid reservation data format")
+// ClaimReservation atomically takes a reservation out of Redis and returns its user and lines.
+// When several callers race for the same code only the first one succeeds; the others get
+// domain.ErrReservationNotFound.
+func (r *RedisRepository) ClaimReservation(ctx context.Context, saleID int64, code string) (string, []domain.OrderLine, error) {
+	keys := []string{
+		reservationKey(saleID, code),
+		globalReservationsKey(saleID),
+		reservationItemsKey(saleID),
+		reservedUnitsKey(saleID),
+		soldCountKey(saleID),
+		claimedKey(saleID, code),
+	}
+	result, err := r.runScript(ctx, claimScript, keys, salePrefix(saleID), code, outboxMarkerTTL.Milliseconds()).StringSlice()
+	if err == redis.Nil {
+		return "", nil, domain.ErrReservationNotFound
+	} else if err != nil {
+		return "", nil, fmt.Errorf("redis claim error: %w", err)
 	}
-	return parts[0], parts[1], nil
+	return parseReservation(result)
 }
 
-func (r *RedisRepository) DeleteReservation(ctx context.Context, userID, itemID, code string) error {
+// ReleaseClaim undoes a claim whose purchase could not be recorded: its units are taken off the
+// sold counts again and returned to stock. Releasing a claim twice, or one whose purchase was
+// confirmed, does nothing.
+func (r *RedisRepository) ReleaseClaim(ctx context.Context, saleID int64, code string) error {
+	keys := []string{claimedKey(saleID, code), soldCountKey(saleID)}
+	if err := r.runScript(ctx, releaseClaimScript, keys, salePrefix(saleID)).Err(); err != nil {
+		return fmt.Errorf("redis claim release error: %w", err)
+	}
+	return nil
+}
+
+// parseReservation decodes the user and lines of a reservation as returned by its scripts.
+func parseReservation(result []string) (string, []domain.OrderLine, error) {
+	if len(result) != 2 {
+		return "", nil, errors.New("invalid reservation data format")
+	}
+	var lines []domain.OrderLine
+	if err := json.Unmarshal([]byte(result[1]), &lines); err != nil {
+		return "", nil, fmt.Errorf("invalid reservation lines: %w", err)
+	}
+	return result[0], lines, nil
+}
+
+// DeleteReservation releases a reservation that is not going to be purchased and returns its units to stock.
+func (r *RedisRepository) DeleteReservation(ctx context.Context, saleID int64, userID, code string) error {
 	keys := []string{
-		fmt.Sprintf("item_reservation:%s", itemID),
-		fmt.Sprintf("reservation:%s", code),
+		reservationKey(saleID, code),
+		globalReservationsKey(saleID),
+		userReservationsKey(saleID, userID),
+		reservationItemsKey(saleID),
 	}
-	if err := r.client.Del(ctx, keys...).Err(); err != nil {
-		return err
+	if err := r.runScript(ctx, releaseScript, keys, salePrefix(saleID), code).Err(); err != nil {
+		return fmt.Errorf("redis reservation release error: %w", err)
+	}
+	return nil
+}
+
+// outboxMarkerTTL is how long applied outbox events are remembered; far longer than the relay retries.
+const outboxMarkerTTL = 7 * 24 * time.Hour
+
+// ApplyOutboxEvent performs the Redis side-effect of an outbox event exactly once,
+// e.g. counting the units of a purchase as sold and counting them for the user, or
+// releasing them again when the order is cancelled. A purchase whose claim counted its
+// units already is only confirmed.
+func (r *RedisRepository) ApplyOutboxEvent(ctx context.Context, event *domain.OutboxEvent) error {
+	keys := []string{
+		outboxAppliedKey(event.SaleID, event.ID),
+		soldCountKey(event.SaleID),
+		userPurchasesKey(event.SaleID, event.UserID),
+		claimedKey(event.SaleID, event.Code),
+	}
+	args := []interface{}{event.Kind, outboxMarkerTTL.Milliseconds(), domain.Units(event.Lines)}
+	for _, line := range event.Lines {
+		keys = append(keys, itemSoldKey(event.SaleID, line.ItemID), itemStockKey(event.SaleID, line.ItemID))
+		args = append(args, line.Quantity)
+	}
+	if err := r.runScript(ctx, applyOutboxScript, keys, args...).Err(); err != nil {
+		return fmt.Errorf("redis outbox apply error: %w", err)
 	}
-	globalKey := "reservations:global"
-	userKey := fmt.Sprintf("reservations:user:%s", userID)
-	r.client.ZRem(ctx, globalKey, code)
-	r.client.ZRem(ctx, userKey, code)
 	return nil
 }
 
-// MarkItemAsSold sets a permanent key in Redis to mark an item as sold.
-func (r *RedisRepository) MarkItemAsSold(ctx context.Context, itemID string) error {
-	soldItemKey := fmt.Sprintf("item_sold:%s", itemID)
-	// Set without expiration (0)
-	return r.client.Set(ctx, soldItemKey, "sold", 0).Err()
+// ReapExpiredReservations removes reservations whose expiry has passed from the sale's global set
+// and returns their units to stock. It returns how many were removed by this call and how many
+// expired in the sale so far. Per-user sets are pruned lazily whenever that user reserves again.
+func (r *RedisRepository) ReapExpiredReservations(ctx context.Context, saleID int64) (int64, int64, error) {
+	keys := []string{globalReservationsKey(saleID), expiredCountKey(saleID), reservationItemsKey(saleID)}
+	result, err := r.runScript(ctx, reapScript, keys, time.Now().UnixMilli(), salePrefix(saleID)).Int64Slice()
+	if err != nil {
+		return 0, 0, fmt.Errorf("redis reap error: %w", err)
+	}
+	if len(result) != 2 {
+		return 0, 0, errors.New("invalid reap script result")
+	}
+	return result[0], result[1], nil
 }
 
-// IncrementUserPurchaseCount increments the total number of items a user has purchased.
-func (r *RedisRepository) IncrementUserPurchaseCount(ctx context.Context, userID string) (int64, error) {
-	userPurchaseCountKey := fmt.Sprintf("user_purchases:%s", userID)
-	return r.client.Incr(ctx, userPurchaseCountKey).Result()
+// FlushStatusCounters adds the given increments to the sale's shared status counters
+// and returns the resulting totals of all counters.
+func (r *RedisRepository) FlushStatusCounters(ctx context.Context, saleID int64, deltas map[string]int64) (map[string]int64, error) {
+	key := statsKey(saleID)
+	pipe := r.client.TxPipeline()
+	for field, n := range deltas {
+		pipe.HIncrBy(ctx, key, field, n)
+	}
+	all := pipe.HGetAll(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("redis status flush error: %w", err)
+	}
+
+	totals := make(map[string]int64, len(all.Val()))
+	for field, raw := range all.Val() {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status counter %s: %w", field, err)
+		}
+		totals[field] = n
+	}
+	return totals, nil
 }
 
 // ResetAllReservations uses pipelining for slightly better performance.
-// Note: This does NOT reset permanent keys like `item_sold` or `user_purchases`.
-func (r *RedisRepository) ResetAllReservations(ctx context.Context) error {
-	patterns := []string{"reservations:user:*", "reservation:*", "item_reservation:*"}
+// Only the temporary reservation keys of the given sale are removed.
+// Note: This does NOT reset permanent keys like `sold`, `stock` or `user_purchases`.
+func (r *RedisRepository) ResetAllReservations(ctx context.Context, saleID int64) error {
+	prefix := salePrefix(saleID)
+	patterns := []string{prefix + "reservations:user:*", prefix + "reservation:*"}
 	pipe := r.client.Pipeline()
 
 	for _, pattern := range patterns {
@@ -148,12 +335,328 @@ func (r *RedisRepository) ResetAllReservations(ctx context.Context) error {
 			return fmt.Errorf("error scanning keys for pattern %s: %w", pattern, err)
 		}
 	}
-	pipe.Del(ctx, "reservations:global") // Also clear the global set
+	pipe.Del(ctx, globalReservationsKey(saleID)) // Also clear the global set
+	pipe.Del(ctx, reservationItemsKey(saleID))
+	pipe.Del(ctx, reservedUnitsKey(saleID))
 
 	_, err := pipe.Exec(ctx)
 	if err != nil && err != redis.Nil {
 		return fmt.Errorf("error executing redis pipeline for reset: %w", err)
 	}
-	log.Println("All temporary reservation keys in Redis have been reset.")
+	log.Printf("All temporary reservation keys of sale %d in Redis have been reset.", saleID)
 	return nil
 }
+
+func idempotencyKey(scope, key string) string {
+	return "idempotency:" + scope + ":" + key
+}
+
+// AcquireIdempotencyKey claims a key for a new request by storing a pending record.
+// When the key is already taken the existing record is returned instead.
+func (r *RedisRepository) AcquireIdempotencyKey(ctx context.Context, scope, key, fingerprint string, lockTTL time.Duration) (*domain.IdempotencyRecord, bool, error) {
+	pending, err := json.Marshal(domain.IdempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, false, err
+	}
+
+	redisKey := idempotencyKey(scope, key)
+	acquired, err := r.client.SetNX(ctx, redisKey, pending, lockTTL).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("redis idempotency lock error: %w", err)
+	}
+	if acquired {
+		return nil, true, nil
+	}
+
+	val, err := r.client.Get(ctx, redisKey).Bytes()
+	if err == redis.Nil {
+		// The other request released the key in the meantime; try once more
+		acquired, err = r.client.SetNX(ctx, redisKey, pending, lockTTL).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("redis idempotency lock error: %w", err)
+		}
+		if acquired {
+			return nil, true, nil
+		}
+		return nil, false, domain.ErrIdempotencyKeyInProgress
+	} else if err != nil {
+		return nil, false, fmt.Errorf("redis error: %w", err)
+	}
+
+	var record domain.IdempotencyRecord
+	if err := json.Unmarshal(val, &record); err != nil {
+		return nil, false, fmt.Errorf("invalid idempotency record: %w", err)
+	}
+	return &record, false, nil
+}
+
+// SaveIdempotencyRecord stores the final outcome of a request for replay until ttl passes.
+func (r *RedisRepository) SaveIdempotencyRecord(ctx context.Context, scope, key string, record *domain.IdempotencyRecord, ttl time.Duration) error {
+	val, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, idempotencyKey(scope, key), val, ttl).Err()
+}
+
+// ReleaseIdempotencyKey forgets a key so that the request can be retried.
+func (r *RedisRepository) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	return r.client.Del(ctx, idempotencyKey(scope, key)).Err()
+}
+
+// initializedKey is set once Redis holds state; its absence means Redis was flushed or lost its data.
+const initializedKey = "flash:initialized"
+
+// IsInitialized reports whether Redis still holds the marker written after startup.
+func (r *RedisRepository) IsInitialized(ctx context.Context) (bool, error) {
+	n, err := r.client.Exists(ctx, initializedKey).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis error: %w", err)
+	}
+	return n == 1, nil
+}
+
+// MarkInitialized writes the marker checked by IsInitialized.
+func (r *RedisRepository) MarkInitialized(ctx context.Context) error {
+	return r.client.Set(ctx, initializedKey, time.Now().UTC().Format(time.RFC3339), 0).Err()
+}
+
+func (r *RedisRepository) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning keys for pattern %s: %w", pattern, err)
+	}
+	return keys, nil
+}
+
+// scanCounters reads every integer key starting with prefix, keyed by the rest of the key.
+func (r *RedisRepository) scanCounters(ctx context.Context, prefix string) (map[string]int64, error) {
+	keys, err := r.scanKeys(ctx, prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return counters, nil
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis error: %w", err)
+	}
+	for i, key := range keys {
+		raw, ok := values[i].(string)
+		if !ok {
+			continue // Deleted between SCAN and MGET
+		}
+		count, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter %s: %w", key, err)
+		}
+		counters[strings.TrimPrefix(key, prefix)] = count
+	}
+	return counters, nil
+}
+
+// LoadSaleState reads the sold and stock counters, purchase counters and live reservations Redis holds for a sale.
+func (r *RedisRepository) LoadSaleState(ctx context.Context, saleID int64) (*domain.SaleState, error) {
+	prefix := salePrefix(saleID)
+	state := &domain.SaleState{
+		SaleID:       saleID,
+		Reservations: make(map[string]domain.Reservation),
+	}
+
+	var err error
+	if state.SoldItems, err = r.scanCounters(ctx, prefix+"sold:"); err != nil {
+		return nil, err
+	}
+	if state.Stock, err = r.scanCounters(ctx, prefix+"stock:"); err != nil {
+		return nil, err
+	}
+	if state.UserPurchases, err = r.scanCounters(ctx, prefix+"user_purchases:"); err != nil {
+		return nil, err
+	}
+
+	soldCount, err := r.client.Get(ctx, soldCountKey(saleID)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis error: %w", err)
+	}
+	state.SoldCount = soldCount
+
+	reservationKeys, err := r.scanKeys(ctx, prefix+"reservation:*")
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.client.Pipeline()
+	gets := make([]*redis.StringCmd, len(reservationKeys))
+	ttls := make([]*redis.DurationCmd, len(reservationKeys))
+	for i, key := range reservationKeys {
+		gets[i] = pipe.Get(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	items := pipe.HGetAll(ctx, reservationItemsKey(saleID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis error: %w", err)
+	}
+	now := time.Now()
+	for i, key := range reservationKeys {
+		userID, err := gets[i].Result()
+		if err != nil {
+			continue // Expired between SCAN and GET
+		}
+		code := strings.TrimPrefix(key, prefix+"reservation:")
+		res := domain.Reservation{
+			Code:      code,
+			UserID:    userID,
+			ExpiresAt: now.Add(ttls[i].Val()),
+		}
+		if raw, ok := items.Val()[code]; ok {
+			if err := json.Unmarshal([]byte(raw), &res.Lines); err != nil {
+				return nil, fmt.Errorf("invalid reservation lines of %s: %w", code, err)
+			}
+		}
+		state.Reservations[code] = res
+	}
+
+	return state, nil
+}
+
+// InspectPurchases reads what Redis holds for each sampled purchase of a sale. Everything is read in
+// a single transaction, so the stock and reservations of an item add up as they did at one point in time.
+func (r *RedisRepository) InspectPurchases(ctx context.Context, saleID int64, samples []*domain.PurchaseSample) ([]domain.PurchaseObservation, error) {
+	pipe := r.client.TxPipeline()
+	sold := make([]*redis.StringCmd, len(samples))
+	counts := make([]*redis.StringCmd, len(samples))
+	stocks := make([]*redis.StringCmd, len(samples))
+	scores := make([]*redis.FloatCmd, len(samples))
+	for i, sample := range samples {
+		sold[i] = pipe.Get(ctx, itemSoldKey(saleID, sample.ItemID))
+		counts[i] = pipe.Get(ctx, userPurchasesKey(saleID, sample.UserID))
+		stocks[i] = pipe.Get(ctx, itemStockKey(saleID, sample.ItemID))
+		scores[i] = pipe.ZScore(ctx, globalReservationsKey(saleID), sample.Code)
+	}
+	soldCount := pipe.Get(ctx, soldCountKey(saleID))
+	items := pipe.HVals(ctx, reservationItemsKey(saleID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis error: %w", err)
+	}
+
+	totalSold, err := soldCount.Int64()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("invalid sold count: %w", err)
+	}
+	reserved := make(map[string]int64)
+	for _, raw := range items.Val() {
+		var lines []domain.OrderLine
+		if err := json.Unmarshal([]byte(raw), &lines); err != nil {
+			return nil, fmt.Errorf("invalid reservation lines: %w", err)
+		}
+		for _, line := range lines {
+			reserved[line.ItemID] += int64(line.Quantity)
+		}
+	}
+
+	observations := make([]domain.PurchaseObservation, len(samples))
+	for i, sample := range samples {
+		itemSold, err := sold[i].Int64()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("invalid sold counter: %w", err)
+		}
+		count, err := counts[i].Int64()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("invalid purchase counter: %w", err)
+		}
+		stock, err := stocks[i].Int64()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("invalid stock counter: %w", err)
+		}
+		observations[i] = domain.PurchaseObservation{
+			ItemSold:        itemSold,
+			UserPurchases:   count,
+			SoldCount:       totalSold,
+			ItemStock:       stock,
+			ItemReserved:    reserved[sample.ItemID],
+			HasStock:        err == nil,
+			ReservationLive: scores[i].Err() == nil,
+		}
+	}
+	return observations, nil
+}
+
+// RepairSaleState rewrites the Redis keys of a sale so they match the expected state the drift was computed from,
+// and returns the number of differences it repaired. A counter is only rewritten while it still holds the value
+// the drift saw; one that changed since, e.g. by a purchase, is left for the next check.
+// Reservations that exist only in Redis are left alone unless the drift lists them as stale.
+func (r *RedisRepository) RepairSaleState(ctx context.Context, drift *domain.SaleDrift) (int, error) {
+	saleID := drift.SaleID
+	var (
+		keys []string
+		args []interface{}
+	)
+	repairCounter := func(key string, count domain.CountMismatch) {
+		keys = append(keys, key)
+		args = append(args, count.Actual, count.Expected)
+	}
+	for itemID, count := range drift.SoldItems {
+		repairCounter(itemSoldKey(saleID, itemID), count)
+	}
+	for itemID, count := range drift.Stock {
+		repairCounter(itemStockKey(saleID, itemID), count)
+	}
+	if drift.SoldCount != nil {
+		repairCounter(soldCountKey(saleID), *drift.SoldCount)
+	}
+	for userID, count := range drift.UserPurchases {
+		repairCounter(userPurchasesKey(saleID, userID), count)
+	}
+	repaired := 0
+	if len(keys) > 0 {
+		n, err := r.runScript(ctx, repairCountersScript, keys, args...).Int()
+		if err != nil {
+			return 0, fmt.Errorf("redis counter repair error: %w", err)
+		}
+		repaired = n
+	}
+
+	pipe := r.client.TxPipeline()
+	now := time.Now()
+	for _, res := range drift.MissingReservations {
+		ttl := res.ExpiresAt.Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		lines, err := json.Marshal(res.Lines)
+		if err != nil {
+			return 0, err
+		}
+		score := float64(res.ExpiresAt.UnixMilli())
+		pipe.Set(ctx, reservationKey(saleID, res.Code), res.UserID, ttl)
+		pipe.HSet(ctx, reservationItemsKey(saleID), res.Code, lines)
+		pipe.ZAdd(ctx, globalReservationsKey(saleID), &redis.Z{Score: score, Member: res.Code})
+		pipe.ZAdd(ctx, userReservationsKey(saleID, res.UserID), &redis.Z{Score: score, Member: res.Code})
+	}
+	for _, res := range drift.StaleReservations {
+		pipe.Del(ctx, reservationKey(saleID, res.Code))
+		pipe.HDel(ctx, reservationItemsKey(saleID), res.Code)
+		pipe.ZRem(ctx, globalReservationsKey(saleID), res.Code)
+		pipe.ZRem(ctx, userReservationsKey(saleID, res.UserID), res.Code)
+	}
+	// The rebuilt state already contains these purchases, so the relay must not apply them again
+	for _, eventID := range drift.PendingOutboxEvents {
+		pipe.Set(ctx, outboxAppliedKey(saleID, eventID), "1", outboxMarkerTTL)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("error executing redis pipeline for repair: %w", err)
+	}
+	repaired += len(drift.MissingReservations) + len(drift.StaleReservations)
+
+	keys = []string{reservationItemsKey(saleID), reservedUnitsKey(saleID)}
+	if err := r.runScript(ctx, recountReservedScript, keys).Err(); err != nil {
+		return 0, fmt.Errorf("redis reserved units recount error: %w", err)
+	}
+	return repaired, nil
+}
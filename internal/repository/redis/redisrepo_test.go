@@ -0,0 +1,73 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"flash/internal/domain"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRepository(t *testing.T) (*RedisRepository, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisRepository(client, time.Minute), server
+}
+
+// TestRepairSaleStateSkipsChangedCounters checks that a repair only rewrites counters that still
+// hold the value the drift observed.
+func TestRepairSaleStateSkipsChangedCounters(t *testing.T) {
+	repo, server := newTestRepository(t)
+	server.Set(itemSoldKey(1, "sku"), "1")
+	server.Set(itemStockKey(1, "sku"), "9")
+	server.Set(soldCountKey(1), "1")
+
+	drift := &domain.SaleDrift{
+		SaleID:    1,
+		SoldItems: map[string]domain.CountMismatch{"sku": {Expected: 2, Actual: 1}},
+		Stock:     map[string]domain.CountMismatch{"sku": {Expected: 8, Actual: 9}},
+		SoldCount: &domain.CountMismatch{Expected: 2, Actual: 1},
+	}
+	// A reservation takes a unit after the drift was computed
+	server.Set(itemStockKey(1, "sku"), "8")
+
+	repaired, err := repo.RepairSaleState(context.Background(), drift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 2 {
+		t.Errorf("RepairSaleState() repaired %d differences, want 2", repaired)
+	}
+	for key, want := range map[string]string{
+		itemSoldKey(1, "sku"):  "2",
+		itemStockKey(1, "sku"): "8",
+		soldCountKey(1):        "2",
+	} {
+		if got, _ := server.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestInspectPurchasesCountsReservedUnits(t *testing.T) {
+	repo, server := newTestRepository(t)
+	server.Set(itemStockKey(1, "sku"), "5")
+	server.Set(soldCountKey(1), "3")
+	server.HSet(reservationItemsKey(1), "a", `[{"item_id":"sku","quantity":2}]`)
+	server.HSet(reservationItemsKey(1), "b", `[{"item_id":"sku","quantity":1},{"item_id":"other","quantity":4}]`)
+
+	samples := []*domain.PurchaseSample{{SaleID: 1, Code: "c", UserID: "user1", ItemID: "sku"}}
+	observations, err := repo.InspectPurchases(context.Background(), 1, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := domain.PurchaseObservation{SoldCount: 3, ItemStock: 5, ItemReserved: 3, HasStock: true}
+	if observations[0] != want {
+		t.Errorf("InspectPurchases() = %+v, want %+v", observations[0], want)
+	}
+}
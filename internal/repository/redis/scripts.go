@@ -0,0 +1,502 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Result codes returned by reserveScript.
+const (
+	reserveOK = iota
+	reserveSoldOut
+	reserveOutOfStock
+	reservePurchaseLimit
+	reserveConcurrentLimit
+)
+
+// reservationLinesLua defines the helpers for the lines of a reservation, stored as JSON in the
+// reservation_items hash: units adds up their quantities and restock returns them to stock and
+// takes them off the sale's reserved units.
+const reservationLinesLua = `
+local function units(raw)
+	local n = 0
+	for _, line in ipairs(cjson.decode(raw)) do
+		n = n + line.quantity
+	end
+	return n
+end
+
+local function restock(prefix, raw)
+	for _, line in ipairs(cjson.decode(raw)) do
+		redis.call('INCRBY', prefix .. 'stock:' .. line.item_id, line.quantity)
+	end
+	redis.call('DECRBY', prefix .. 'reserved_units', units(raw))
+end
+`
+
+// pruneExpiredLua defines prune, which removes the expired reservations of a sale from its
+// global set, returns their units to stock and counts them as expired. It is shared by every
+// script that has to see expired reservations gone.
+const pruneExpiredLua = reservationLinesLua + `
+local function prune(global, items, expiredCount, prefix, now)
+	local expired = redis.call('ZRANGEBYSCORE', global, '-inf', now)
+	for _, code in ipairs(expired) do
+		local raw = redis.call('HGET', items, code)
+		if raw then
+			restock(prefix, raw)
+			redis.call('HDEL', items, code)
+		end
+	end
+	if #expired > 0 then
+		redis.call('ZREMRANGEBYSCORE', global, '-inf', now)
+		redis.call('INCRBY', expiredCount, #expired)
+	end
+	return #expired
+end
+`
+
+// reserveScript performs every reservation check and write in a single atomic step, so either
+// all lines of a reservation are reserved or none is.
+//
+// Expired entries are pruned before anything is counted, so reservations that timed out
+// no longer hold stock, a share of the quota or of the user's limits. The stock of an item
+// is initialized from the catalog the first time it is reserved. The user's purchase limit
+// covers the units they bought, hold in live reservations and are reserving now.
+// Items with users on their waitlist are out of stock for everyone but the waitlist, so the
+// units that come free go to those who waited for them.
+//
+// KEYS: reservations:global, sold_count, user_purchases, reservations:user, reservation,
+// expired_count, reservation_items, reserved_units, then the stock of every line
+// ARGV: code, expiry score, ttl in ms, item quota, per-user limit, concurrent limit, user,
+// now, sale key prefix, lines as JSON, units, 1 for a waitlist reservation or 0,
+// then the quantity and catalog stock of every line
+// Returns {result code}, or {reserveOutOfStock, line number} for the first line out of stock.
+var reserveScript = redis.NewScript(pruneExpiredLua + `
+prune(KEYS[1], KEYS[7], KEYS[6], ARGV[9], ARGV[8])
+redis.call('ZREMRANGEBYSCORE', KEYS[4], '-inf', ARGV[8])
+local wanted = tonumber(ARGV[11])
+local sold = tonumber(redis.call('GET', KEYS[2]) or '0')
+local reserved = tonumber(redis.call('GET', KEYS[8]) or '0')
+if reserved + sold + wanted > tonumber(ARGV[4]) then
+	return {1}
+end
+local lines = cjson.decode(ARGV[10])
+for i = 9, #KEYS do
+	local arg = 13 + (i - 9) * 2
+	redis.call('SET', KEYS[i], ARGV[arg + 1], 'NX')
+	if tonumber(redis.call('GET', KEYS[i])) < tonumber(ARGV[arg]) then
+		return {2, i - 8}
+	end
+	if ARGV[12] ~= '1' and redis.call('EXISTS', ARGV[9] .. 'waitlisted:' .. lines[i - 8].item_id) == 1 then
+		return {2, i - 8}
+	end
+end
+local held = 0
+local codes = redis.call('ZRANGE', KEYS[4], 0, -1)
+for _, code in ipairs(codes) do
+	local raw = redis.call('HGET', KEYS[7], code)
+	if raw then
+		held = held + units(raw)
+	end
+end
+local purchased = tonumber(redis.call('GET', KEYS[3]) or '0')
+if purchased + held + wanted > tonumber(ARGV[5]) then
+	return {3}
+end
+if #codes >= tonumber(ARGV[6]) then
+	return {4}
+end
+for i = 9, #KEYS do
+	redis.call('DECRBY', KEYS[i], ARGV[13 + (i - 9) * 2])
+end
+redis.call('INCRBY', KEYS[8], wanted)
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[4], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[7], ARGV[1], ARGV[10])
+redis.call('SET', KEYS[5], ARGV[7], 'PX', ARGV[3])
+return {0}
+`)
+
+// applyOutboxScript applies an outbox event at most once; the applied marker makes
+// retries after a lost acknowledgement harmless. A purchase counts its units as sold, unless its
+// claim counted them already; a cancel takes them off again and returns them to stock, unless
+// the stock was never initialized.
+//
+// KEYS: outbox_applied marker, sold_count, user_purchases, claimed marker of the purchase,
+// then the sold units and the stock of every line's item
+// ARGV: kind, marker ttl in ms, units, then the quantity of every line
+// Returns 1 when the event was applied now and 0 when it had been applied before.
+var applyOutboxScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[2]) then
+	return 0
+end
+if ARGV[1] == 'purchase' then
+	if redis.call('DEL', KEYS[4]) == 1 then
+		return 1
+	end
+	redis.call('INCRBY', KEYS[2], ARGV[3])
+	redis.call('INCRBY', KEYS[3], ARGV[3])
+	for i = 4, #ARGV do
+		redis.call('INCRBY', KEYS[(i - 3) * 2 + 3], ARGV[i])
+	end
+elseif ARGV[1] == 'cancel' then
+	redis.call('DECRBY', KEYS[2], ARGV[3])
+	redis.call('DECRBY', KEYS[3], ARGV[3])
+	for i = 4, #ARGV do
+		local n = (i - 3) * 2 + 3
+		redis.call('DECRBY', KEYS[n], ARGV[i])
+		if redis.call('EXISTS', KEYS[n + 1]) == 1 then
+			redis.call('INCRBY', KEYS[n + 1], ARGV[i])
+		end
+	end
+else
+	redis.call('DEL', KEYS[1])
+	return redis.error_reply('unknown outbox event kind ' .. ARGV[1])
+end
+return 1
+`)
+
+// reapScript removes expired reservations, returns their units to stock and keeps a running total of them.
+//
+// KEYS: reservations:global, expired_count, reservation_items
+// ARGV: now, sale key prefix
+// Returns the number of reservations removed by this call and the total expired so far.
+var reapScript = redis.NewScript(pruneExpiredLua + `
+local removed = prune(KEYS[1], KEYS[3], KEYS[2], ARGV[2], ARGV[1])
+local total = tonumber(redis.call('GET', KEYS[2]) or '0')
+return {removed, total}
+`)
+
+// holdScript keeps a reservation alive until at least the given time, without taking it,
+// so it is not pruned as expired while it is being paid for. Given a user, it only holds
+// reservations of that user.
+//
+// KEYS: reservation, reservations:global, reservation_items
+// ARGV: sale key prefix, code, hold until score, hold in ms, user or empty for any user
+// Returns {user, lines as JSON}, {user} when the reservation belongs to someone else, or nil
+// when it does not exist (anymore).
+var holdScript = redis.NewScript(`
+local user = redis.call('GET', KEYS[1])
+if not user then
+	return false
+end
+if ARGV[5] ~= '' and ARGV[5] ~= user then
+	return {user}
+end
+local raw = redis.call('HGET', KEYS[3], ARGV[2])
+if not raw then
+	return false
+end
+local score = tonumber(redis.call('ZSCORE', KEYS[2], ARGV[2]) or '0')
+if score < tonumber(ARGV[3]) then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+	redis.call('ZADD', ARGV[1] .. 'reservations:user:' .. user, ARGV[3], ARGV[2])
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return {user, raw}
+`)
+
+// claimScript hands a reservation to exactly one caller by reading and deleting it in one step.
+// Its units stay taken from stock, since they are about to be sold, and are counted as sold for
+// the sale, its items and the user in the same step, so the quota and per-user limit checks of
+// concurrent reservations see them right away. The claimed marker keeps the user and lines of
+// the claim for the purchase's outbox event, which finds them counted already, and for
+// releaseClaimScript, which undoes a claim whose purchase could not be recorded.
+//
+// KEYS: reservation, reservations:global, reservation_items, reserved_units, sold_count, claimed marker
+// ARGV: sale key prefix, code, marker ttl in ms
+// Returns {user, lines as JSON}, or nil when the reservation does not exist (anymore).
+var claimScript = redis.NewScript(reservationLinesLua + `
+local user = redis.call('GET', KEYS[1])
+if not user then
+	return false
+end
+local raw = redis.call('HGET', KEYS[3], ARGV[2])
+if not raw then
+	-- Pruned as expired in the same millisecond its key expires
+	return false
+end
+local n = units(raw)
+redis.call('DEL', KEYS[1])
+redis.call('HDEL', KEYS[3], ARGV[2])
+redis.call('DECRBY', KEYS[4], n)
+redis.call('ZREM', KEYS[2], ARGV[2])
+redis.call('ZREM', ARGV[1] .. 'reservations:user:' .. user, ARGV[2])
+redis.call('INCRBY', KEYS[5], n)
+redis.call('INCRBY', ARGV[1] .. 'user_purchases:' .. user, n)
+for _, line in ipairs(cjson.decode(raw)) do
+	redis.call('INCRBY', ARGV[1] .. 'sold:' .. line.item_id, line.quantity)
+end
+redis.call('HSET', KEYS[6], 'user', user, 'lines', raw)
+redis.call('PEXPIRE', KEYS[6], ARGV[3])
+return {user, raw}
+`)
+
+// releaseClaimScript undoes a claim whose purchase could not be recorded: its units are taken off
+// the sold counts and returned to stock. A claim the purchase's outbox event already confirmed is
+// left alone, since the purchase was recorded after all.
+//
+// KEYS: claimed marker, sold_count
+// ARGV: sale key prefix
+// Returns 1 when the claim was released and 0 when there was nothing to release.
+var releaseClaimScript = redis.NewScript(reservationLinesLua + `
+local user = redis.call('HGET', KEYS[1], 'user')
+local raw = redis.call('HGET', KEYS[1], 'lines')
+if not user or not raw then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+local n = units(raw)
+redis.call('DECRBY', KEYS[2], n)
+redis.call('DECRBY', ARGV[1] .. 'user_purchases:' .. user, n)
+for _, line in ipairs(cjson.decode(raw)) do
+	redis.call('DECRBY', ARGV[1] .. 'sold:' .. line.item_id, line.quantity)
+	redis.call('INCRBY', ARGV[1] .. 'stock:' .. line.item_id, line.quantity)
+end
+return 1
+`)
+
+// releaseScript drops a reservation that is not going to be purchased and returns its units to stock.
+//
+// KEYS: reservation, reservations:global, reservations:user, reservation_items
+// ARGV: sale key prefix, code
+var releaseScript = redis.NewScript(reservationLinesLua + `
+local raw = redis.call('HGET', KEYS[4], ARGV[2])
+if raw then
+	restock(ARGV[1], raw)
+	redis.call('HDEL', KEYS[4], ARGV[2])
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[2])
+redis.call('ZREM', KEYS[3], ARGV[2])
+return 0
+`)
+
+// recountReservedScript recomputes the reserved units of a sale from its live reservations,
+// after they were rewritten by a repair.
+//
+// KEYS: reservation_items, reserved_units
+var recountReservedScript = redis.NewScript(reservationLinesLua + `
+local total = 0
+for _, raw in ipairs(redis.call('HVALS', KEYS[1])) do
+	total = total + units(raw)
+end
+redis.call('SET', KEYS[2], total)
+return total
+`)
+
+// repairCountersScript sets counters of a sale to their expected value, each only while it still
+// holds the value observed when the drift was computed. A missing counter reads as 0.
+//
+// KEYS: counters
+// ARGV: observed and expected value of every counter
+// Returns the number of counters set.
+var repairCountersScript = redis.NewScript(`
+local repaired = 0
+for i, key in ipairs(KEYS) do
+	if (tonumber(redis.call('GET', key)) or 0) == tonumber(ARGV[i * 2 - 1]) then
+		redis.call('SET', key, ARGV[i * 2])
+		repaired = repaired + 1
+	end
+end
+return repaired
+`)
+
+// queueAdvanceLua defines advance, which moves the admission mark of a waiting room forward by
+// the tickets due since it last moved at the given rate per second, but never past the last ticket
+// issued nor before the sale starts. Capacity is not saved up while nobody waits, so a crowd
+// arriving late is still admitted at the rate.
+const queueAdvanceLua = `
+local function advance(issuedKey, admittedKey, atKey, now, from, rate)
+	local issued = tonumber(redis.call('GET', issuedKey) or '0')
+	local admitted = tonumber(redis.call('GET', admittedKey) or '0')
+	if now < from then
+		return admitted
+	end
+	if admitted >= issued then
+		redis.call('SET', atKey, now)
+		return admitted
+	end
+	local at = tonumber(redis.call('GET', atKey) or from)
+	if at < from then
+		at = from
+	end
+	local due = math.floor((now - at) * rate / 1000)
+	if due > 0 then
+		if admitted + due >= issued then
+			admitted = issued
+			at = now
+		else
+			admitted = admitted + due
+			at = at + math.floor(due * 1000 / rate)
+		end
+		redis.call('SET', admittedKey, admitted)
+		redis.call('SET', atKey, at)
+	end
+	return admitted
+end
+`
+
+// joinQueueScript hands a user a ticket at the end of a waiting room. A user who still waits,
+// or holds a valid admission, gets their ticket back instead of a new one, so refreshing never
+// costs anyone their place.
+//
+// KEYS: queue:issued, queue:admitted, queue:admitted_at, queue:user
+// ARGV: now, sale start, admission rate, sale key prefix, new ticket, user, ticket ttl in ms
+// Returns the user's ticket.
+var joinQueueScript = redis.NewScript(queueAdvanceLua + `
+advance(KEYS[1], KEYS[2], KEYS[3], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]))
+local existing = redis.call('GET', KEYS[4])
+if existing then
+	local ticketKey = ARGV[4] .. 'queue:ticket:' .. existing
+	local token = redis.call('HGET', ticketKey, 'token')
+	if token then
+		if redis.call('EXISTS', ARGV[4] .. 'admission:' .. token) == 1 then
+			return existing
+		end
+	elseif redis.call('EXISTS', ticketKey) == 1 then
+		return existing
+	end
+end
+local seq = redis.call('INCR', KEYS[1])
+local ticketKey = ARGV[4] .. 'queue:ticket:' .. ARGV[5]
+redis.call('HSET', ticketKey, 'seq', seq, 'user', ARGV[6])
+redis.call('PEXPIRE', ticketKey, ARGV[7])
+redis.call('SET', KEYS[4], ARGV[5], 'PX', ARGV[7])
+return ARGV[5]
+`)
+
+// queueStatusScript reports the place of a ticket in a waiting room and issues its admission
+// token once its turn has come. The token is issued once; polling again returns the same token.
+//
+// KEYS: queue:issued, queue:admitted, queue:admitted_at, queue:ticket
+// ARGV: now, sale start, admission rate, sale key prefix, new admission token, admission ttl in ms
+// Returns {tickets ahead up to and including this one}, {0, token, ms left} once admitted,
+// {0} when the admission expired, or nil for an unknown ticket.
+var queueStatusScript = redis.NewScript(queueAdvanceLua + `
+local admitted = advance(KEYS[1], KEYS[2], KEYS[3], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]))
+local seq = redis.call('HGET', KEYS[4], 'seq')
+if not seq then
+	return false
+end
+seq = tonumber(seq)
+if seq > admitted then
+	return {seq - admitted}
+end
+local token = redis.call('HGET', KEYS[4], 'token')
+if not token then
+	token = ARGV[5]
+	redis.call('HSET', KEYS[4], 'token', token)
+	redis.call('SET', ARGV[4] .. 'admission:' .. token, redis.call('HGET', KEYS[4], 'user'), 'PX', ARGV[6])
+	return {0, token, tonumber(ARGV[6])}
+end
+local ttl = redis.call('PTTL', ARGV[4] .. 'admission:' .. token)
+if ttl < 0 then
+	return {0}
+end
+return {0, token, ttl}
+`)
+
+// acquireLeaseScript takes a lease if nobody holds it and hands out a new fencing token, above
+// the given floor even if the counter was lost.
+//
+// KEYS: lease, lease token counter
+// ARGV: node id, ttl in ms, token floor
+// Returns the fencing token, or 0 when the lease is held by someone else.
+var acquireLeaseScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+local floor = tonumber(ARGV[3])
+if token <= floor then
+	token = floor + 1
+	redis.call('SET', KEYS[2], token)
+end
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return token
+`)
+
+// renewLeaseScript extends a lease, but only for the holder of the given token.
+//
+// KEYS: lease
+// ARGV: node id and token as stored, ttl in ms
+var renewLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLeaseScript gives up a lease, but only for the holder of the given token.
+//
+// KEYS: lease
+// ARGV: node id and token as stored
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// rateLimitScript counts a request against a sliding window log: the window keeps the time of every
+// request allowed during the last window, and a request is allowed while fewer than the limit are.
+// Rejected requests are not counted, so clients that keep retrying are let in as soon as the oldest
+// request leaves the window.
+//
+// KEYS: window
+// ARGV: now, window in ms, limit, unique request id
+// Returns {1 when allowed or 0, requests left, ms until the oldest request leaves the window}.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+local reset = 0
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+var scripts = []*redis.Script{
+	reserveScript, applyOutboxScript, reapScript, holdScript, claimScript, releaseClaimScript, releaseScript, recountReservedScript,
+	repairCountersScript, joinQueueScript, queueStatusScript, acquireLeaseScript, renewLeaseScript, releaseLeaseScript,
+	rateLimitScript,
+}
+
+// LoadScripts uploads all Lua scripts so that later calls can use EVALSHA.
+func (r *RedisRepository) LoadScripts(ctx context.Context) error {
+	for _, script := range scripts {
+		if err := script.Load(ctx, r.client).Err(); err != nil {
+			return fmt.Errorf("error loading redis script: %w", err)
+		}
+	}
+	return nil
+}
+
+// runScript executes a script by its SHA and reloads it once when Redis reports NOSCRIPT,
+// e.g. after a restart or SCRIPT FLUSH.
+func (r *RedisRepository) runScript(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := script.EvalSha(ctx, r.client, keys, args...)
+	if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		if err := script.Load(ctx, r.client).Err(); err != nil {
+			cmd.SetErr(fmt.Errorf("error reloading redis script: %w", err))
+			return cmd
+		}
+		cmd = script.EvalSha(ctx, r.client, keys, args...)
+	}
+	return cmd
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"flash/internal/domain"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// waitlistedKey holds how many users wait for an item of a sale. While it exists, reserveScript
+// keeps the item for the waitlist.
+func waitlistedKey(saleID int64, itemID string) string {
+	return salePrefix(saleID) + "waitlisted:" + itemID
+}
+
+// SetWaitlisted records how many users wait for each of the given items of a sale.
+// Items nobody waits for any more are released to every checkout.
+func (r *RedisRepository) SetWaitlisted(ctx context.Context, saleID int64, waiting map[string]int) error {
+	if len(waiting) == 0 {
+		return nil
+	}
+	pipe := r.client.TxPipeline()
+	for itemID, count := range waiting {
+		if count > 0 {
+			pipe.Set(ctx, waitlistedKey(saleID, itemID), count, 0)
+		} else {
+			pipe.Del(ctx, waitlistedKey(saleID, itemID))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis waitlist update error: %w", err)
+	}
+	return nil
+}
+
+// ItemAvailable reports whether a checkout could still reserve quantity units of an item: nobody
+// waits for it, its stock holds them and the sale's quota is not taken up by reserved and sold units.
+// The stock of an item nobody reserved yet is the catalog stock.
+func (r *RedisRepository) ItemAvailable(ctx context.Context, saleID int64, limits domain.SaleLimits,
+	item *domain.CatalogItem, quantity int) (bool, error) {
+	pipe := r.client.Pipeline()
+	waitlisted := pipe.Exists(ctx, waitlistedKey(saleID, item.SKU))
+	stock := pipe.Get(ctx, itemStockKey(saleID, item.SKU))
+	sold := pipe.Get(ctx, soldCountKey(saleID))
+	reserved := pipe.Get(ctx, reservedUnitsKey(saleID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, fmt.Errorf("redis item availability error: %w", err)
+	}
+
+	if waitlisted.Val() > 0 {
+		return false, nil
+	}
+	left := int64(item.Stock)
+	if stock.Err() != redis.Nil {
+		left, _ = stock.Int64()
+	}
+	soldUnits, _ := sold.Int64()
+	reservedUnits, _ := reserved.Int64()
+	return left >= int64(quantity) && soldUnits+reservedUnits+int64(quantity) <= int64(limits.ItemQuota), nil
+}
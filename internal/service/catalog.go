@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// ListCatalogItems returns the items sold in a sale.
+func (s *FlashSaleService) ListCatalogItems(ctx context.Context, saleID int64) ([]*domain.CatalogItem, error) {
+	if _, err := s.pgRepo.GetSale(ctx, saleID); err != nil {
+		return nil, err
+	}
+	return s.pgRepo.ListCatalogItems(ctx, saleID)
+}
+
+// PutCatalogItem adds an item to the catalog of a sale or replaces its name, stock and price.
+// It is an operator action; the HTTP API only exposes it to admins. Stock is loaded into Redis by the first reservation of an item, so the catalog is fixed once the sale starts.
+func (s *FlashSaleService) PutCatalogItem(ctx context.Context, item *domain.CatalogItem) (*domain.CatalogItem, error) {
+	if err := item.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.checkCatalogEditable(ctx, item.SaleID); err != nil {
+		return nil, err
+	}
+	saved, err := s.pgRepo.SaveCatalogItem(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+	s.sales.invalidate(item.SaleID)
+	return saved, nil
+}
+
+// DeleteCatalogItem removes an item from the catalog of a sale that has not started yet.
+func (s *FlashSaleService) DeleteCatalogItem(ctx context.Context, saleID int64, sku string) error {
+	if err := s.checkCatalogEditable(ctx, saleID); err != nil {
+		return err
+	}
+	if err := s.pgRepo.DeleteCatalogItem(ctx, saleID, sku); err != nil {
+		return err
+	}
+	s.sales.invalidate(saleID)
+	return nil
+}
+
+func (s *FlashSaleService) checkCatalogEditable(ctx context.Context, saleID int64) error {
+	sale, err := s.pgRepo.GetSale(ctx, saleID)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(sale.StartsAt) {
+		return domain.ErrSaleStarted
+	}
+	return nil
+}
+
+// getCatalog returns the catalog of a running sale by SKU through the sale cache.
+func (s *FlashSaleService) getCatalog(ctx context.Context, saleID int64) (map[string]*domain.CatalogItem, error) {
+	now := time.Now()
+	if items, ok := s.sales.getCatalog(saleID, now); ok {
+		return items, nil
+	}
+	list, err := s.pgRepo.ListCatalogItems(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	return s.sales.putCatalog(saleID, list, now), nil
+}
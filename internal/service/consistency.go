@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// RunConsistencyChecker periodically spot-checks random purchases of every active sale
+// against Redis, counts the drift it finds and, when repair is enabled, fixes it.
+func (s *FlashSaleService) RunConsistencyChecker(ctx context.Context) {
+	if s.consistency.Interval <= 0 {
+		log.Println("Consistency checker disabled.")
+		return
+	}
+	log.Println("Starting consistency checker...")
+	ticker := time.NewTicker(s.consistency.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkConsistency(ctx)
+		case <-ctx.Done():
+			log.Println("Stopping consistency checker.")
+			return
+		}
+	}
+}
+
+func (s *FlashSaleService) checkConsistency(ctx context.Context) {
+	sales, err := s.pgRepo.ListActiveSales(ctx, time.Now())
+	if err != nil {
+		log.Printf("Listing active sales for consistency check failed: %v", err)
+		return
+	}
+	for _, sale := range sales {
+		if err := s.checkSaleConsistency(ctx, sale); err != nil {
+			log.Printf("Consistency check of sale %d failed: %v", sale.ID, err)
+		}
+	}
+}
+
+func (s *FlashSaleService) checkSaleConsistency(ctx context.Context, sale *domain.Sale) error {
+	saleID := sale.ID
+	samples, err := s.pgRepo.SamplePurchases(ctx, saleID, s.consistency.SampleSize)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	observations, err := s.redisRepo.InspectPurchases(ctx, saleID, samples)
+	if err != nil {
+		return err
+	}
+
+	drift := samplePurchaseDrift(saleID, samples, observations)
+	detected := drift.Count()
+	if detected == 0 {
+		return nil
+	}
+
+	status := s.statusOf(sale)
+	status.AddInconsistenciesDetected(uint64(detected))
+	log.Printf("Sale %d: %d inconsistencies between Postgres and Redis in a sample of %d purchase lines",
+		saleID, detected, len(samples))
+
+	if !s.consistency.Repair {
+		return nil
+	}
+	repaired, err := s.redisRepo.RepairSaleState(ctx, drift)
+	if err != nil {
+		return err
+	}
+	status.AddInconsistenciesRepaired(uint64(repaired))
+	return nil
+}
+
+// samplePurchaseDrift turns the Redis observations of sampled purchases into a repairable drift.
+// A sold or purchase counter is only reported when Redis is behind: a higher count may just reflect
+// a purchase made after the sample was read, and lowering it would be wrong. Likewise the stock of
+// an item is only reported when Redis holds more units, in stock and reserved, than the catalog
+// has left: purchases made since the sample was read move units out of Redis, never into it.
+func samplePurchaseDrift(saleID int64, samples []*domain.PurchaseSample, observations []domain.PurchaseObservation) *domain.SaleDrift {
+	drift := &domain.SaleDrift{
+		SaleID:        saleID,
+		SoldItems:     make(map[string]domain.CountMismatch),
+		Stock:         make(map[string]domain.CountMismatch),
+		UserPurchases: make(map[string]domain.CountMismatch),
+	}
+	for i, sample := range samples {
+		observed := observations[i]
+		if observed.SoldCount < sample.SoldCount && drift.SoldCount == nil {
+			drift.SoldCount = &domain.CountMismatch{
+				Expected: sample.SoldCount,
+				Actual:   observed.SoldCount,
+			}
+		}
+		if sample.ItemAvailable != nil && observed.HasStock {
+			if excess := observed.ItemStock + observed.ItemReserved - *sample.ItemAvailable; excess > 0 {
+				drift.Stock[sample.ItemID] = domain.CountMismatch{
+					Expected: max(observed.ItemStock-excess, 0),
+					Actual:   observed.ItemStock,
+				}
+			}
+		}
+		if observed.ItemSold < sample.ItemSold {
+			drift.SoldItems[sample.ItemID] = domain.CountMismatch{
+				Expected: sample.ItemSold,
+				Actual:   observed.ItemSold,
+			}
+		}
+		if observed.UserPurchases < sample.UserPurchases {
+			drift.UserPurchases[sample.UserID] = domain.CountMismatch{
+				Expected: sample.UserPurchases,
+				Actual:   observed.UserPurchases,
+			}
+		}
+		if observed.ReservationLive {
+			drift.StaleReservations = append(drift.StaleReservations, domain.Reservation{
+				Code:   sample.Code,
+				UserID: sample.UserID,
+			})
+		}
+	}
+	return drift
+}
@@ -4,220 +4,698 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
-	"sync/atomic"
+	"sync"
 	"time"
+
+	"flash/internal/auth"
+	"flash/internal/domain"
+)
+
+const (
+	// finalizationPollInterval is how often the finalizer looks for sales whose window has closed.
+	finalizationPollInterval = 5 * time.Second
+	// reapInterval is how often expired reservations are pruned from active sales.
+	reapInterval = 10 * time.Second
 )
 
 // Interfaces for repositories to allow for easy mocking and swapping implementations
 type PostgresRepository interface {
-	SaveCheckoutAttempt(ctx context.Context, userID, itemID, code string) error
-	ProcessPurchase(ctx context.Context, userID, itemID, code string) error
-	FinalizeSales(ctx context.Context) (int, error)
+	CreateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error)
+	GetSale(ctx context.Context, id int64) (*domain.Sale, error)
+	ListSales(ctx context.Context) ([]*domain.Sale, error)
+	ListActiveSales(ctx context.Context, now time.Time) ([]*domain.Sale, error)
+	ListSalesToOpen(ctx context.Context, now time.Time) ([]*domain.Sale, error)
+	ListSalesToFinalize(ctx context.Context, now time.Time) ([]*domain.Sale, error)
+	UpdateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error)
+	TransitionSale(ctx context.Context, saleID int64, to domain.SaleStatus) (*domain.Sale, error)
+	MarkSoldOut(ctx context.Context, saleID int64) (bool, error)
+	DeleteSale(ctx context.Context, id int64) error
+	ListCatalogItems(ctx context.Context, saleID int64) ([]*domain.CatalogItem, error)
+	SaveCatalogItem(ctx context.Context, item *domain.CatalogItem) (*domain.CatalogItem, error)
+	DeleteCatalogItem(ctx context.Context, saleID int64, sku string) error
+	SaveCheckoutAttempt(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine, code string) error
+	ProcessPurchase(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine, code string,
+		payment *domain.Payment) (*domain.Order, []*domain.OutboxEvent, error)
+	SavePayment(ctx context.Context, payment *domain.Payment) error
+	UpdatePaymentStatus(ctx context.Context, id int64, status domain.PaymentStatus, actor string) error
+	ListPaymentsToCapture(ctx context.Context, limit int) ([]*domain.Payment, error)
+	ListPaymentsToVoid(ctx context.Context, orphanedBefore time.Time, limit int) ([]*domain.Payment, error)
+	FlagUnpaidOrders(ctx context.Context, actor string, limit int) ([]*domain.Payment, error)
+	CancelOrder(ctx context.Context, orderID int64, userID, actor, reason string) (*domain.Cancellation, []*domain.OutboxEvent, error)
+	GetOrderByCode(ctx context.Context, code string) (*domain.Order, error)
+	ListOrderEvents(ctx context.Context, orderID int64) ([]*domain.OrderEvent, error)
+	ListRefundsToProcess(ctx context.Context, limit int) ([]*domain.Refund, error)
+	CompleteRefund(ctx context.Context, refund *domain.Refund, status domain.RefundStatus, actor string) error
+	MarkAvailable(ctx context.Context, saleID int64) (bool, error)
+	CreateLottery(ctx context.Context, saleID int64, seed, seedHash string) (*domain.Lottery, error)
+	GetLottery(ctx context.Context, saleID int64) (*domain.Lottery, error)
+	ListLotteriesToDraw(ctx context.Context, now time.Time) ([]*domain.Sale, error)
+	CompleteLotteryDraw(ctx context.Context, saleID int64, nodeID, entriesHash string) (*domain.Lottery, error)
+	SaveLotteryEntry(ctx context.Context, entry *domain.LotteryEntry) error
+	GetLotteryEntry(ctx context.Context, saleID int64, userID string) (*domain.LotteryEntry, error)
+	ListLotteryEntries(ctx context.Context, saleID int64) ([]*domain.LotteryEntry, error)
+	ListClosedLotteryEntries(ctx context.Context, saleID int64) ([]*domain.LotteryEntry, error)
+	ListEntriesToNotify(ctx context.Context, limit int) ([]*domain.LotteryEntry, error)
+	UpdateLotteryEntry(ctx context.Context, entry *domain.LotteryEntry) error
+	MarkEntryNotified(ctx context.Context, entryID int64) error
+	JoinWaitlist(ctx context.Context, saleID int64, itemID, userID string, quantity int) (*domain.WaitlistEntry, error)
+	LeaveWaitlist(ctx context.Context, saleID int64, itemID, userID string) error
+	ListUserWaitlistEntries(ctx context.Context, saleID int64, userID string) ([]*domain.WaitlistEntry, error)
+	ListWaitlist(ctx context.Context, saleID int64, itemID string, limit int) ([]*domain.WaitlistEntry, error)
+	ListWaitlistEntriesToNotify(ctx context.Context, limit int) ([]*domain.WaitlistEntry, error)
+	CountWaitlisted(ctx context.Context, saleID int64) (map[string]int, error)
+	UpdateWaitlistEntry(ctx context.Context, entry *domain.WaitlistEntry) (bool, error)
+	MarkWaitlistEntryNotified(ctx context.Context, entryID int64) error
+	AbortSale(ctx context.Context, saleID int64, nodeID string) (*domain.Sale, int64, error)
+	FinalizeToken(ctx context.Context, saleID int64) (int64, error)
+	FinalizeSale(ctx context.Context, saleID int64, nodeID string, token int64,
+		settle func(sale *domain.Sale, pendingUnits int) (domain.SettlementOutcome, error)) (*domain.Settlement, error)
+	GetSettlement(ctx context.Context, saleID int64) (*domain.Settlement, error)
+	ListPendingOutboxEvents(ctx context.Context, limit int) ([]*domain.OutboxEvent, error)
+	AckOutboxEvent(ctx context.Context, id int64) error
+	FailOutboxEvent(ctx context.Context, id int64, reason string) error
+	LoadSaleState(ctx context.Context, saleID int64, reservationTimeout time.Duration) (*domain.SaleState, error)
+	SamplePurchases(ctx context.Context, saleID int64, limit int) ([]*domain.PurchaseSample, error)
+	GetIdempotencyRecord(ctx context.Context, scope, key string) (*domain.IdempotencyRecord, error)
+	SaveIdempotencyRecord(ctx context.Context, scope, key string, record *domain.IdempotencyRecord) error
 }
 
 type RedisRepository interface {
-	CreateReservation(ctx context.Context, userID, itemID, code string) error
-	GetReservation(ctx context.Context, code string) (string, string, error)
-	DeleteReservation(ctx context.Context, userID, itemID, code string) error
-	ResetAllReservations(ctx context.Context) error
-	MarkItemAsSold(ctx context.Context, itemID string) error
-	IncrementUserPurchaseCount(ctx context.Context, userID string) (int64, error)
+	CreateReservation(ctx context.Context, saleID int64, limits domain.SaleLimits, userID string,
+		lines []domain.OrderLine, catalog map[string]*domain.CatalogItem, code string) error
+	CreateWaitlistReservation(ctx context.Context, saleID int64, limits domain.SaleLimits, userID string,
+		lines []domain.OrderLine, catalog map[string]*domain.CatalogItem, code string) error
+	SetWaitlisted(ctx context.Context, saleID int64, waiting map[string]int) error
+	ItemAvailable(ctx context.Context, saleID int64, limits domain.SaleLimits, item *domain.CatalogItem, quantity int) (bool, error)
+	HoldReservation(ctx context.Context, saleID int64, code, userID string, hold time.Duration) (string, []domain.OrderLine, error)
+	ClaimReservation(ctx context.Context, saleID int64, code string) (string, []domain.OrderLine, error)
+	ReleaseClaim(ctx context.Context, saleID int64, code string) error
+	DeleteReservation(ctx context.Context, saleID int64, userID, code string) error
+	ReapExpiredReservations(ctx context.Context, saleID int64) (int64, int64, error)
+	FlushStatusCounters(ctx context.Context, saleID int64, deltas map[string]int64) (map[string]int64, error)
+	ResetAllReservations(ctx context.Context, saleID int64) error
+	ApplyOutboxEvent(ctx context.Context, event *domain.OutboxEvent) error
+	LoadSaleState(ctx context.Context, saleID int64) (*domain.SaleState, error)
+	InspectPurchases(ctx context.Context, saleID int64, samples []*domain.PurchaseSample) ([]domain.PurchaseObservation, error)
+	RepairSaleState(ctx context.Context, drift *domain.SaleDrift) (int, error)
+	IsInitialized(ctx context.Context) (bool, error)
+	MarkInitialized(ctx context.Context) error
+	AcquireIdempotencyKey(ctx context.Context, scope, key, fingerprint string, lockTTL time.Duration) (*domain.IdempotencyRecord, bool, error)
+	SaveIdempotencyRecord(ctx context.Context, scope, key string, record *domain.IdempotencyRecord, ttl time.Duration) error
+	ReleaseIdempotencyKey(ctx context.Context, scope, key string) error
+	AcquireLease(ctx context.Context, name, nodeID string, after int64, ttl time.Duration) (int64, bool, error)
+	RenewLease(ctx context.Context, name, nodeID string, token int64, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, nodeID string, token int64) error
+	PublishSaleEvent(ctx context.Context, event *domain.SaleEvent) error
+	JoinQueue(ctx context.Context, saleID int64, startsAt time.Time, rate int, userID, ticket string, ttl time.Duration) (string, error)
+	QueueStatus(ctx context.Context, saleID int64, startsAt time.Time, rate int, ticket, token string,
+		admissionTTL time.Duration) (*domain.QueueTicket, error)
+	CheckAdmission(ctx context.Context, saleID int64, token, userID string) (bool, error)
+	SubscribeSaleEvents(ctx context.Context, handle func(*domain.SaleEvent)) error
+	CountRequest(ctx context.Context, route, client string, limit domain.RateLimit) (*domain.RateLimitDecision, error)
 }
 
 // PurchaseResult is a struct to hold data from a successful purchase
 type PurchaseResult struct {
-	UserID string
-	ItemID string
+	SaleID   int64
+	OrderID  int64
+	UserID   string
+	Lines    []domain.OrderLine
+	Total    int64
+	Currency string
+	Payment  domain.PaymentStatus
+}
+
+// Options configures a FlashSaleService.
+type Options struct {
+	// SaleDefaults fill in the limits of sales created without them.
+	SaleDefaults domain.SaleLimits
+	// IdempotencyTTL is how long the outcome of a request with an Idempotency-Key can be replayed.
+	IdempotencyTTL time.Duration
+	// ReservationTimeout is how long a reservation lives; used to tell live reservations when rebuilding Redis.
+	ReservationTimeout time.Duration
+	// Consistency configures the background Postgres/Redis consistency checker.
+	Consistency ConsistencyOptions
+	// NodeID identifies this replica in finalization leases and on finalized sales.
+	NodeID string
+	// FinalizationLeaseTTL is how long a finalization lease lives without renewal,
+	// and so how long other replicas wait before taking over from a dead finalizer.
+	FinalizationLeaseTTL time.Duration
+	// SettlementPolicies adds custom settlement policies, or replaces built-in ones, by name.
+	SettlementPolicies map[domain.SettlementPolicy]SettlementPolicy
+	// Payments charges purchases; without it purchases fail.
+	Payments PaymentProvider
+	// AuthorizationTimeout bounds a payment authorization, and so how long a reservation
+	// is kept alive for it beyond its own expiry.
+	AuthorizationTimeout time.Duration
+	// AdmissionTTL is how long a waiting room admission token lets its user check out.
+	AdmissionTTL time.Duration
+	// Notifier tells users the outcome of lottery draws and about reservations taken for them
+	// from a waitlist; without it nobody is notified.
+	Notifier Notifier
+	// RateLimits limits the requests every client makes to a route, by route name. The limit named
+	// domain.DefaultRateLimitRoute applies to routes without their own; routes without either are not limited.
+	RateLimits map[string]domain.RateLimit
+}
+
+// ConsistencyOptions configures the background consistency checker.
+type ConsistencyOptions struct {
+	// Interval between checks; zero disables the checker.
+	Interval time.Duration
+	// SampleSize is the number of purchases checked per sale and run.
+	SampleSize int
+	// Repair makes the checker fix the drift it finds instead of only counting it.
+	Repair bool
 }
 
 type FlashSaleService struct {
-	pgRepo    PostgresRepository
-	redisRepo RedisRepository
-	status    *Status
+	pgRepo               PostgresRepository
+	redisRepo            RedisRepository
+	saleDefaults         domain.SaleLimits
+	idempotencyTTL       time.Duration
+	idempotencyLockTTL   time.Duration
+	reservationTimeout   time.Duration
+	consistency          ConsistencyOptions
+	nodeID               string
+	leaseTTL             time.Duration
+	settlementPolicies   map[domain.SettlementPolicy]SettlementPolicy
+	payments             PaymentProvider
+	authorizationTimeout time.Duration
+	admissionTTL         time.Duration
+	notifier             Notifier
+	rateLimits           map[string]domain.RateLimit
+	sales                *saleCache
+
+	statusMu sync.Mutex
+	statuses map[int64]*Status
 }
 
-func NewFlashSaleService(pgRepo PostgresRepository, redisRepo RedisRepository) *FlashSaleService {
+func NewFlashSaleService(pgRepo PostgresRepository, redisRepo RedisRepository, opts Options) *FlashSaleService {
+	policies := defaultSettlementPolicies()
+	for name, policy := range opts.SettlementPolicies {
+		policies[name] = policy
+	}
 	return &FlashSaleService{
-		pgRepo:    pgRepo,
-		redisRepo: redisRepo,
-		status:    NewStatus(),
+		pgRepo:               pgRepo,
+		redisRepo:            redisRepo,
+		saleDefaults:         opts.SaleDefaults,
+		idempotencyTTL:       opts.IdempotencyTTL,
+		idempotencyLockTTL:   opts.AuthorizationTimeout + idempotencyRequestBudget,
+		reservationTimeout:   opts.ReservationTimeout,
+		consistency:          opts.Consistency,
+		nodeID:               opts.NodeID,
+		leaseTTL:             opts.FinalizationLeaseTTL,
+		settlementPolicies:   policies,
+		payments:             opts.Payments,
+		authorizationTimeout: opts.AuthorizationTimeout,
+		admissionTTL:         opts.AdmissionTTL,
+		notifier:             opts.Notifier,
+		rateLimits:           opts.RateLimits,
+		sales:                newSaleCache(),
+		statuses:             make(map[int64]*Status),
 	}
 }
 
-func (s *FlashSaleService) GetCurrentStatus() *Status {
-	return s.status
+// GetStatus returns the counters of a single sale, creating them on first use. Only sales in the
+// sale cache that are not over get counters, so sale IDs taken from requests cannot grow them
+// without bound; any other sale gets detached counters whose increments are dropped.
+func (s *FlashSaleService) GetStatus(saleID int64) *Status {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	status, ok := s.statuses[saleID]
+	if !ok {
+		status = NewStatus()
+		if sale, known := s.sales.lookup(saleID); known && !sale.Status.IsTerminal() {
+			s.statuses[saleID] = status
+		}
+	}
+	return status
 }
 
-func (s *FlashSaleService) CreateReservation(ctx context.Context, userID, itemID string) (string, error) {
-	if s.status.IsSaleCompleted() {
-		return "", fmt.Errorf("sale completed, items sold out")
+// statusOf returns the counters of a sale loaded from the database, creating them on first use
+// unless the sale is over.
+func (s *FlashSaleService) statusOf(sale *domain.Sale) *Status {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	status, ok := s.statuses[sale.ID]
+	if !ok {
+		status = NewStatus()
+		if !sale.Status.IsTerminal() {
+			s.statuses[sale.ID] = status
+		}
 	}
+	return status
+}
 
-	if s.status.GetPurchasedGoods() >= 10000 {
-		return "", fmt.Errorf("sale completed, items sold out")
+func (s *FlashSaleService) CreateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error) {
+	if err := s.validateSale(sale); err != nil {
+		return nil, err
 	}
+	return s.pgRepo.CreateSale(ctx, sale)
+}
+
+func (s *FlashSaleService) GetSale(ctx context.Context, id int64) (*domain.Sale, error) {
+	return s.pgRepo.GetSale(ctx, id)
+}
+
+func (s *FlashSaleService) ListSales(ctx context.Context) ([]*domain.Sale, error) {
+	return s.pgRepo.ListSales(ctx)
+}
+
+func (s *FlashSaleService) UpdateSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error) {
+	if err := s.validateSale(sale); err != nil {
+		return nil, err
+	}
+	current, err := s.pgRepo.GetSale(ctx, sale.ID)
+	if err != nil {
+		return nil, err
+	}
+	if current.FinalizedAt != nil {
+		return nil, domain.ErrSaleFinalized
+	}
+	// A running sale may only be extended, renamed or given another settlement policy;
+	// its start, limits and mode are fixed once open
+	if !time.Now().Before(current.StartsAt) &&
+		(!sale.StartsAt.Equal(current.StartsAt) || sale.Limits() != current.Limits() || sale.Mode != current.Mode) {
+		return nil, domain.ErrSaleStarted
+	}
+	updated, err := s.pgRepo.UpdateSale(ctx, sale)
+	if err != nil {
+		return nil, err
+	}
+	s.saleChanged(ctx, updated.ID, updated.Status)
+	return updated, nil
+}
+
+func (s *FlashSaleService) DeleteSale(ctx context.Context, id int64) error {
+	sale, err := s.pgRepo.GetSale(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(sale.StartsAt) {
+		return domain.ErrSaleStarted
+	}
+	if err := s.pgRepo.DeleteSale(ctx, id); err != nil {
+		return err
+	}
+	s.saleChanged(ctx, id, "")
+	return nil
+}
+
+// getCurrentSale loads a sale through the sale cache, opening it first if its window has started
+// but no replica has opened it yet, so checkouts do not wait for the next lifecycle poll.
+func (s *FlashSaleService) getCurrentSale(ctx context.Context, saleID int64) (*domain.Sale, error) {
+	now := time.Now()
+	sale, ok := s.sales.get(saleID, now)
+	if !ok {
+		var err error
+		if sale, err = s.pgRepo.GetSale(ctx, saleID); err != nil {
+			return nil, err
+		}
+		s.sales.put(sale, now)
+	}
+	if sale.Status == domain.SaleScheduled && !now.Before(sale.StartsAt) && now.Before(sale.EndsAt) {
+		return s.openSale(ctx, sale)
+	}
+	return sale, nil
+}
+
+// openSale moves a scheduled sale to open. Losing the race to another replica is not an error.
+func (s *FlashSaleService) openSale(ctx context.Context, sale *domain.Sale) (*domain.Sale, error) {
+	opened, err := s.pgRepo.TransitionSale(ctx, sale.ID, domain.SaleOpen)
+	if errors.Is(err, domain.ErrInvalidTransition) {
+		return s.pgRepo.GetSale(ctx, sale.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.saleChanged(ctx, opened.ID, opened.Status)
+	log.Printf("Sale %d (%s) is open", sale.ID, sale.Name)
+	return opened, nil
+}
+
+// markSoldOut moves an open sale to sold_out if it has sold its whole quota.
+func (s *FlashSaleService) markSoldOut(ctx context.Context, sale *domain.Sale) {
+	soldOut, err := s.pgRepo.MarkSoldOut(ctx, sale.ID)
+	if err != nil {
+		log.Printf("Sold out check for sale %d failed: %v", sale.ID, err)
+		return
+	}
+	if soldOut {
+		s.saleChanged(ctx, sale.ID, domain.SaleSoldOut)
+		log.Printf("Sale %d is sold out", sale.ID)
+	}
+}
+
+// CreateReservation reserves every line of a checkout for the authenticated user of ctx, or none
+// of them, and returns the reservation code. Sales with a waiting room require the admission token
+// the user was given by it.
+func (s *FlashSaleService) CreateReservation(ctx context.Context, saleID int64, admissionToken string,
+	lines []domain.OrderLine) (string, error) {
+	userID, ok := auth.UserFromContext(ctx)
+	if !ok {
+		return "", domain.ErrUnauthenticated
+	}
+	if err := domain.ValidateLines(lines); err != nil {
+		return "", err
+	}
+	sale, err := s.getCurrentSale(ctx, saleID)
+	if err != nil {
+		return "", err
+	}
+	if err := sale.CheckCheckout(time.Now()); err != nil {
+		return "", err
+	}
+	if err := s.checkAdmission(ctx, sale, userID, admissionToken); err != nil {
+		return "", err
+	}
+	catalog, err := s.getCatalog(ctx, sale.ID)
+	if err != nil {
+		return "", err
+	}
+	// The price is captured now, so the order is charged what the customer saw at checkout
+	lines, err = domain.PriceLines(lines, catalog)
+	if err != nil {
+		return "", err
+	}
+	status := s.statusOf(sale)
 
 	code, err := generateUniqueCode()
 	if err != nil {
 		return "", fmt.Errorf("could not generate code: %w", err)
 	}
 
-	if err := s.redisRepo.CreateReservation(ctx, userID, itemID, code); err != nil {
+	if err := s.redisRepo.CreateReservation(ctx, sale.ID, sale.Limits(), userID, lines, catalog, code); err != nil {
 		return "", err
 	}
 
-	if err := s.pgRepo.SaveCheckoutAttempt(ctx, userID, itemID, code); err != nil {
+	if err := s.pgRepo.SaveCheckoutAttempt(ctx, sale.ID, userID, lines, code); err != nil {
 		// Attempt to roll back the Redis reservation if DB write fails
-		_ = s.redisRepo.DeleteReservation(ctx, userID, itemID, code)
+		_ = s.redisRepo.DeleteReservation(ctx, sale.ID, userID, code)
 		return "", fmt.Errorf("failed to save checkout attempt: %w", err)
 	}
 
-	s.status.IncrementSuccessfulCheckouts()
-	s.status.IncrementScheduledGoods()
+	status.IncrementSuccessfulCheckouts()
+	status.AddScheduledGoods(uint64(domain.Units(lines)))
 	return code, nil
 }
 
-func (s *FlashSaleService) ProcessPurchase(ctx context.Context, code string) (*PurchaseResult, error) {
-	userID, itemID, err := s.redisRepo.GetReservation(ctx, code)
+// ProcessPurchase charges the user holding the reservation of code and records the order. When ctx
+// carries an authenticated user, only that user can purchase the reservation.
+func (s *FlashSaleService) ProcessPurchase(ctx context.Context, saleID int64, code string) (*PurchaseResult, error) {
+	sale, err := s.getCurrentSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sale.CheckPurchase(time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Hold the reservation while the customer is charged, so it neither expires nor has its
+	// units handed to someone else during a slow authorization. An authenticated buyer can only
+	// hold their own reservation, so nobody can keep another user's reservation from expiring.
+	buyer, _ := auth.UserFromContext(ctx)
+	userID, lines, err := s.redisRepo.HoldReservation(ctx, sale.ID, code, buyer, s.authorizationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	payment, err := s.authorizePayment(ctx, sale.ID, userID, lines, code)
+	if err != nil {
+		// The reservation stays until it expires, so a declined customer can try again
+		return nil, err
+	}
+
+	// Claiming reads and deletes the reservation atomically, so a code can only be spent once
+	userID, lines, err = s.redisRepo.ClaimReservation(ctx, sale.ID, code)
 	if err != nil {
+		s.voidPayment(ctx, payment, "the reservation was claimed by another purchase")
 		return nil, err
 	}
 
-	// The reservation is valid, now delete it from Redis
-	if err := s.redisRepo.DeleteReservation(ctx, userID, itemID, code); err != nil {
-		return nil, fmt.Errorf("failed to delete reservation: %w", err)
+	// Persist the order to the database, together with the outbox events for Redis
+	order, events, err := s.pgRepo.ProcessPurchase(ctx, sale.ID, userID, lines, code, payment)
+	if err != nil {
+		order, err = s.recoverPurchase(ctx, sale.ID, code, payment, err)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Persist the purchase to the database
-	if err := s.pgRepo.ProcessPurchase(ctx, userID, itemID, code); err != nil {
-		return nil, fmt.Errorf("failed to process purchase in db: %w", err)
+	// After successful DB write, confirm the claim in Redis, whose units are counted as sold
+	// for their items and for the user already. Whatever fails here is retried by the outbox relay.
+	for _, event := range events {
+		if err := s.applyOutboxEvent(ctx, event); err != nil {
+			log.Printf("Outbox event %d for sale %d not applied yet, leaving it to the relay: %v", event.ID, sale.ID, err)
+		}
 	}
 
-	// After successful DB write, update Redis with permanent state
-	// Mark the item as permanently sold
-	if err := s.redisRepo.MarkItemAsSold(ctx, itemID); err != nil {
-		// Log a critical error. The purchase is in the DB, but Redis state is inconsistent.
-		// A background job could be used to fix such inconsistencies.
-		log.Printf("CRITICAL: inconsistency detected. DB purchase for item %s succeeded, but failed to mark as sold in Redis: %v", itemID, err)
+	status := s.statusOf(sale)
+	status.IncrementSuccessfulPurchases()
+	status.AddPurchasedGoods(uint64(domain.Units(lines)))
+	// The counters lag behind other replicas, so this only saves the Postgres check while the sale
+	// is clearly not full; the lifecycle poll catches whatever is missed here.
+	if sale.Status == domain.SaleOpen && status.GetPurchasedGoods() >= uint64(sale.ItemQuota) {
+		s.markSoldOut(ctx, sale)
 	}
+	return &PurchaseResult{
+		SaleID:   sale.ID,
+		OrderID:  order.ID,
+		UserID:   userID,
+		Lines:    order.Lines,
+		Total:    order.Total,
+		Currency: order.Currency,
+		Payment:  payment.Status,
+	}, nil
+}
 
-	// Increment the user's total purchase count
-	if _, err := s.redisRepo.IncrementUserPurchaseCount(ctx, userID); err != nil {
-		log.Printf("CRITICAL: inconsistency detected. DB purchase for user %s succeeded, but failed to increment purchase count in Redis: %v", userID, err)
+// recoverPurchase handles a failed write of the order of code. Errors the repository reports before
+// committing mean nothing was recorded, so the payment is voided and the claimed units are given
+// back. Any other error may have come after the commit went through, so the order is looked up
+// first: a recorded order is returned as if the write had succeeded, and its outbox event is left
+// to the relay. When the lookup fails too, nothing is compensated; the sweep voids the payment if
+// it never got an order, and the consistency checker returns units that were never sold.
+func (s *FlashSaleService) recoverPurchase(ctx context.Context, saleID int64, code string, payment *domain.Payment,
+	err error) (*domain.Order, error) {
+	rolledBack := errors.Is(err, domain.ErrDuplicatePurchase) || errors.Is(err, domain.ErrSaleNotActive) ||
+		errors.Is(err, domain.ErrSaleNotFound) || errors.Is(err, domain.ErrPaymentDeclined)
+	if !rolledBack {
+		order, lookupErr := s.pgRepo.GetOrderByCode(ctx, code)
+		if lookupErr == nil {
+			log.Printf("Purchase of %s in sale %d reported %v but its order %d was recorded", code, saleID, err, order.ID)
+			payment.OrderID = order.ID
+			return order, nil
+		}
+		if !errors.Is(lookupErr, domain.ErrOrderNotFound) {
+			log.Printf("Could not tell whether the purchase of %s in sale %d was recorded, leaving its payment and claim: %v",
+				code, saleID, lookupErr)
+			return nil, fmt.Errorf("failed to process purchase in db: %w", err)
+		}
 	}
 
-	s.status.IncrementSuccessfulPurchases()
-	s.status.IncrementPurchasedGoods()
-	return &PurchaseResult{UserID: userID, ItemID: itemID}, nil
+	s.voidPayment(ctx, payment, "the order could not be recorded")
+	// The claim counted the units as sold; give them back so they can be bought by someone else
+	if releaseErr := s.redisRepo.ReleaseClaim(ctx, saleID, code); releaseErr != nil {
+		log.Printf("Releasing claim %s of sale %d failed, its units stay sold until Redis is reconciled: %v", code, saleID, releaseErr)
+	}
+	if rolledBack {
+		return nil, err
+	}
+	return nil, fmt.Errorf("failed to process purchase in db: %w", err)
 }
 
-func (s *FlashSaleService) RunHourlyFinalization(ctx context.Context) {
-	log.Println("Starting hourly sales finalization process...")
-	for {
-		now := time.Now()
-		nextHour := now.Truncate(time.Hour).Add(time.Hour)
-		waitDuration := time.Until(nextHour)
+// RunFinalization periodically advances the sale lifecycle: it opens sales whose window has started,
+// marks full sales as sold out and finalizes every sale whose window has closed.
+// Every replica runs it; a per-sale lease makes sure only one of them finalizes a given sale.
+func (s *FlashSaleService) RunFinalization(ctx context.Context) {
+	log.Println("Starting sales finalization process...")
+	ticker := time.NewTicker(finalizationPollInterval)
+	defer ticker.Stop()
 
+	for {
 		select {
-		case <-time.After(waitDuration):
-			log.Println("Running sales finalization...")
-			if err := s.finalizeSales(ctx); err != nil {
-				log.Printf("Sales finalization error: %v", err)
+		case <-ticker.C:
+			s.advanceLifecycle(ctx)
+			sales, err := s.pgRepo.ListSalesToFinalize(ctx, time.Now())
+			if err != nil {
+				log.Printf("Listing sales to finalize failed: %v", err)
+				continue
+			}
+			for _, sale := range sales {
+				if err := s.finalizeWithLease(ctx, sale); err != nil {
+					log.Printf("Sales finalization error for sale %d: %v", sale.ID, err)
+				}
 			}
 		case <-ctx.Done():
-			log.Println("Stopping hourly finalization process.")
+			log.Println("Stopping sales finalization process.")
 			return
 		}
 	}
 }
 
-func (s *FlashSaleService) finalizeSales(ctx context.Context) error {
-	pendingCount, err := s.pgRepo.FinalizeSales(ctx)
-	if err != nil {
-		return fmt.Errorf("db finalization failed: %w", err)
+// RunReservationReaper periodically removes expired, unpurchased reservations from every
+// active sale and records how many expired.
+func (s *FlashSaleService) RunReservationReaper(ctx context.Context) {
+	log.Println("Starting reservation reaper...")
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reapExpiredReservations(ctx)
+		case <-ctx.Done():
+			log.Println("Stopping reservation reaper.")
+			return
+		}
 	}
+}
 
-	if pendingCount == 10000 {
-		log.Println("Sales confirmed - exactly 10000 orders")
-		s.status.SetSaleCompleted(true)
-	} else {
-		log.Printf("Provisional sales count (%d) not equal to 10000. Sales canceled.", pendingCount)
-		s.status.SetSaleCompleted(false)
+func (s *FlashSaleService) reapExpiredReservations(ctx context.Context) {
+	sales, err := s.pgRepo.ListActiveSales(ctx, time.Now())
+	if err != nil {
+		log.Printf("Listing active sales for reaping failed: %v", err)
+		return
+	}
+	for _, sale := range sales {
+		removed, total, err := s.redisRepo.ReapExpiredReservations(ctx, sale.ID)
+		if err != nil {
+			log.Printf("Reaping expired reservations of sale %d failed: %v", sale.ID, err)
+			continue
+		}
+		s.statusOf(sale).SetExpiredReservations(uint64(total))
+		if removed > 0 {
+			log.Printf("Sale %d: %d reservations expired unpurchased (%d in total)", sale.ID, removed, total)
+		}
 	}
+}
 
-	// Reset metrics and clear Redis for the new sale hour
-	s.status.Reset()
+// advanceLifecycle opens due sales and marks full ones as sold out.
+func (s *FlashSaleService) advanceLifecycle(ctx context.Context) {
+	now := time.Now()
+	toOpen, err := s.pgRepo.ListSalesToOpen(ctx, now)
+	if err != nil {
+		log.Printf("Listing sales to open failed: %v", err)
+	}
+	for _, sale := range toOpen {
+		if _, err := s.openSale(ctx, sale); err != nil {
+			log.Printf("Opening sale %d failed: %v", sale.ID, err)
+		}
+	}
 
-	if err := s.redisRepo.ResetAllReservations(ctx); err != nil {
-		// Log error but don't fail the entire finalization. The system might recover.
-		log.Printf("Redis reset error: %v", err)
+	active, err := s.pgRepo.ListActiveSales(ctx, now)
+	if err != nil {
+		log.Printf("Listing active sales failed: %v", err)
+		return
+	}
+	for _, sale := range active {
+		if sale.Status == domain.SaleOpen {
+			s.markSoldOut(ctx, sale)
+		}
 	}
+}
 
-	return nil
+func finalizationLeaseName(saleID int64) string {
+	return fmt.Sprintf("finalize:%d", saleID)
 }
 
-func generateUniqueCode() (string, error) {
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+// finalizeWithLease finalizes a sale if this node wins its finalization lease. Losing nodes
+// skip the sale; should the winner die mid-run, its lease expires and the sale, still
+// unfinalized, is picked up by another node on a later poll.
+func (s *FlashSaleService) finalizeWithLease(ctx context.Context, sale *domain.Sale) error {
+	name := finalizationLeaseName(sale.ID)
+	// Postgres keeps the latest token, so the lease hands out a newer one even after Redis lost its counter
+	after, err := s.pgRepo.FinalizeToken(ctx, sale.ID)
+	if err != nil {
+		return err
+	}
+	token, acquired, err := s.redisRepo.AcquireLease(ctx, name, s.nodeID, after, s.leaseTTL)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
 	}
-	return hex.EncodeToString(b), nil
-}
 
-// Status management struct
-type Status struct {
-	successfulCheckouts uint64
-	failedCheckouts     uint64
-	successfulPurchases uint64
-	failedPurchases     uint64
-	scheduledGoods      uint64
-	purchasedGoods      uint64
-	saleCompleted       uint32 // Atomic bool (0 or 1)
-}
+	leaseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.keepLease(leaseCtx, cancel, name, token)
+
+	log.Printf("Running finalization for sale %d (%s) on node %s with lease token %d...", sale.ID, sale.Name, s.nodeID, token)
+	err = s.finalizeSale(leaseCtx, sale, token)
 
-func NewStatus() *Status {
-	return &Status{}
+	if releaseErr := s.redisRepo.ReleaseLease(ctx, name, s.nodeID, token); releaseErr != nil {
+		log.Printf("Finalization lease release error for sale %d: %v", sale.ID, releaseErr)
+	}
+	return err
 }
 
-// ... Atomic getter and incrementer methods for Status ...
-func (s *Status) IncrementSuccessfulCheckouts() { atomic.AddUint64(&s.successfulCheckouts, 1) }
-func (s *Status) IncrementFailedCheckouts()     { atomic.AddUint64(&s.failedCheckouts, 1) }
-func (s *Status) IncrementSuccessfulPurchases() { atomic.AddUint64(&s.successfulPurchases, 1) }
-func (s *Status) IncrementFailedPurchases()     { atomic.AddUint64(&s.failedPurchases, 1) }
-func (s *Status) IncrementScheduledGoods()      { atomic.AddUint64(&s.scheduledGoods, 1) }
-func (s *Status) IncrementPurchasedGoods()      { atomic.AddUint64(&s.purchasedGoods, 1) }
+// keepLease renews a lease until ctx is done, and cancels the work it guards once the lease is lost.
+func (s *FlashSaleService) keepLease(ctx context.Context, cancel context.CancelFunc, name string, token int64) {
+	ticker := time.NewTicker(s.leaseTTL / 3)
+	defer ticker.Stop()
 
-func (s *Status) GetSuccessfulCheckouts() uint64 { return atomic.LoadUint64(&s.successfulCheckouts) }
-func (s *Status) GetFailedCheckouts() uint64     { return atomic.LoadUint64(&s.failedCheckouts) }
-func (s *Status) GetSuccessfulPurchases() uint64 { return atomic.LoadUint64(&s.successfulPurchases) }
-func (s *Status) GetFailedPurchases() uint64     { return atomic.LoadUint64(&s.failedPurchases) }
-func (s *Status) GetScheduledGoods() uint64      { return atomic.LoadUint64(&s.scheduledGoods) }
-func (s *Status) GetPurchasedGoods() uint64      { return atomic.LoadUint64(&s.purchasedGoods) }
+	for {
+		select {
+		case <-ticker.C:
+			renewed, err := s.redisRepo.RenewLease(ctx, name, s.nodeID, token, s.leaseTTL)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Lease %s renew error: %v", name, err)
+			}
+			if err == nil && !renewed {
+				log.Printf("Lease %s was lost, aborting the work it guards", name)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-func (s *Status) IsSaleCompleted() bool { return atomic.LoadUint32(&s.saleCompleted) == 1 }
-func (s *Status) SetSaleCompleted(val bool) {
-	if val {
-		atomic.StoreUint32(&s.saleCompleted, 1)
-	} else {
-		atomic.StoreUint32(&s.saleCompleted, 0)
+// settle applies the settlement policy stored on the sale.
+func (s *FlashSaleService) settle(sale *domain.Sale, pendingUnits int) (domain.SettlementOutcome, error) {
+	policy, err := s.settlementPolicy(sale.SettlementPolicy)
+	if err != nil {
+		return "", err
 	}
+	return policy.Settle(sale, pendingUnits), nil
 }
 
-func (s *Status) SaleStatusText() string {
-	if s.IsSaleCompleted() {
-		return "completed"
+func (s *FlashSaleService) finalizeSale(ctx context.Context, sale *domain.Sale, token int64) error {
+	// A node that took over from a dead finalizer finds the sale already settling
+	if sale.Status != domain.SaleSettling {
+		if _, err := s.pgRepo.TransitionSale(ctx, sale.ID, domain.SaleSettling); err != nil {
+			return fmt.Errorf("sale settling transition failed: %w", err)
+		}
+		s.saleChanged(ctx, sale.ID, domain.SaleSettling)
+	}
+
+	settlement, err := s.pgRepo.FinalizeSale(ctx, sale.ID, s.nodeID, token, s.settle)
+	if err != nil {
+		return fmt.Errorf("db finalization failed: %w", err)
+	}
+
+	s.saleChanged(ctx, sale.ID, domain.SaleSettled)
+	log.Printf("Sale %d settled with policy %s: %d orders %s", sale.ID, settlement.Policy, settlement.Purchases, settlement.Outcome)
+
+	// Clear the sale's reservations from Redis; its counters stay for /status
+	if err := s.redisRepo.ResetAllReservations(ctx, sale.ID); err != nil {
+		// Log error but don't fail the entire finalization. The system might recover.
+		log.Printf("Redis reset error: %v", err)
 	}
-	return "active"
+
+	return nil
 }
 
-func (s *Status) Reset() {
-	atomic.StoreUint64(&s.successfulCheckouts, 0)
-	atomic.StoreUint64(&s.failedCheckouts, 0)
-	atomic.StoreUint64(&s.successfulPurchases, 0)
-	atomic.StoreUint64(&s.failedPurchases, 0)
-	atomic.StoreUint64(&s.scheduledGoods, 0)
-	atomic.StoreUint64(&s.purchasedGoods, 0)
-	atomic.StoreUint32(&s.saleCompleted, 0)
+func generateUniqueCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// Scopes separate the idempotency keys of different operations.
+const (
+	IdempotencyScopeCheckout = "checkout"
+	IdempotencyScopePurchase = "purchase"
+)
+
+// idempotencyRequestBudget is how long a purchase may spend on Postgres and Redis besides the
+// payment authorization. Together they bound how long a crashed request can block retries with the
+// same key, and the lock has to outlive a slow request that is still running, or its retry would
+// charge the customer a second time.
+const idempotencyRequestBudget = 30 * time.Second
+
+// BeginIdempotentRequest claims an idempotency key for a request with the given fingerprint.
+// It returns the stored outcome when the request was already completed, or nil when the
+// caller should process it and then call CompleteIdempotentRequest or AbortIdempotentRequest.
+func (s *FlashSaleService) BeginIdempotentRequest(ctx context.Context, scope, key, fingerprint string) (*domain.IdempotencyRecord, error) {
+	record, acquired, err := s.redisRepo.AcquireIdempotencyKey(ctx, scope, key, fingerprint, s.idempotencyLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if acquired {
+		if scope != IdempotencyScopePurchase {
+			return nil, nil
+		}
+		// Purchases outlive the Redis TTL in Postgres, so a late retry still gets its original answer
+		stored, err := s.pgRepo.GetIdempotencyRecord(ctx, scope, key)
+		if err != nil {
+			s.AbortIdempotentRequest(ctx, scope, key)
+			return nil, err
+		}
+		if stored == nil {
+			return nil, nil
+		}
+		record = stored
+		if err := s.redisRepo.SaveIdempotencyRecord(ctx, scope, key, record, s.idempotencyTTL); err != nil {
+			log.Printf("Caching idempotency record %s/%s failed: %v", scope, key, err)
+		}
+	}
+
+	if record.Fingerprint != fingerprint {
+		return nil, domain.ErrIdempotencyKeyReused
+	}
+	if !record.Completed {
+		return nil, domain.ErrIdempotencyKeyInProgress
+	}
+	return record, nil
+}
+
+// CompleteIdempotentRequest stores the outcome of a request claimed with BeginIdempotentRequest.
+func (s *FlashSaleService) CompleteIdempotentRequest(ctx context.Context, scope, key, fingerprint string, statusCode int, body []byte) error {
+	record := &domain.IdempotencyRecord{
+		Fingerprint: fingerprint,
+		Completed:   true,
+		StatusCode:  statusCode,
+		Body:        body,
+	}
+	if scope == IdempotencyScopePurchase {
+		if err := s.pgRepo.SaveIdempotencyRecord(ctx, scope, key, record); err != nil {
+			return err
+		}
+	}
+	return s.redisRepo.SaveIdempotencyRecord(ctx, scope, key, record, s.idempotencyTTL)
+}
+
+// AbortIdempotentRequest releases a claimed key without storing an outcome, so a retry is processed again.
+func (s *FlashSaleService) AbortIdempotentRequest(ctx context.Context, scope, key string) {
+	if err := s.redisRepo.ReleaseIdempotencyKey(ctx, scope, key); err != nil {
+		log.Printf("Releasing idempotency key %s/%s failed: %v", scope, key, err)
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// saleCacheTTL bounds how long a replica serves checkouts and purchases from a cached sale.
+// Changes are announced over pub/sub and evict the cache right away; the TTL covers lost announcements.
+const saleCacheTTL = time.Second
+
+// saleCache keeps recently loaded sales and their catalogs so the hot path does not read
+// Postgres on every request.
+type saleCache struct {
+	mu       sync.RWMutex
+	entries  map[int64]cachedSale
+	catalogs map[int64]cachedCatalog
+}
+
+type cachedSale struct {
+	sale     *domain.Sale
+	loadedAt time.Time
+}
+
+type cachedCatalog struct {
+	items    map[string]*domain.CatalogItem
+	loadedAt time.Time
+}
+
+func newSaleCache() *saleCache {
+	return &saleCache{
+		entries:  make(map[int64]cachedSale),
+		catalogs: make(map[int64]cachedCatalog),
+	}
+}
+
+func (c *saleCache) get(saleID int64, now time.Time) (*domain.Sale, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[saleID]
+	if !ok || now.Sub(entry.loadedAt) >= saleCacheTTL {
+		return nil, false
+	}
+	return entry.sale, true
+}
+
+// lookup returns a cached sale however long ago it was loaded.
+func (c *saleCache) lookup(saleID int64) (*domain.Sale, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[saleID]
+	return entry.sale, ok
+}
+
+func (c *saleCache) put(sale *domain.Sale, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[sale.ID] = cachedSale{sale: sale, loadedAt: now}
+}
+
+func (c *saleCache) getCatalog(saleID int64, now time.Time) (map[string]*domain.CatalogItem, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.catalogs[saleID]
+	if !ok || now.Sub(entry.loadedAt) >= saleCacheTTL {
+		return nil, false
+	}
+	return entry.items, true
+}
+
+func (c *saleCache) putCatalog(saleID int64, items []*domain.CatalogItem, now time.Time) map[string]*domain.CatalogItem {
+	bySKU := make(map[string]*domain.CatalogItem, len(items))
+	for _, item := range items {
+		bySKU[item.SKU] = item
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.catalogs[saleID] = cachedCatalog{items: bySKU, loadedAt: now}
+	return bySKU
+}
+
+func (c *saleCache) invalidate(saleID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, saleID)
+	delete(c.catalogs, saleID)
+}
+
+// saleChanged evicts a sale from the local cache and tells the other replicas to do the same.
+// The counters of a sale that is over or deleted are dropped as well.
+func (s *FlashSaleService) saleChanged(ctx context.Context, saleID int64, status domain.SaleStatus) {
+	s.sales.invalidate(saleID)
+	if status == "" || status.IsTerminal() {
+		s.dropStatus(ctx, saleID)
+	}
+	event := &domain.SaleEvent{SaleID: saleID, Status: status, NodeID: s.nodeID}
+	if err := s.redisRepo.PublishSaleEvent(ctx, event); err != nil {
+		log.Printf("Announcing change of sale %d failed, other replicas pick it up within %v: %v", saleID, saleCacheTTL, err)
+	}
+}
+
+// RunSaleEventListener applies sale changes announced by other replicas until ctx is done.
+func (s *FlashSaleService) RunSaleEventListener(ctx context.Context) {
+	log.Println("Starting sale event listener...")
+	for {
+		err := s.redisRepo.SubscribeSaleEvents(ctx, func(event *domain.SaleEvent) {
+			if event.NodeID == s.nodeID {
+				return
+			}
+			s.sales.invalidate(event.SaleID)
+			if event.Status == "" || event.Status.IsTerminal() {
+				s.dropStatus(ctx, event.SaleID)
+			}
+			log.Printf("Sale %d changed on node %s (status %s)", event.SaleID, event.NodeID, event.Status)
+		})
+		if err != nil {
+			log.Printf("Sale event subscription failed: %v", err)
+		}
+
+		select {
+		case <-time.After(saleCacheTTL):
+		case <-ctx.Done():
+			log.Println("Stopping sale event listener.")
+			return
+		}
+	}
+}
+
+// PauseSale stops a sale from accepting new checkouts. Existing reservations can still be purchased.
+func (s *FlashSaleService) PauseSale(ctx context.Context, saleID int64) (*domain.Sale, error) {
+	sale, err := s.pgRepo.TransitionSale(ctx, saleID, domain.SalePaused)
+	if err != nil {
+		return nil, err
+	}
+	s.saleChanged(ctx, sale.ID, sale.Status)
+	log.Printf("Sale %d paused", sale.ID)
+	return sale, nil
+}
+
+// ResumeSale reopens a paused sale.
+func (s *FlashSaleService) ResumeSale(ctx context.Context, saleID int64) (*domain.Sale, error) {
+	current, err := s.pgRepo.GetSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != domain.SalePaused {
+		return nil, domain.TransitionError(current.Status, domain.SaleOpen)
+	}
+	sale, err := s.pgRepo.TransitionSale(ctx, saleID, domain.SaleOpen)
+	if err != nil {
+		return nil, err
+	}
+	s.saleChanged(ctx, sale.ID, sale.Status)
+	log.Printf("Sale %d resumed", sale.ID)
+	return sale, nil
+}
+
+// AbortSale cancels a sale before it settles: its pending purchases are cancelled and its
+// reservations dropped. It returns the sale and the number of cancelled purchases.
+func (s *FlashSaleService) AbortSale(ctx context.Context, saleID int64) (*domain.Sale, int64, error) {
+	sale, cancelled, err := s.pgRepo.AbortSale(ctx, saleID, s.nodeID)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.saleChanged(ctx, sale.ID, sale.Status)
+	log.Printf("Sale %d aborted, %d pending purchases cancelled", sale.ID, cancelled)
+
+	// Reservations of a cancelled sale can no longer be purchased; dropping them is only cleanup
+	if err := s.redisRepo.ResetAllReservations(ctx, sale.ID); err != nil {
+		log.Printf("Redis reset error: %v", err)
+	}
+	return sale, cancelled, nil
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"flash/internal/domain"
+)
+
+const (
+	// lotteryPollInterval is how often due lottery draws are run and their outcomes sent out.
+	lotteryPollInterval = 2 * time.Second
+	// lotteryNotifyBatchSize bounds how many users a single pass notifies.
+	lotteryNotifyBatchSize = 100
+	// lotteryLeaseName is the lease that makes a single replica draw lotteries at a time.
+	lotteryLeaseName = "lottery"
+)
+
+// EnterLottery registers the entry of a user to a lottery sale. Entries are taken until the sale
+// starts, one per user, and may ask for at most the sale's per-user limit. The price of every line
+// is captured when entering.
+func (s *FlashSaleService) EnterLottery(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine) (*domain.LotteryEntry, error) {
+	if err := domain.ValidateLines(lines); err != nil {
+		return nil, err
+	}
+	sale, err := s.getCurrentSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sale.CheckEntry(time.Now()); err != nil {
+		return nil, err
+	}
+	catalog, err := s.getCatalog(ctx, sale.ID)
+	if err != nil {
+		return nil, err
+	}
+	lines, err = domain.PriceLines(lines, catalog)
+	if err != nil {
+		return nil, err
+	}
+	if domain.Units(lines) > sale.PerUserLimit {
+		return nil, domain.PurchaseLimitError(sale.PerUserLimit)
+	}
+	// The seed is committed to before the first entry is taken
+	if _, err := s.lottery(ctx, sale.ID); err != nil {
+		return nil, err
+	}
+
+	entry := &domain.LotteryEntry{SaleID: sale.ID, UserID: userID, Lines: lines, Status: domain.EntryEntered}
+	if err := s.pgRepo.SaveLotteryEntry(ctx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GetLotteryEntry returns the entry of a user, with the reservation code to purchase once it won.
+func (s *FlashSaleService) GetLotteryEntry(ctx context.Context, saleID int64, userID string) (*domain.LotteryEntry, error) {
+	return s.pgRepo.GetLotteryEntry(ctx, saleID, userID)
+}
+
+// ListLotteryEntries returns every entry of a lottery, in draw order once drawn, for audits.
+func (s *FlashSaleService) ListLotteryEntries(ctx context.Context, saleID int64) ([]*domain.LotteryEntry, error) {
+	if _, err := s.getLotterySale(ctx, saleID); err != nil {
+		return nil, err
+	}
+	return s.pgRepo.ListLotteryEntries(ctx, saleID)
+}
+
+// GetLottery returns the draw of a lottery sale. Its seed is only revealed once the draw is done;
+// until then only the seed's hash is.
+func (s *FlashSaleService) GetLottery(ctx context.Context, saleID int64) (*domain.Lottery, error) {
+	sale, err := s.getLotterySale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	lottery, err := s.lottery(ctx, sale.ID)
+	if err != nil {
+		return nil, err
+	}
+	if lottery.DrawnAt == nil {
+		lottery.Seed = ""
+	}
+	return lottery, nil
+}
+
+func (s *FlashSaleService) getLotterySale(ctx context.Context, saleID int64) (*domain.Sale, error) {
+	sale, err := s.pgRepo.GetSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	if sale.Mode != domain.SaleModeLottery {
+		return nil, domain.ErrNotLottery
+	}
+	return sale, nil
+}
+
+// lottery returns the lottery of a sale, drawing its seed the first time it is asked for.
+func (s *FlashSaleService) lottery(ctx context.Context, saleID int64) (*domain.Lottery, error) {
+	lottery, err := s.pgRepo.GetLottery(ctx, saleID)
+	if !errors.Is(err, domain.ErrNotLottery) {
+		return lottery, err
+	}
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("could not generate lottery seed: %w", err)
+	}
+	return s.pgRepo.CreateLottery(ctx, saleID, hex.EncodeToString(seed), domain.LotterySeedHash(seed))
+}
+
+// RunLotteryDrawer draws the winners of lottery sales once they open and tells every entrant
+// the outcome. Every replica runs it; a lease makes sure only one of them draws at a time.
+func (s *FlashSaleService) RunLotteryDrawer(ctx context.Context) {
+	log.Println("Starting lottery drawer...")
+	ticker := time.NewTicker(lotteryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.drawLotteriesWithLease(ctx); err != nil {
+				log.Printf("Lottery draw error: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("Stopping lottery drawer.")
+			return
+		}
+	}
+}
+
+func (s *FlashSaleService) drawLotteriesWithLease(ctx context.Context) error {
+	token, acquired, err := s.redisRepo.AcquireLease(ctx, lotteryLeaseName, s.nodeID, 0, s.leaseTTL)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.keepLease(leaseCtx, cancel, lotteryLeaseName, token)
+
+	sales, err := s.pgRepo.ListLotteriesToDraw(leaseCtx, time.Now())
+	if err != nil {
+		log.Printf("Listing lotteries to draw failed: %v", err)
+	}
+	for _, sale := range sales {
+		if err := s.drawLottery(leaseCtx, sale); err != nil {
+			log.Printf("Drawing lottery of sale %d failed, retrying on the next poll: %v", sale.ID, err)
+		}
+	}
+	s.notifyLotteryEntries(leaseCtx)
+
+	if err := s.redisRepo.ReleaseLease(ctx, lotteryLeaseName, s.nodeID, token); err != nil {
+		log.Printf("Lottery lease release error: %v", err)
+	}
+	return nil
+}
+
+// drawLottery goes through the entries of a lottery in draw order and reserves what every entry
+// asks for while the stock of its items and the sale's quota last. Winning reservations are held
+// until the sale ends and are purchased like any other. A draw that was interrupted picks up where
+// it stopped, since the order only depends on the seed and the entries.
+func (s *FlashSaleService) drawLottery(ctx context.Context, sale *domain.Sale) error {
+	lottery, err := s.lottery(ctx, sale.ID)
+	if err != nil {
+		return err
+	}
+	entries, err := s.pgRepo.ListClosedLotteryEntries(ctx, sale.ID)
+	if err != nil {
+		return err
+	}
+	// Entries closed when the sale opened, so the entries hash is the same on every attempt
+	entriesHash, err := domain.DrawOrder(lottery.Seed, entries)
+	if err != nil {
+		return err
+	}
+	catalog, err := s.getCatalog(ctx, sale.ID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Drawing lottery of sale %d (%s) from %d entries...", sale.ID, sale.Name, len(entries))
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.Status != domain.EntryEntered {
+			continue
+		}
+		if err := s.drawEntry(ctx, sale, catalog, entry); err != nil {
+			return fmt.Errorf("entry %d: %w", entry.ID, err)
+		}
+	}
+
+	drawn, err := s.pgRepo.CompleteLotteryDraw(ctx, sale.ID, s.nodeID, entriesHash)
+	if err != nil {
+		return err
+	}
+	log.Printf("Lottery of sale %d drawn with seed %s and entries hash %s: %d of %d entries won %d units", sale.ID, drawn.Seed,
+		drawn.EntriesHash, drawn.Winners, drawn.Entries, drawn.Units)
+	return nil
+}
+
+// drawEntry reserves the lines of an entry under a new code, or marks the entry lost if they
+// cannot be had. The code is stored before reserving, so a draw that stops in between finds
+// the reservation again instead of taking a second one.
+func (s *FlashSaleService) drawEntry(ctx context.Context, sale *domain.Sale, catalog map[string]*domain.CatalogItem,
+	entry *domain.LotteryEntry) error {
+	hold := time.Until(sale.EndsAt)
+	if entry.Code != "" {
+		_, _, err := s.redisRepo.HoldReservation(ctx, sale.ID, entry.Code, entry.UserID, hold)
+		if err == nil {
+			entry.Status = domain.EntryWon
+			return s.pgRepo.UpdateLotteryEntry(ctx, entry)
+		}
+		if !errors.Is(err, domain.ErrReservationNotFound) {
+			return err
+		}
+	} else {
+		code, err := generateUniqueCode()
+		if err != nil {
+			return fmt.Errorf("could not generate code: %w", err)
+		}
+		entry.Code = code
+		if err := s.pgRepo.UpdateLotteryEntry(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	err := s.reserveEntry(ctx, sale, catalog, entry)
+	switch {
+	case err == nil:
+		if _, _, err := s.redisRepo.HoldReservation(ctx, sale.ID, entry.Code, entry.UserID, hold); err != nil {
+			return err
+		}
+		entry.Status = domain.EntryWon
+		s.statusOf(sale).IncrementSuccessfulCheckouts()
+		s.statusOf(sale).AddScheduledGoods(uint64(domain.Units(entry.Lines)))
+	case errors.Is(err, domain.ErrOutOfStock), errors.Is(err, domain.ErrSaleSoldOut), errors.Is(err, domain.ErrUnknownItem),
+		errors.Is(err, domain.ErrPurchaseLimitExceeded), errors.Is(err, domain.ErrConcurrentReservationExceeded):
+		entry.Status = domain.EntryLost
+		entry.Code = ""
+	default:
+		return err
+	}
+	return s.pgRepo.UpdateLotteryEntry(ctx, entry)
+}
+
+func (s *FlashSaleService) reserveEntry(ctx context.Context, sale *domain.Sale, catalog map[string]*domain.CatalogItem,
+	entry *domain.LotteryEntry) error {
+	// Items can leave the catalog until the sale starts, after the entry was taken
+	for _, line := range entry.Lines {
+		if _, ok := catalog[line.ItemID]; !ok {
+			return fmt.Errorf("%w: %s", domain.ErrUnknownItem, line.ItemID)
+		}
+	}
+	return s.redisRepo.CreateReservation(ctx, sale.ID, sale.Limits(), entry.UserID, entry.Lines, catalog, entry.Code)
+}
+
+// notifyLotteryEntries tells the users of drawn entries whether they won. Failed notifications
+// are retried on the next poll.
+func (s *FlashSaleService) notifyLotteryEntries(ctx context.Context) {
+	if s.notifier == nil {
+		return
+	}
+	entries, err := s.pgRepo.ListEntriesToNotify(ctx, lotteryNotifyBatchSize)
+	if err != nil {
+		log.Printf("Listing lottery entries to notify failed: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		notification := Notification{
+			Kind:    NotificationLotteryLost,
+			UserID:  entry.UserID,
+			SaleID:  entry.SaleID,
+			Message: "Your lottery entry was not drawn this time.",
+		}
+		if entry.Status == domain.EntryWon {
+			notification.Kind = NotificationLotteryWon
+			notification.Code = entry.Code
+			notification.Message = "Your lottery entry won. Purchase it with your reservation code before the sale ends."
+		}
+		if err := s.notifier.Notify(ctx, notification); err != nil {
+			log.Printf("Notifying user %s of lottery entry %d failed: %v", entry.UserID, entry.ID, err)
+			continue
+		}
+		if err := s.pgRepo.MarkEntryNotified(ctx, entry.ID); err != nil {
+			log.Printf("Recording notification of lottery entry %d failed: %v", entry.ID, err)
+		}
+	}
+}
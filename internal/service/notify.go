@@ -0,0 +1,28 @@
+package service
+
+import "context"
+
+// Kinds of notifications sent to users.
+const (
+	NotificationLotteryWon  = "lottery_won"
+	NotificationLotteryLost = "lottery_lost"
+	// NotificationWaitlistReserved tells a waitlisted user that units came free and were reserved for them.
+	NotificationWaitlistReserved = "waitlist_reserved"
+)
+
+// Notifier tells users about outcomes that happen without them asking, such as a lottery draw
+// or a reservation taken for them from a waitlist.
+// Notifications that fail are sent again later, so a user may get the same one twice.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notification is a message to a user about a sale. Code is the reservation code the user was
+// given, if any.
+type Notification struct {
+	Kind    string
+	UserID  string
+	SaleID  int64
+	Code    string
+	Message string
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"flash/internal/domain"
+)
+
+// CancelOrder cancels an order of userID, or any order when userID is empty, which is how
+// operators cancel on a customer's behalf.
+//
+// An order cancelled before its sale settled gives its units back: they are taken off the sold
+// counts and returned to stock in Redis, and its payment is voided. An order that was already
+// confirmed gets a refund request, which the payment settler pays back.
+func (s *FlashSaleService) CancelOrder(ctx context.Context, orderID int64, userID, reason string) (*domain.Cancellation, error) {
+	actor := domain.AdminActor
+	if userID != "" {
+		actor = domain.UserActor(userID)
+	}
+	cancellation, events, err := s.pgRepo.CancelOrder(ctx, orderID, userID, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	order := cancellation.Order
+	log.Printf("Order %d of sale %d cancelled by %s", order.ID, order.SaleID, actor)
+
+	// Whatever fails here is retried by the outbox relay
+	for _, event := range events {
+		if err := s.applyOutboxEvent(ctx, event); err != nil {
+			log.Printf("Outbox event %d for sale %d not applied yet, leaving it to the relay: %v", event.ID, order.SaleID, err)
+		}
+	}
+	if payment := cancellation.Payment; payment != nil && payment.Status == domain.PaymentAuthorized && s.payments != nil {
+		s.voidPayment(ctx, payment, "its order was cancelled")
+	}
+
+	s.countCancelledOrder(ctx, order.SaleID)
+	if len(events) > 0 {
+		s.markAvailable(ctx, order.SaleID)
+	}
+	return cancellation, nil
+}
+
+// ListOrderEvents returns the audit trail of an order.
+func (s *FlashSaleService) ListOrderEvents(ctx context.Context, orderID int64) ([]*domain.OrderEvent, error) {
+	return s.pgRepo.ListOrderEvents(ctx, orderID)
+}
+
+// markAvailable reopens a sold out sale whose cancelled orders freed some of its quota.
+func (s *FlashSaleService) markAvailable(ctx context.Context, saleID int64) {
+	reopened, err := s.pgRepo.MarkAvailable(ctx, saleID)
+	if err != nil {
+		log.Printf("Availability check for sale %d failed: %v", saleID, err)
+		return
+	}
+	if reopened {
+		s.saleChanged(ctx, saleID, domain.SaleOpen)
+		log.Printf("Sale %d is open again after a cancellation", saleID)
+	}
+}
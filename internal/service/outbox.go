@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"flash/internal/domain"
+)
+
+const (
+	// outboxRelayInterval is how often pending outbox events are retried.
+	outboxRelayInterval = time.Second
+	// outboxBatchSize bounds how many events a single relay pass applies.
+	outboxBatchSize = 500
+	// outboxAlertAttempts is the number of failed attempts after which every further failure is logged.
+	outboxAlertAttempts = 10
+)
+
+// RunOutboxRelay applies pending outbox events to Redis until each one is acknowledged,
+// so Redis converges to the purchases committed in Postgres.
+func (s *FlashSaleService) RunOutboxRelay(ctx context.Context) {
+	log.Println("Starting outbox relay...")
+	ticker := time.NewTicker(outboxRelayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.relayOutbox(ctx)
+		case <-ctx.Done():
+			log.Println("Stopping outbox relay.")
+			return
+		}
+	}
+}
+
+func (s *FlashSaleService) relayOutbox(ctx context.Context) {
+	events, err := s.pgRepo.ListPendingOutboxEvents(ctx, outboxBatchSize)
+	if err != nil {
+		log.Printf("Listing pending outbox events failed: %v", err)
+		return
+	}
+	for _, event := range events {
+		if err := s.applyOutboxEvent(ctx, event); err != nil && event.Attempts+1 >= outboxAlertAttempts {
+			log.Printf("Outbox event %d (%s, sale %d) still failing after %d attempts: %v",
+				event.ID, event.Kind, event.SaleID, event.Attempts+1, err)
+		}
+	}
+}
+
+// applyOutboxEvent applies a single event and acknowledges it. Applying is idempotent,
+// so an event whose acknowledgement got lost is simply applied again.
+func (s *FlashSaleService) applyOutboxEvent(ctx context.Context, event *domain.OutboxEvent) error {
+	if err := s.redisRepo.ApplyOutboxEvent(ctx, event); err != nil {
+		if failErr := s.pgRepo.FailOutboxEvent(ctx, event.ID, err.Error()); failErr != nil {
+			log.Printf("Recording failure of outbox event %d failed: %v", event.ID, failErr)
+		}
+		return err
+	}
+	if err := s.pgRepo.AckOutboxEvent(ctx, event.ID); err != nil {
+		log.Printf("Acknowledging outbox event %d failed: %v", event.ID, err)
+	}
+	return nil
+}
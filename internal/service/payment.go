@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"flash/internal/domain"
+)
+
+const (
+	// paymentSettleInterval is how often authorized payments of settled or failed orders are captured or voided.
+	paymentSettleInterval = 5 * time.Second
+	// paymentBatchSize bounds how many payments a single pass captures and voids.
+	paymentBatchSize = 100
+	// paymentOrphanGrace is how long an authorization may stay without an order before it is voided,
+	// long enough for the purchase that took it to finish or fail.
+	paymentOrphanGrace = time.Minute
+	// paymentLeaseName is the lease that makes a single replica capture and void payments at a time.
+	paymentLeaseName = "payments"
+)
+
+// PaymentProvider charges customers for their purchases in two phases: the amount is authorized
+// when a reservation is purchased and captured once its sale settles with the order confirmed.
+// Authorizations of orders that are not kept are voided; captured payments can be refunded.
+//
+// Capture and Void may be retried for the same authorization and must be idempotent. Refund may be
+// retried with the same key, e.g. when recording a completed refund failed, and must pay back the
+// amount only once per key.
+type PaymentProvider interface {
+	// Authorize holds the amount of the request and returns the provider's authorization ID.
+	// It returns an error matching domain.ErrPaymentDeclined when the customer cannot pay.
+	Authorize(ctx context.Context, req PaymentRequest) (string, error)
+	Capture(ctx context.Context, authorizationID string, amount int64) error
+	Void(ctx context.Context, authorizationID string) error
+	// Refund pays back the amount of a captured authorization. Key identifies the refund.
+	Refund(ctx context.Context, authorizationID, key string, amount int64) error
+}
+
+// PaymentRequest is the payment of a reservation, in the minor unit of Currency.
+// Reference is the reservation code, so the provider can tell retries of the same purchase.
+type PaymentRequest struct {
+	Reference string
+	UserID    string
+	Amount    int64
+	Currency  string
+}
+
+// authorizePayment authorizes the total of the lines and records the authorization.
+// The authorization is bounded by the authorization timeout, which is also how long
+// the reservation is held for it.
+func (s *FlashSaleService) authorizePayment(ctx context.Context, saleID int64, userID string,
+	lines []domain.OrderLine, code string) (*domain.Payment, error) {
+	if s.payments == nil {
+		return nil, errors.New("no payment provider configured")
+	}
+	payment := &domain.Payment{
+		SaleID: saleID,
+		Code:   code,
+		UserID: userID,
+		Amount: domain.Total(lines),
+		Status: domain.PaymentAuthorized,
+	}
+	if len(lines) > 0 {
+		payment.Currency = lines[0].Currency
+	}
+
+	authCtx, cancel := context.WithTimeout(ctx, s.authorizationTimeout)
+	defer cancel()
+	authorizationID, err := s.payments.Authorize(authCtx, PaymentRequest{
+		Reference: code,
+		UserID:    userID,
+		Amount:    payment.Amount,
+		Currency:  payment.Currency,
+	})
+	if err != nil {
+		if errors.Is(err, domain.ErrPaymentDeclined) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("payment authorization failed: %w", err)
+	}
+	payment.AuthorizationID = authorizationID
+
+	if err := s.pgRepo.SavePayment(ctx, payment); err != nil {
+		// Without a record nothing would ever release the authorization
+		s.voidPayment(ctx, payment, "recording the authorization failed")
+		return nil, fmt.Errorf("failed to save payment: %w", err)
+	}
+	return payment, nil
+}
+
+// voidPayment releases the authorization of a purchase that did not go through.
+// A payment whose void fails stays authorized in Postgres and is retried by the payment settler
+// once it is old enough to be an orphan.
+func (s *FlashSaleService) voidPayment(ctx context.Context, payment *domain.Payment, reason string) {
+	if err := s.payments.Void(ctx, payment.AuthorizationID); err != nil {
+		log.Printf("Voiding payment %s of reservation %s failed, the settler retries it: %v", payment.AuthorizationID, payment.Code, err)
+		return
+	}
+	log.Printf("Payment %s of reservation %s voided: %s", payment.AuthorizationID, payment.Code, reason)
+	if payment.ID == 0 {
+		return
+	}
+	if err := s.pgRepo.UpdatePaymentStatus(ctx, payment.ID, domain.PaymentVoided, s.nodeID); err != nil {
+		log.Printf("Recording void of payment %d failed: %v", payment.ID, err)
+	}
+}
+
+// RunPaymentSettler captures the payments of confirmed orders, voids those of cancelled,
+// deleted and never recorded orders and pays back requested refunds, so customers are only
+// charged for what they get. Confirmed orders left without a payment are flagged for operators.
+// Every replica runs it; a lease makes sure only one of them talks to the provider at a time.
+func (s *FlashSaleService) RunPaymentSettler(ctx context.Context) {
+	log.Println("Starting payment settler...")
+	ticker := time.NewTicker(paymentSettleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.settlePaymentsWithLease(ctx); err != nil {
+				log.Printf("Payment settlement error: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("Stopping payment settler.")
+			return
+		}
+	}
+}
+
+func (s *FlashSaleService) settlePaymentsWithLease(ctx context.Context) error {
+	token, acquired, err := s.redisRepo.AcquireLease(ctx, paymentLeaseName, s.nodeID, 0, s.leaseTTL)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.keepLease(leaseCtx, cancel, paymentLeaseName, token)
+
+	s.settlePayments(leaseCtx)
+
+	if err := s.redisRepo.ReleaseLease(ctx, paymentLeaseName, s.nodeID, token); err != nil {
+		log.Printf("Payment lease release error: %v", err)
+	}
+	return nil
+}
+
+func (s *FlashSaleService) settlePayments(ctx context.Context) {
+	if s.payments == nil {
+		return
+	}
+
+	toCapture, err := s.pgRepo.ListPaymentsToCapture(ctx, paymentBatchSize)
+	if err != nil {
+		log.Printf("Listing payments to capture failed: %v", err)
+	}
+	for _, payment := range toCapture {
+		if err := s.payments.Capture(ctx, payment.AuthorizationID, payment.Amount); err != nil {
+			log.Printf("Capturing payment %d of order %d failed: %v", payment.ID, payment.OrderID, err)
+			continue
+		}
+		if err := s.pgRepo.UpdatePaymentStatus(ctx, payment.ID, domain.PaymentCaptured, s.nodeID); err != nil {
+			log.Printf("Recording capture of payment %d failed: %v", payment.ID, err)
+		}
+	}
+
+	toVoid, err := s.pgRepo.ListPaymentsToVoid(ctx, time.Now().Add(-paymentOrphanGrace), paymentBatchSize)
+	if err != nil {
+		log.Printf("Listing payments to void failed: %v", err)
+	}
+	for _, payment := range toVoid {
+		s.voidPayment(ctx, payment, "its order was not kept")
+	}
+
+	refunds, err := s.pgRepo.ListRefundsToProcess(ctx, paymentBatchSize)
+	if err != nil {
+		log.Printf("Listing refunds to process failed: %v", err)
+	}
+	for _, refund := range refunds {
+		s.processRefund(ctx, refund)
+	}
+
+	// A confirmed order should never lose its payment; when one does, e.g. because a purchase was
+	// compensated although its order had been recorded, an operator has to settle it with the customer
+	unpaid, err := s.pgRepo.FlagUnpaidOrders(ctx, s.nodeID, paymentBatchSize)
+	if err != nil {
+		log.Printf("Flagging unpaid orders failed: %v", err)
+	}
+	for _, payment := range unpaid {
+		log.Printf("Order %d of sale %d is confirmed but its payment %d was voided, so %d %s were never charged to user %s; "+
+			"it has to be settled by hand",
+			payment.OrderID, payment.SaleID, payment.ID, payment.Amount, payment.Currency, payment.UserID)
+	}
+}
+
+// processRefund pays back a refund whose payment was captured. A refund whose payment was voided
+// instead, or whose order had no payment, is completed without money changing hands.
+func (s *FlashSaleService) processRefund(ctx context.Context, refund *domain.Refund) {
+	status := domain.RefundNotCharged
+	if refund.PaymentStatus == domain.PaymentCaptured {
+		// The refund ID keys the refund, so retrying one whose completion was not recorded pays nothing twice
+		if err := s.payments.Refund(ctx, refund.AuthorizationID, refundKey(refund), refund.Amount); err != nil {
+			log.Printf("Refunding order %d failed: %v", refund.OrderID, err)
+			return
+		}
+		status = domain.RefundCompleted
+	}
+	if err := s.pgRepo.CompleteRefund(ctx, refund, status, s.nodeID); err != nil {
+		log.Printf("Recording refund %d of order %d failed: %v", refund.ID, refund.OrderID, err)
+		return
+	}
+	log.Printf("Refund %d of order %d: %s", refund.ID, refund.OrderID, status)
+}
+
+// refundKey is the idempotency key a refund is paid back with.
+func refundKey(refund *domain.Refund) string {
+	return "refund_" + strconv.FormatInt(refund.ID, 10)
+}
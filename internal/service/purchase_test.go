@@ -0,0 +1,232 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"flash/internal/auth"
+	"flash/internal/domain"
+	"flash/internal/payment"
+	redisrepo "flash/internal/repository/redis"
+	"flash/internal/service"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// purchaseRepo is the Postgres side of a purchase. It keeps orders in memory and rejects a second
+// order for the same code, like the unique index on the codes of the sales table does.
+type purchaseRepo struct {
+	service.PostgresRepository
+	sale *domain.Sale
+
+	mu     sync.Mutex
+	orders map[string]*domain.Order
+	nextID int64
+	voided int
+	// lostCommit makes ProcessPurchase record the order and still fail, like a commit whose reply was lost
+	lostCommit bool
+}
+
+func (r *purchaseRepo) GetSale(ctx context.Context, id int64) (*domain.Sale, error) {
+	sale := *r.sale
+	return &sale, nil
+}
+
+func (r *purchaseRepo) SavePayment(ctx context.Context, payment *domain.Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	payment.ID = r.nextID
+	return nil
+}
+
+func (r *purchaseRepo) UpdatePaymentStatus(ctx context.Context, id int64, status domain.PaymentStatus, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if status == domain.PaymentVoided {
+		r.voided++
+	}
+	return nil
+}
+
+func (r *purchaseRepo) ProcessPurchase(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine, code string,
+	payment *domain.Payment) (*domain.Order, []*domain.OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.orders[code]; ok {
+		return nil, nil, domain.ErrDuplicatePurchase
+	}
+	r.nextID++
+	order := &domain.Order{ID: r.nextID, SaleID: saleID, UserID: userID, Code: code, Lines: lines}
+	r.orders[code] = order
+	event := &domain.OutboxEvent{ID: r.nextID, SaleID: saleID, Kind: domain.OutboxPurchase, UserID: userID, Lines: lines, Code: code}
+	if r.lostCommit {
+		return nil, nil, errors.New("transaction commit error: connection reset")
+	}
+	return order, []*domain.OutboxEvent{event}, nil
+}
+
+func (r *purchaseRepo) GetOrderByCode(ctx context.Context, code string) (*domain.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[code]
+	if !ok {
+		return nil, domain.ErrOrderNotFound
+	}
+	return order, nil
+}
+
+func (r *purchaseRepo) AckOutboxEvent(ctx context.Context, id int64) error {
+	return nil
+}
+
+func (r *purchaseRepo) FailOutboxEvent(ctx context.Context, id int64, reason string) error {
+	return nil
+}
+
+const (
+	testCode   = "c0ffee"
+	testUserID = "user1"
+	testPrefix = "sale:{1}:"
+)
+
+// newPurchaseService returns a service backed by miniredis and pgRepo, with two units of a single
+// item reserved under testCode for testUserID.
+func newPurchaseService(t *testing.T, pgRepo *purchaseRepo) (*service.FlashSaleService, *miniredis.Miniredis) {
+	t.Helper()
+	ctx := context.Background()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	redisRepo := redisrepo.NewRedisRepository(client, time.Minute)
+
+	now := time.Now()
+	pgRepo.sale = &domain.Sale{
+		ID:                        1,
+		StartsAt:                  now.Add(-time.Hour),
+		EndsAt:                    now.Add(time.Hour),
+		ItemQuota:                 100,
+		PerUserLimit:              5,
+		MaxConcurrentReservations: 5,
+		Status:                    domain.SaleOpen,
+	}
+	pgRepo.orders = make(map[string]*domain.Order)
+	item := &domain.CatalogItem{SaleID: pgRepo.sale.ID, SKU: "sneaker-42", Stock: 10, Price: 1000, Currency: "EUR"}
+	lines := []domain.OrderLine{{ItemID: item.SKU, Quantity: 2, UnitPrice: item.Price, Currency: item.Currency}}
+	catalog := map[string]*domain.CatalogItem{item.SKU: item}
+	err := redisRepo.CreateReservation(ctx, pgRepo.sale.ID, pgRepo.sale.Limits(), testUserID, lines, catalog, testCode)
+	if err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+
+	// Payments are held for longer than a reservation lives, so a hold moves its expiry
+	svc := service.NewFlashSaleService(pgRepo, redisRepo, service.Options{
+		NodeID:               "test",
+		Payments:             payment.NewFakeProvider(payment.FakeOptions{}),
+		AuthorizationTimeout: 2 * time.Minute,
+	})
+	return svc, server
+}
+
+// checkSold checks that the reserved units are counted as sold exactly once.
+func checkSold(t *testing.T, server *miniredis.Miniredis) {
+	t.Helper()
+	for key, want := range map[string]string{
+		"sold_count":                   "2",
+		"user_purchases:" + testUserID: "2",
+		"sold:sneaker-42":              "2",
+		"stock:sneaker-42":             "8",
+		"reserved_units":               "0",
+	} {
+		got, err := server.Get(testPrefix + key)
+		if err != nil || got != want {
+			t.Errorf("%s = %q (%v), want %q", key, got, err, want)
+		}
+	}
+}
+
+// TestConcurrentPurchasesOfOneCode races buyers for the same reservation code through the real
+// Redis scripts and checks that exactly one of them gets the order and its units are sold once.
+func TestConcurrentPurchasesOfOneCode(t *testing.T) {
+	const buyers = 32
+	ctx := context.Background()
+	pgRepo := &purchaseRepo{}
+	svc, server := newPurchaseService(t, pgRepo)
+
+	var (
+		successes int64
+		wg        sync.WaitGroup
+		start     = make(chan struct{})
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := svc.ProcessPurchase(ctx, pgRepo.sale.ID, testCode)
+			switch {
+			case err == nil:
+				atomic.AddInt64(&successes, 1)
+			case !errors.Is(err, domain.ErrReservationNotFound):
+				t.Errorf("unexpected purchase error: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if successes != 1 {
+		t.Fatalf("%d purchases succeeded, want exactly 1", successes)
+	}
+	if len(pgRepo.orders) != 1 {
+		t.Fatalf("%d orders recorded, want 1", len(pgRepo.orders))
+	}
+	checkSold(t, server)
+	if server.Exists(testPrefix + "claimed:" + testCode) {
+		t.Errorf("claim of %s was not confirmed by its outbox event", testCode)
+	}
+}
+
+// TestPurchaseWithLostCommit checks that a purchase whose order was recorded keeps its payment and
+// its sold units even though the write reported an error.
+func TestPurchaseWithLostCommit(t *testing.T) {
+	pgRepo := &purchaseRepo{lostCommit: true}
+	svc, server := newPurchaseService(t, pgRepo)
+
+	result, err := svc.ProcessPurchase(context.Background(), pgRepo.sale.ID, testCode)
+	if err != nil {
+		t.Fatalf("ProcessPurchase() error = %v", err)
+	}
+	if order := pgRepo.orders[testCode]; order == nil || result.OrderID != order.ID {
+		t.Fatalf("ProcessPurchase() = order %d, want the recorded order", result.OrderID)
+	}
+	if pgRepo.voided != 0 {
+		t.Errorf("%d payments voided, want none", pgRepo.voided)
+	}
+	checkSold(t, server)
+}
+
+// TestPurchaseOfAnotherUsersReservation checks that a user cannot buy, nor keep alive, a
+// reservation that belongs to someone else.
+func TestPurchaseOfAnotherUsersReservation(t *testing.T) {
+	pgRepo := &purchaseRepo{}
+	svc, server := newPurchaseService(t, pgRepo)
+	expiry, err := server.ZScore(testPrefix+"reservations:global", testCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := auth.WithUser(context.Background(), "mallory")
+	if _, err := svc.ProcessPurchase(ctx, pgRepo.sale.ID, testCode); !errors.Is(err, domain.ErrReservationNotOwned) {
+		t.Fatalf("ProcessPurchase() error = %v, want %v", err, domain.ErrReservationNotOwned)
+	}
+	if held, _ := server.ZScore(testPrefix+"reservations:global", testCode); held != expiry {
+		t.Errorf("reservation held until %v by another user, want it to expire at %v", held, expiry)
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// JoinQueue puts a user in the waiting room of a sale and returns their ticket. Users can queue
+// before the sale starts; admission begins at its start. Joining again while waiting or admitted
+// returns the ticket the user already holds.
+func (s *FlashSaleService) JoinQueue(ctx context.Context, saleID int64, userID string) (*domain.QueueTicket, error) {
+	sale, err := s.getWaitingRoomSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if sale.Status.IsTerminal() || !now.Before(sale.EndsAt) {
+		return nil, domain.ErrSaleNotActive
+	}
+
+	ticket, err := generateUniqueCode()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate ticket: %w", err)
+	}
+	// A ticket is of no use after the sale, except to check out with an admission taken just before its end
+	ttl := sale.EndsAt.Sub(now) + s.admissionTTL
+	held, err := s.redisRepo.JoinQueue(ctx, sale.ID, sale.StartsAt, sale.AdmissionRate, userID, ticket, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return s.queueTicket(ctx, sale, held)
+}
+
+// GetQueueTicket returns the position and estimated wait of a ticket in the waiting room of a sale,
+// and its admission token once its turn has come.
+func (s *FlashSaleService) GetQueueTicket(ctx context.Context, saleID int64, ticket string) (*domain.QueueTicket, error) {
+	sale, err := s.getWaitingRoomSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	return s.queueTicket(ctx, sale, ticket)
+}
+
+func (s *FlashSaleService) queueTicket(ctx context.Context, sale *domain.Sale, ticket string) (*domain.QueueTicket, error) {
+	token, err := generateUniqueCode()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate admission token: %w", err)
+	}
+	status, err := s.redisRepo.QueueStatus(ctx, sale.ID, sale.StartsAt, sale.AdmissionRate, ticket, token, s.admissionTTL)
+	if err != nil {
+		return nil, err
+	}
+	if status.Status == domain.TicketWaiting {
+		rate := int64(sale.AdmissionRate)
+		status.EstimatedWaitSeconds = (status.Position + rate - 1) / rate
+		if untilStart := time.Until(sale.StartsAt); untilStart > 0 {
+			status.EstimatedWaitSeconds += int64(untilStart.Seconds())
+		}
+	}
+	return status, nil
+}
+
+func (s *FlashSaleService) getWaitingRoomSale(ctx context.Context, saleID int64) (*domain.Sale, error) {
+	sale, err := s.getCurrentSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	if sale.AdmissionRate == 0 {
+		return nil, domain.ErrNoWaitingRoom
+	}
+	return sale, nil
+}
+
+// checkAdmission lets a checkout of a sale with a waiting room through only with an admission
+// token issued to the user who checks out. A token can be used for several checkouts until it expires.
+func (s *FlashSaleService) checkAdmission(ctx context.Context, sale *domain.Sale, userID, token string) error {
+	if sale.AdmissionRate == 0 {
+		return nil
+	}
+	if token == "" {
+		return domain.ErrAdmissionRequired
+	}
+	admitted, err := s.redisRepo.CheckAdmission(ctx, sale.ID, token, userID)
+	if err != nil {
+		return err
+	}
+	if !admitted {
+		return domain.ErrAdmissionRequired
+	}
+	return nil
+}
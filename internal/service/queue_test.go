@@ -0,0 +1,201 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"flash/internal/auth"
+	"flash/internal/domain"
+	redisrepo "flash/internal/repository/redis"
+	"flash/internal/service"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+const testAdmissionTTL = time.Minute
+
+// checkoutRepo is the Postgres side of a checkout: a single sale with a single item, and its waitlist.
+type checkoutRepo struct {
+	service.PostgresRepository
+	sale     *domain.Sale
+	item     *domain.CatalogItem
+	waitlist []*domain.WaitlistEntry
+}
+
+func (r *checkoutRepo) GetSale(ctx context.Context, id int64) (*domain.Sale, error) {
+	sale := *r.sale
+	return &sale, nil
+}
+
+func (r *checkoutRepo) ListCatalogItems(ctx context.Context, saleID int64) ([]*domain.CatalogItem, error) {
+	return []*domain.CatalogItem{r.item}, nil
+}
+
+func (r *checkoutRepo) SaveCheckoutAttempt(ctx context.Context, saleID int64, userID string, lines []domain.OrderLine, code string) error {
+	return nil
+}
+
+// newCheckoutService returns a service backed by miniredis and a checkoutRepo for an open sale
+// admitting admissionRate users per second, whose only item has stock units.
+func newCheckoutService(t *testing.T, admissionRate, stock int) (*service.FlashSaleService, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	redisRepo := redisrepo.NewRedisRepository(client, time.Minute)
+
+	now := time.Now()
+	pgRepo := &checkoutRepo{
+		sale: &domain.Sale{
+			ID:                        1,
+			StartsAt:                  now.Add(-time.Hour),
+			EndsAt:                    now.Add(time.Hour),
+			ItemQuota:                 100,
+			PerUserLimit:              5,
+			MaxConcurrentReservations: 5,
+			Status:                    domain.SaleOpen,
+			AdmissionRate:             admissionRate,
+		},
+		item: &domain.CatalogItem{SaleID: 1, SKU: "sneaker-42", Stock: stock, Price: 1000, Currency: "EUR"},
+	}
+	svc := service.NewFlashSaleService(pgRepo, redisRepo, service.Options{
+		NodeID:       "test",
+		AdmissionTTL: testAdmissionTTL,
+	})
+	return svc, server
+}
+
+// checkout reserves one unit of the item for userID with an admission token.
+func checkout(svc *service.FlashSaleService, userID, token string) error {
+	ctx := auth.WithUser(context.Background(), userID)
+	_, err := svc.CreateReservation(ctx, 1, token, []domain.OrderLine{{ItemID: "sneaker-42", Quantity: 1}})
+	return err
+}
+
+// advanceWaitingRoom makes the waiting room of the test sale act as if d had passed since its
+// admission mark last moved.
+func advanceWaitingRoom(t *testing.T, server *miniredis.Miniredis, d time.Duration) {
+	t.Helper()
+	at := time.Now().Add(-d).UnixMilli()
+	if err := server.Set(testPrefix+"queue:admitted_at", strconv.FormatInt(at, 10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWaitingRoomAdmissionRate checks that tickets are admitted in order at the sale's rate, and
+// that only admitted users can check out.
+func TestWaitingRoomAdmissionRate(t *testing.T) {
+	const rate = 2
+	ctx := context.Background()
+	svc, server := newCheckoutService(t, rate, 10)
+
+	users := []string{"alice", "bob", "carol", "dave", "erin"}
+	tickets := make([]*domain.QueueTicket, len(users))
+	for i, user := range users {
+		ticket, err := svc.JoinQueue(ctx, 1, user)
+		if err != nil {
+			t.Fatalf("JoinQueue(%s) error = %v", user, err)
+		}
+		if ticket.Status != domain.TicketWaiting || ticket.Position != int64(i+1) {
+			t.Fatalf("ticket of %s is %s at position %d, want waiting at %d", user, ticket.Status, ticket.Position, i+1)
+		}
+		if want := int64((i + rate) / rate); ticket.EstimatedWaitSeconds != want {
+			t.Errorf("ticket of %s waits %ds, want %ds", user, ticket.EstimatedWaitSeconds, want)
+		}
+		tickets[i] = ticket
+	}
+	if err := checkout(svc, "alice", ""); !errors.Is(err, domain.ErrAdmissionRequired) {
+		t.Fatalf("checkout before admission error = %v, want %v", err, domain.ErrAdmissionRequired)
+	}
+
+	// One second admits as many tickets as the rate, however long the queue
+	advanceWaitingRoom(t, server, time.Second)
+	for i, user := range users {
+		ticket, err := svc.GetQueueTicket(ctx, 1, tickets[i].Ticket)
+		if err != nil {
+			t.Fatalf("GetQueueTicket(%s) error = %v", user, err)
+		}
+		if i < rate {
+			if ticket.Status != domain.TicketAdmitted || ticket.AdmissionToken == "" {
+				t.Fatalf("ticket of %s is %s, want admitted with a token", user, ticket.Status)
+			}
+			if err := checkout(svc, user, ticket.AdmissionToken); err != nil {
+				t.Errorf("checkout of admitted %s error = %v", user, err)
+			}
+			continue
+		}
+		if ticket.Status != domain.TicketWaiting || ticket.Position != int64(i+1-rate) {
+			t.Errorf("ticket of %s is %s at position %d, want waiting at %d", user, ticket.Status, ticket.Position, i+1-rate)
+		}
+	}
+	if got, _ := server.Get(testPrefix + "queue:admitted"); got != strconv.Itoa(rate) {
+		t.Errorf("%s tickets admitted, want %d", got, rate)
+	}
+}
+
+// TestWaitingRoomTokenReuse checks that an admission token is issued once per ticket, lets only
+// its user check out, and is replaced by a new ticket once it expires.
+func TestWaitingRoomTokenReuse(t *testing.T) {
+	ctx := context.Background()
+	svc, server := newCheckoutService(t, 1, 10)
+
+	joined, err := svc.JoinQueue(ctx, 1, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	advanceWaitingRoom(t, server, time.Second)
+	admitted, err := svc.GetQueueTicket(ctx, 1, joined.Ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admitted.Status != domain.TicketAdmitted {
+		t.Fatalf("ticket is %s, want admitted", admitted.Status)
+	}
+
+	polled, err := svc.GetQueueTicket(ctx, 1, joined.Ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polled.AdmissionToken != admitted.AdmissionToken {
+		t.Errorf("polling again issued token %s, want %s", polled.AdmissionToken, admitted.AdmissionToken)
+	}
+	rejoined, err := svc.JoinQueue(ctx, 1, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejoined.Ticket != joined.Ticket || rejoined.AdmissionToken != admitted.AdmissionToken {
+		t.Errorf("joining again while admitted returned ticket %s, want %s", rejoined.Ticket, joined.Ticket)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := checkout(svc, testUserID, admitted.AdmissionToken); err != nil {
+			t.Fatalf("checkout %d with the token error = %v", i+1, err)
+		}
+	}
+	if err := checkout(svc, "mallory", admitted.AdmissionToken); !errors.Is(err, domain.ErrAdmissionRequired) {
+		t.Errorf("checkout with another user's token error = %v, want %v", err, domain.ErrAdmissionRequired)
+	}
+
+	server.FastForward(testAdmissionTTL)
+	expired, err := svc.GetQueueTicket(ctx, 1, joined.Ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Status != domain.TicketExpired {
+		t.Errorf("ticket is %s after its admission ran out, want expired", expired.Status)
+	}
+	if err := checkout(svc, testUserID, admitted.AdmissionToken); !errors.Is(err, domain.ErrAdmissionRequired) {
+		t.Errorf("checkout with an expired token error = %v, want %v", err, domain.ErrAdmissionRequired)
+	}
+	next, err := svc.JoinQueue(ctx, 1, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Ticket == joined.Ticket || next.Status != domain.TicketWaiting {
+		t.Errorf("joining after the admission expired returned %s ticket %s, want a new waiting one", next.Status, next.Ticket)
+	}
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"flash/internal/domain"
+)
+
+// CheckRateLimit counts a request to a route against the rate limit of every client it comes from,
+// such as its user, address and API key, and returns the most restrictive decision. The request is
+// allowed only if every client is within the limit. It returns nil when the route is not limited.
+//
+// Rate limiting fails open: when Redis cannot be reached the request is let through and only the
+// global throttle in front of the handlers applies.
+func (s *FlashSaleService) CheckRateLimit(ctx context.Context, route string, clients []string) *domain.RateLimitDecision {
+	limit, ok := s.rateLimits[route]
+	if !ok {
+		if limit, ok = s.rateLimits[domain.DefaultRateLimitRoute]; !ok {
+			return nil
+		}
+	}
+
+	var decision *domain.RateLimitDecision
+	for _, client := range clients {
+		counted, err := s.redisRepo.CountRequest(ctx, route, client, limit)
+		if err != nil {
+			log.Printf("Rate limit check of %s on %s failed, letting the request through: %v", client, route, err)
+			continue
+		}
+		decision = decision.Tighter(counted)
+		// The other clients keep their budget for requests that are let in
+		if !decision.Allowed {
+			break
+		}
+	}
+	return decision
+}
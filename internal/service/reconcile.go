@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// ReconcileRedis compares the Redis state of every active sale with the state derived from
+// Postgres and, unless dryRun is set, rewrites Redis to match. It returns the drift of every
+// sale that had any.
+func (s *FlashSaleService) ReconcileRedis(ctx context.Context, dryRun bool) ([]*domain.SaleDrift, error) {
+	sales, err := s.pgRepo.ListActiveSales(ctx, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("listing active sales failed: %w", err)
+	}
+
+	var drifts []*domain.SaleDrift
+	for _, sale := range sales {
+		drift, err := s.reconcileSale(ctx, sale.ID, dryRun)
+		if err != nil {
+			return drifts, fmt.Errorf("reconciling sale %d failed: %w", sale.ID, err)
+		}
+		if drift.Count() > 0 {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+func (s *FlashSaleService) reconcileSale(ctx context.Context, saleID int64, dryRun bool) (*domain.SaleDrift, error) {
+	expected, err := s.pgRepo.LoadSaleState(ctx, saleID, s.reservationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := s.redisRepo.LoadSaleState(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := diffSaleState(expected, actual)
+	if dryRun || drift.Count() == 0 {
+		return drift, nil
+	}
+	if _, err := s.redisRepo.RepairSaleState(ctx, drift); err != nil {
+		return nil, err
+	}
+	return drift, nil
+}
+
+// RestoreRedisIfEmpty rebuilds Redis from Postgres when Redis lost its data, e.g. after a
+// flush or a restart without persistence. It is meant to run at startup before serving traffic.
+func (s *FlashSaleService) RestoreRedisIfEmpty(ctx context.Context) error {
+	initialized, err := s.redisRepo.IsInitialized(ctx)
+	if err != nil {
+		return err
+	}
+	if initialized {
+		return nil
+	}
+
+	log.Println("Redis holds no state, rebuilding it from Postgres...")
+	drifts, err := s.ReconcileRedis(ctx, false)
+	if err != nil {
+		return err
+	}
+	for _, drift := range drifts {
+		log.Printf("Sale %d: restored %d differences in Redis", drift.SaleID, drift.Count())
+	}
+	return s.redisRepo.MarkInitialized(ctx)
+}
+
+// diffSaleState lists what has to change in actual to match expected.
+// Reservations that only exist in actual are not drift: they may simply not be persisted yet.
+// Nor is a missing stock counter of an untouched item: the first reservation initializes it from the catalog.
+func diffSaleState(expected, actual *domain.SaleState) *domain.SaleDrift {
+	drift := &domain.SaleDrift{
+		SaleID:        expected.SaleID,
+		SoldItems:     make(map[string]domain.CountMismatch),
+		Stock:         make(map[string]domain.CountMismatch),
+		UserPurchases: make(map[string]domain.CountMismatch),
+	}
+
+	for sku, count := range expected.SoldItems {
+		if actual.SoldItems[sku] != count {
+			drift.SoldItems[sku] = domain.CountMismatch{Expected: count, Actual: actual.SoldItems[sku]}
+		}
+	}
+	for sku, count := range actual.SoldItems {
+		if _, ok := expected.SoldItems[sku]; !ok && count != 0 {
+			drift.SoldItems[sku] = domain.CountMismatch{Expected: 0, Actual: count}
+		}
+	}
+
+	reserved := make(map[string]bool)
+	for _, res := range expected.Reservations {
+		for _, line := range res.Lines {
+			reserved[line.ItemID] = true
+		}
+	}
+	for sku, stock := range expected.Stock {
+		current, ok := actual.Stock[sku]
+		if !ok && expected.SoldItems[sku] == 0 && !reserved[sku] {
+			continue
+		}
+		if current != stock {
+			drift.Stock[sku] = domain.CountMismatch{Expected: stock, Actual: current}
+		}
+	}
+
+	if expected.SoldCount != actual.SoldCount {
+		drift.SoldCount = &domain.CountMismatch{Expected: expected.SoldCount, Actual: actual.SoldCount}
+	}
+
+	for userID, count := range expected.UserPurchases {
+		if actual.UserPurchases[userID] != count {
+			drift.UserPurchases[userID] = domain.CountMismatch{Expected: count, Actual: actual.UserPurchases[userID]}
+		}
+	}
+	for userID, count := range actual.UserPurchases {
+		if _, ok := expected.UserPurchases[userID]; !ok && count != 0 {
+			drift.UserPurchases[userID] = domain.CountMismatch{Expected: 0, Actual: count}
+		}
+	}
+
+	for code, res := range expected.Reservations {
+		if _, ok := actual.Reservations[code]; !ok {
+			drift.MissingReservations = append(drift.MissingReservations, res)
+		}
+	}
+	sort.Slice(drift.MissingReservations, func(i, j int) bool {
+		return drift.MissingReservations[i].Code < drift.MissingReservations[j].Code
+	})
+
+	drift.PendingOutboxEvents = expected.PendingOutboxEvents
+	return drift
+}
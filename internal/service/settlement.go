@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"flash/internal/domain"
+)
+
+// SettlementPolicy decides what happens to the pending purchases of a sale when it is finalized.
+// Policies are looked up by the name stored on the sale; custom ones can be plugged in through
+// Options.SettlementPolicies.
+type SettlementPolicy interface {
+	// Validate checks the policy's settings on a sale before the sale is saved.
+	Validate(sale *domain.Sale) error
+	// Settle returns the outcome for a sale that ended with the given number of units in pending purchases.
+	Settle(sale *domain.Sale, pendingUnits int) domain.SettlementOutcome
+}
+
+// allOrNothingPolicy confirms a sale that sold exactly its quota and rejects anything else.
+type allOrNothingPolicy struct {
+	rejected domain.SettlementOutcome
+}
+
+func (allOrNothingPolicy) Validate(*domain.Sale) error {
+	return nil
+}
+
+func (p allOrNothingPolicy) Settle(sale *domain.Sale, pendingUnits int) domain.SettlementOutcome {
+	if pendingUnits == sale.ItemQuota {
+		return domain.SettlementConfirmed
+	}
+	return p.rejected
+}
+
+// confirmSoldPolicy confirms whatever was sold.
+type confirmSoldPolicy struct{}
+
+func (confirmSoldPolicy) Validate(*domain.Sale) error {
+	return nil
+}
+
+func (confirmSoldPolicy) Settle(*domain.Sale, int) domain.SettlementOutcome {
+	return domain.SettlementConfirmed
+}
+
+// thresholdPolicy confirms a sale that sold at least its settlement threshold and cancels the rest.
+type thresholdPolicy struct{}
+
+func (thresholdPolicy) Validate(sale *domain.Sale) error {
+	if sale.SettlementThreshold <= 0 || sale.SettlementThreshold > sale.ItemQuota {
+		return fmt.Errorf("%w: settlement threshold must be between 1 and the item quota", domain.ErrInvalidSale)
+	}
+	return nil
+}
+
+func (thresholdPolicy) Settle(sale *domain.Sale, pendingUnits int) domain.SettlementOutcome {
+	if pendingUnits >= sale.SettlementThreshold {
+		return domain.SettlementConfirmed
+	}
+	return domain.SettlementCancelled
+}
+
+func defaultSettlementPolicies() map[domain.SettlementPolicy]SettlementPolicy {
+	return map[domain.SettlementPolicy]SettlementPolicy{
+		domain.SettlementAllOrNothing:       allOrNothingPolicy{rejected: domain.SettlementDeleted},
+		domain.SettlementAllOrNothingCancel: allOrNothingPolicy{rejected: domain.SettlementCancelled},
+		domain.SettlementConfirmSold:        confirmSoldPolicy{},
+		domain.SettlementThreshold:          thresholdPolicy{},
+	}
+}
+
+// settlementPolicy returns the policy registered under the given name.
+func (s *FlashSaleService) settlementPolicy(name domain.SettlementPolicy) (SettlementPolicy, error) {
+	policy, ok := s.settlementPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown settlement policy %q", domain.ErrInvalidSale, name)
+	}
+	return policy, nil
+}
+
+// validateSale applies the defaults to a sale and checks it, including its settlement policy.
+func (s *FlashSaleService) validateSale(sale *domain.Sale) error {
+	sale.ApplyDefaults(s.saleDefaults)
+	if err := sale.Validate(); err != nil {
+		return err
+	}
+	policy, err := s.settlementPolicy(sale.SettlementPolicy)
+	if err != nil {
+		return err
+	}
+	return policy.Validate(sale)
+}
+
+// GetSettlement returns how a finalized sale was settled.
+func (s *FlashSaleService) GetSettlement(ctx context.Context, saleID int64) (*domain.Settlement, error) {
+	return s.pgRepo.GetSettlement(ctx, saleID)
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"flash/internal/domain"
+)
+
+func TestSettlementPolicies(t *testing.T) {
+	tests := []struct {
+		policy       domain.SettlementPolicy
+		threshold    int
+		pendingUnits int
+		want         domain.SettlementOutcome
+	}{
+		{policy: domain.SettlementAllOrNothing, pendingUnits: 10, want: domain.SettlementConfirmed},
+		{policy: domain.SettlementAllOrNothing, pendingUnits: 9, want: domain.SettlementDeleted},
+		{policy: domain.SettlementAllOrNothing, pendingUnits: 0, want: domain.SettlementDeleted},
+		{policy: domain.SettlementAllOrNothingCancel, pendingUnits: 10, want: domain.SettlementConfirmed},
+		{policy: domain.SettlementAllOrNothingCancel, pendingUnits: 9, want: domain.SettlementCancelled},
+		{policy: domain.SettlementConfirmSold, pendingUnits: 0, want: domain.SettlementConfirmed},
+		{policy: domain.SettlementConfirmSold, pendingUnits: 3, want: domain.SettlementConfirmed},
+		{policy: domain.SettlementThreshold, threshold: 5, pendingUnits: 5, want: domain.SettlementConfirmed},
+		{policy: domain.SettlementThreshold, threshold: 5, pendingUnits: 10, want: domain.SettlementConfirmed},
+		{policy: domain.SettlementThreshold, threshold: 5, pendingUnits: 4, want: domain.SettlementCancelled},
+	}
+
+	policies := defaultSettlementPolicies()
+	for _, tt := range tests {
+		sale := &domain.Sale{ItemQuota: 10, SettlementPolicy: tt.policy, SettlementThreshold: tt.threshold}
+		if got := policies[tt.policy].Settle(sale, tt.pendingUnits); got != tt.want {
+			t.Errorf("%s with threshold %d settled %d units as %s, want %s", tt.policy, tt.threshold, tt.pendingUnits, got, tt.want)
+		}
+	}
+}
+
+func TestThresholdPolicyValidate(t *testing.T) {
+	tests := []struct {
+		threshold int
+		wantErr   bool
+	}{
+		{threshold: 1},
+		{threshold: 10},
+		{threshold: 0, wantErr: true},
+		{threshold: 11, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		sale := &domain.Sale{ItemQuota: 10, SettlementPolicy: domain.SettlementThreshold, SettlementThreshold: tt.threshold}
+		err := thresholdPolicy{}.Validate(sale)
+		if tt.wantErr != (err != nil) || (err != nil && !errors.Is(err, domain.ErrInvalidSale)) {
+			t.Errorf("Validate() with threshold %d error = %v, want error %v", tt.threshold, err, tt.wantErr)
+		}
+	}
+}
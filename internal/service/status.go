@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"flash/internal/domain"
+)
+
+// statusFlushInterval is how often local counter increments are pushed to Redis and the
+// cluster-wide totals are read back.
+const statusFlushInterval = 500 * time.Millisecond
+
+// Counter indexes; counterFields holds the Redis hash field each one is stored under.
+const (
+	successfulCheckouts = iota
+	failedCheckouts
+	successfulPurchases
+	failedPurchases
+	scheduledGoods
+	purchasedGoods
+	inconsistencies
+	repairs
+	cancelledOrders
+	numCounters
+)
+
+var counterFields = [numCounters]string{
+	successfulCheckouts: "successful_checkouts",
+	failedCheckouts:     "failed_checkouts",
+	successfulPurchases: "successful_purchases",
+	failedPurchases:     "failed_purchases",
+	scheduledGoods:      "scheduled_goods",
+	purchasedGoods:      "purchased_goods",
+	inconsistencies:     "inconsistencies_detected",
+	repairs:             "inconsistencies_repaired",
+	cancelledOrders:     "cancelled_orders",
+}
+
+// Status management struct
+//
+// Counters are shared by all replicas through Redis. Increments are batched locally in
+// pending and flushed periodically; cluster holds the totals last read back from Redis.
+// Getters return the cluster total plus this replica's unflushed increments.
+type Status struct {
+	pending             [numCounters]uint64
+	cluster             [numCounters]uint64
+	expiredReservations uint64
+}
+
+func NewStatus() *Status {
+	return &Status{}
+}
+
+func (s *Status) add(counter int, n uint64) { atomic.AddUint64(&s.pending[counter], n) }
+func (s *Status) get(counter int) uint64 {
+	return atomic.LoadUint64(&s.cluster[counter]) + atomic.LoadUint64(&s.pending[counter])
+}
+
+// ... Atomic getter and incrementer methods for Status ...
+func (s *Status) IncrementSuccessfulCheckouts() { s.add(successfulCheckouts, 1) }
+func (s *Status) IncrementFailedCheckouts()     { s.add(failedCheckouts, 1) }
+func (s *Status) IncrementSuccessfulPurchases() { s.add(successfulPurchases, 1) }
+func (s *Status) IncrementFailedPurchases()     { s.add(failedPurchases, 1) }
+func (s *Status) AddScheduledGoods(n uint64)    { s.add(scheduledGoods, n) }
+func (s *Status) AddPurchasedGoods(n uint64)    { s.add(purchasedGoods, n) }
+
+func (s *Status) GetSuccessfulCheckouts() uint64 { return s.get(successfulCheckouts) }
+func (s *Status) GetFailedCheckouts() uint64     { return s.get(failedCheckouts) }
+func (s *Status) GetSuccessfulPurchases() uint64 { return s.get(successfulPurchases) }
+func (s *Status) GetFailedPurchases() uint64     { return s.get(failedPurchases) }
+func (s *Status) GetScheduledGoods() uint64      { return s.get(scheduledGoods) }
+func (s *Status) GetPurchasedGoods() uint64      { return s.get(purchasedGoods) }
+
+func (s *Status) AddInconsistenciesDetected(n uint64) { s.add(inconsistencies, n) }
+func (s *Status) AddInconsistenciesRepaired(n uint64) { s.add(repairs, n) }
+func (s *Status) GetInconsistenciesDetected() uint64  { return s.get(inconsistencies) }
+func (s *Status) GetInconsistenciesRepaired() uint64  { return s.get(repairs) }
+
+func (s *Status) IncrementCancelledOrders()  { s.add(cancelledOrders, 1) }
+func (s *Status) GetCancelledOrders() uint64 { return s.get(cancelledOrders) }
+
+// Expired reservations are counted in Redis, so the local value is overwritten rather than incremented.
+func (s *Status) SetExpiredReservations(val uint64) { atomic.StoreUint64(&s.expiredReservations, val) }
+func (s *Status) GetExpiredReservations() uint64    { return atomic.LoadUint64(&s.expiredReservations) }
+
+// takePending moves the unflushed increments out of the status for flushing.
+func (s *Status) takePending() map[string]int64 {
+	deltas := make(map[string]int64)
+	for i := 0; i < numCounters; i++ {
+		if n := atomic.SwapUint64(&s.pending[i], 0); n > 0 {
+			deltas[counterFields[i]] = int64(n)
+		}
+	}
+	return deltas
+}
+
+// restorePending puts back increments whose flush failed so the next flush retries them.
+func (s *Status) restorePending(deltas map[string]int64) {
+	for i := 0; i < numCounters; i++ {
+		if n := deltas[counterFields[i]]; n > 0 {
+			s.add(i, uint64(n))
+		}
+	}
+}
+
+// setClusterTotals stores the totals read back from Redis.
+func (s *Status) setClusterTotals(totals map[string]int64) {
+	for i := 0; i < numCounters; i++ {
+		atomic.StoreUint64(&s.cluster[i], uint64(totals[counterFields[i]]))
+	}
+}
+
+// RunStatusFlusher periodically pushes local counter increments to Redis and refreshes
+// the cluster-wide totals, so every replica reports the same numbers.
+func (s *FlashSaleService) RunStatusFlusher(ctx context.Context) {
+	ticker := time.NewTicker(statusFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flushStatuses(ctx)
+		case <-ctx.Done():
+			// Push what is left so a restart loses no counts
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.flushStatuses(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *FlashSaleService) flushStatuses(ctx context.Context) {
+	s.statusMu.Lock()
+	statuses := make(map[int64]*Status, len(s.statuses))
+	for saleID, status := range s.statuses {
+		statuses[saleID] = status
+	}
+	s.statusMu.Unlock()
+
+	for saleID, status := range statuses {
+		s.flushStatus(ctx, saleID, status)
+	}
+}
+
+func (s *FlashSaleService) flushStatus(ctx context.Context, saleID int64, status *Status) {
+	deltas := status.takePending()
+	totals, err := s.redisRepo.FlushStatusCounters(ctx, saleID, deltas)
+	if err != nil {
+		status.restorePending(deltas)
+		log.Printf("Flushing status counters of sale %d failed: %v", saleID, err)
+		return
+	}
+	status.setClusterTotals(totals)
+}
+
+// dropStatus stops keeping the counters of a sale, after pushing the increments not flushed yet.
+// Their totals stay in Redis for /status.
+func (s *FlashSaleService) dropStatus(ctx context.Context, saleID int64) {
+	s.statusMu.Lock()
+	status, ok := s.statuses[saleID]
+	delete(s.statuses, saleID)
+	s.statusMu.Unlock()
+
+	if ok {
+		s.flushStatus(ctx, saleID, status)
+	}
+}
+
+// SaleStatus returns the counters of a sale for reporting. Those of a sale this replica keeps no
+// counters for, e.g. one that is over, are read from Redis.
+func (s *FlashSaleService) SaleStatus(ctx context.Context, sale *domain.Sale) *Status {
+	s.statusMu.Lock()
+	status, ok := s.statuses[sale.ID]
+	s.statusMu.Unlock()
+	if ok {
+		return status
+	}
+
+	status = NewStatus()
+	s.flushStatus(ctx, sale.ID, status)
+	return status
+}
+
+// countCancelledOrder counts a cancelled order of a sale. Cancellations after the sale is over,
+// when this replica keeps no counters for it, go to Redis right away.
+func (s *FlashSaleService) countCancelledOrder(ctx context.Context, saleID int64) {
+	s.statusMu.Lock()
+	status, ok := s.statuses[saleID]
+	s.statusMu.Unlock()
+	if !ok {
+		status = NewStatus()
+	}
+
+	status.IncrementCancelledOrders()
+	if !ok {
+		s.flushStatus(ctx, saleID, status)
+	}
+}
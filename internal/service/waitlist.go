@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"flash/internal/domain"
+)
+
+const (
+	// waitlistPollInterval is how often units that came free are handed to waitlisted users.
+	waitlistPollInterval = 2 * time.Second
+	// waitlistBatchSize bounds how many entries of an item a single pass serves.
+	waitlistBatchSize = 100
+	// waitlistLeaseName is the lease that makes a single replica serve waitlists at a time.
+	waitlistLeaseName = "waitlist"
+)
+
+// JoinWaitlist puts a user on the waitlist of an item whose units are all reserved or sold.
+// It is open while the sale takes checkouts or is sold out, with the same admission as a checkout,
+// and only for items a checkout of the quantity would fail for; joining one that is still available
+// returns domain.ErrItemAvailable, so nobody can hold back units that could be bought.
+// From then on the item is kept for its waitlist: units that come free, because a reservation
+// expired or an order was cancelled, are reserved for the users waiting for it in the order
+// they joined.
+func (s *FlashSaleService) JoinWaitlist(ctx context.Context, saleID int64, userID, admissionToken, itemID string,
+	quantity int) (*domain.WaitlistEntry, error) {
+	lines := []domain.OrderLine{{ItemID: itemID, Quantity: quantity}}
+	if err := domain.ValidateLines(lines); err != nil {
+		return nil, err
+	}
+	sale, err := s.getCurrentSale(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	soldOut := false
+	if err := sale.CheckCheckout(time.Now()); errors.Is(err, domain.ErrSaleSoldOut) {
+		soldOut = true
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.checkAdmission(ctx, sale, userID, admissionToken); err != nil {
+		return nil, err
+	}
+	catalog, err := s.getCatalog(ctx, sale.ID)
+	if err != nil {
+		return nil, err
+	}
+	item, ok := catalog[itemID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", domain.ErrUnknownItem, itemID)
+	}
+	if quantity > sale.PerUserLimit {
+		return nil, domain.PurchaseLimitError(sale.PerUserLimit)
+	}
+	if !soldOut {
+		available, err := s.redisRepo.ItemAvailable(ctx, sale.ID, sale.Limits(), item, quantity)
+		if err != nil {
+			return nil, err
+		}
+		if available {
+			return nil, domain.ErrItemAvailable
+		}
+	}
+
+	entry, err := s.pgRepo.JoinWaitlist(ctx, sale.ID, itemID, userID, quantity)
+	if err != nil {
+		return nil, err
+	}
+	// Hold the item back from checkouts right away; the waitlist server corrects the count
+	if err := s.redisRepo.SetWaitlisted(ctx, sale.ID, map[string]int{itemID: entry.Position}); err != nil {
+		log.Printf("Holding back item %s of sale %d for its waitlist failed: %v", itemID, sale.ID, err)
+	}
+	return entry, nil
+}
+
+// LeaveWaitlist takes a user off the waitlist of an item. An item nobody waits for any more is
+// released to every checkout right away; the waitlist server corrects the count if this fails.
+func (s *FlashSaleService) LeaveWaitlist(ctx context.Context, saleID int64, userID, itemID string) error {
+	if err := s.pgRepo.LeaveWaitlist(ctx, saleID, itemID, userID); err != nil {
+		return err
+	}
+	if err := s.refreshWaitlisted(ctx, saleID); err != nil {
+		log.Printf("Updating the waitlist of item %s of sale %d failed: %v", itemID, saleID, err)
+	}
+	return nil
+}
+
+// ListWaitlistEntries returns the waitlist entries of a user, with the reservation code of those served.
+func (s *FlashSaleService) ListWaitlistEntries(ctx context.Context, saleID int64, userID string) ([]*domain.WaitlistEntry, error) {
+	return s.pgRepo.ListUserWaitlistEntries(ctx, saleID, userID)
+}
+
+// RunWaitlistServer reserves units that came free for the users waiting for them and notifies
+// those users. Every replica runs it; a lease makes sure only one of them serves waitlists at a time.
+func (s *FlashSaleService) RunWaitlistServer(ctx context.Context) {
+	log.Println("Starting waitlist server...")
+	ticker := time.NewTicker(waitlistPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.serveWaitlistsWithLease(ctx); err != nil {
+				log.Printf("Waitlist error: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("Stopping waitlist server.")
+			return
+		}
+	}
+}
+
+func (s *FlashSaleService) serveWaitlistsWithLease(ctx context.Context) error {
+	token, acquired, err := s.redisRepo.AcquireLease(ctx, waitlistLeaseName, s.nodeID, 0, s.leaseTTL)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.keepLease(leaseCtx, cancel, waitlistLeaseName, token)
+
+	sales, err := s.pgRepo.ListActiveSales(leaseCtx, time.Now())
+	if err != nil {
+		log.Printf("Listing active sales for waitlists failed: %v", err)
+	}
+	for _, sale := range sales {
+		// Sold out and paused sales have nothing to hand out; cancellations reopen sold out ones.
+		// Their waitlists are still recounted, so items nobody waits for any more are released.
+		if sale.Status != domain.SaleOpen {
+			if err := s.refreshWaitlisted(leaseCtx, sale.ID); err != nil {
+				log.Printf("Recounting waitlists of sale %d failed, retrying on the next poll: %v", sale.ID, err)
+			}
+			continue
+		}
+		if err := s.serveWaitlist(leaseCtx, sale); err != nil {
+			log.Printf("Serving waitlists of sale %d failed, retrying on the next poll: %v", sale.ID, err)
+		}
+	}
+	s.notifyWaitlistEntries(leaseCtx)
+
+	if err := s.redisRepo.ReleaseLease(ctx, waitlistLeaseName, s.nodeID, token); err != nil {
+		log.Printf("Waitlist lease release error: %v", err)
+	}
+	return nil
+}
+
+// refreshWaitlisted records how many users wait for every waitlisted item of a sale, releasing
+// the items nobody waits for any more to every checkout.
+func (s *FlashSaleService) refreshWaitlisted(ctx context.Context, saleID int64) error {
+	waiting, err := s.pgRepo.CountWaitlisted(ctx, saleID)
+	if err != nil {
+		return err
+	}
+	return s.redisRepo.SetWaitlisted(ctx, saleID, waiting)
+}
+
+// serveWaitlist hands the free units of every waitlisted item of a sale to its waitlist, then
+// releases the items nobody waits for any more to every checkout.
+func (s *FlashSaleService) serveWaitlist(ctx context.Context, sale *domain.Sale) error {
+	waiting, err := s.pgRepo.CountWaitlisted(ctx, sale.ID)
+	if err != nil || len(waiting) == 0 {
+		return err
+	}
+	// Expired reservations give their units back right away instead of on the next reap
+	if _, total, err := s.redisRepo.ReapExpiredReservations(ctx, sale.ID); err == nil {
+		s.statusOf(sale).SetExpiredReservations(uint64(total))
+	}
+	catalog, err := s.getCatalog(ctx, sale.ID)
+	if err != nil {
+		return err
+	}
+
+	for itemID, count := range waiting {
+		if count == 0 {
+			continue
+		}
+		served, err := s.serveItemWaitlist(ctx, sale, catalog, itemID)
+		waiting[itemID] = count - served
+		if err != nil {
+			log.Printf("Serving waitlist of item %s of sale %d failed: %v", itemID, sale.ID, err)
+		}
+	}
+	return s.redisRepo.SetWaitlisted(ctx, sale.ID, waiting)
+}
+
+// serveItemWaitlist reserves units of an item for its waiting entries in turn until the units run
+// out, and returns how many entries left the waitlist. Entries that cannot be served any more,
+// because their user reached the purchase limit meanwhile, are dropped.
+func (s *FlashSaleService) serveItemWaitlist(ctx context.Context, sale *domain.Sale, catalog map[string]*domain.CatalogItem,
+	itemID string) (int, error) {
+	entries, err := s.pgRepo.ListWaitlist(ctx, sale.ID, itemID, waitlistBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	item, ok := catalog[itemID]
+	served := 0
+	for _, entry := range entries {
+		if !ok {
+			entry.Status = domain.WaitlistDropped
+			if _, err := s.pgRepo.UpdateWaitlistEntry(ctx, entry); err != nil {
+				return served, err
+			}
+			served++
+			continue
+		}
+		lines := []domain.OrderLine{{ItemID: itemID, Quantity: entry.Quantity, UnitPrice: item.Price, Currency: item.Currency}}
+		code, err := generateUniqueCode()
+		if err != nil {
+			return served, fmt.Errorf("could not generate code: %w", err)
+		}
+
+		err = s.redisRepo.CreateWaitlistReservation(ctx, sale.ID, sale.Limits(), entry.UserID, lines, catalog, code)
+		switch {
+		case err == nil:
+			if err := s.pgRepo.SaveCheckoutAttempt(ctx, sale.ID, entry.UserID, lines, code); err != nil {
+				_ = s.redisRepo.DeleteReservation(ctx, sale.ID, entry.UserID, code)
+				return served, fmt.Errorf("failed to save checkout attempt: %w", err)
+			}
+			entry.Status, entry.Code = domain.WaitlistReserved, code
+		case errors.Is(err, domain.ErrOutOfStock), errors.Is(err, domain.ErrSaleSoldOut):
+			return served, nil
+		case errors.Is(err, domain.ErrConcurrentReservationExceeded):
+			// The user holds enough reservations for now; they keep their place for the next units
+			continue
+		case errors.Is(err, domain.ErrPurchaseLimitExceeded):
+			entry.Status = domain.WaitlistDropped
+		default:
+			return served, err
+		}
+
+		updated, err := s.pgRepo.UpdateWaitlistEntry(ctx, entry)
+		if err != nil {
+			return served, err
+		}
+		if !updated && entry.Code != "" {
+			// The user left the waitlist meanwhile; the units go to the next one
+			_ = s.redisRepo.DeleteReservation(ctx, sale.ID, entry.UserID, code)
+			served++
+			continue
+		}
+		served++
+		if entry.Status == domain.WaitlistReserved {
+			s.statusOf(sale).IncrementSuccessfulCheckouts()
+			s.statusOf(sale).AddScheduledGoods(uint64(entry.Quantity))
+			log.Printf("Sale %d: reserved %d of %s for waitlisted user %s", sale.ID, entry.Quantity, itemID, entry.UserID)
+		}
+	}
+	return served, nil
+}
+
+// notifyWaitlistEntries tells the users of served entries about their reservation. Failed
+// notifications are retried on the next poll.
+func (s *FlashSaleService) notifyWaitlistEntries(ctx context.Context) {
+	if s.notifier == nil {
+		return
+	}
+	entries, err := s.pgRepo.ListWaitlistEntriesToNotify(ctx, waitlistBatchSize)
+	if err != nil {
+		log.Printf("Listing waitlist entries to notify failed: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		err := s.notifier.Notify(ctx, Notification{
+			Kind:    NotificationWaitlistReserved,
+			UserID:  entry.UserID,
+			SaleID:  entry.SaleID,
+			Code:    entry.Code,
+			Message: fmt.Sprintf("%d of %s you waited for are reserved for you. Purchase them with your reservation code before it expires.", entry.Quantity, entry.ItemID),
+		})
+		if err != nil {
+			log.Printf("Notifying user %s of waitlist entry %d failed: %v", entry.UserID, entry.ID, err)
+			continue
+		}
+		if err := s.pgRepo.MarkWaitlistEntryNotified(ctx, entry.ID); err != nil {
+			log.Printf("Recording notification of waitlist entry %d failed: %v", entry.ID, err)
+		}
+	}
+}
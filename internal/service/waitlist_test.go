@@ -0,0 +1,146 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"flash/internal/domain"
+	"flash/internal/service"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func (r *checkoutRepo) JoinWaitlist(ctx context.Context, saleID int64, itemID, userID string, quantity int) (*domain.WaitlistEntry, error) {
+	position := 1
+	for _, entry := range r.waitlist {
+		if entry.Status != domain.WaitlistWaiting || entry.ItemID != itemID {
+			continue
+		}
+		if entry.UserID == userID {
+			return nil, domain.ErrAlreadyWaitlisted
+		}
+		position++
+	}
+	entry := &domain.WaitlistEntry{ID: int64(len(r.waitlist) + 1), SaleID: saleID, ItemID: itemID, UserID: userID,
+		Quantity: quantity, Status: domain.WaitlistWaiting, Position: position}
+	r.waitlist = append(r.waitlist, entry)
+	return entry, nil
+}
+
+func (r *checkoutRepo) LeaveWaitlist(ctx context.Context, saleID int64, itemID, userID string) error {
+	for _, entry := range r.waitlist {
+		if entry.Status == domain.WaitlistWaiting && entry.ItemID == itemID && entry.UserID == userID {
+			entry.Status = domain.WaitlistLeft
+			return nil
+		}
+	}
+	return domain.ErrNotWaitlisted
+}
+
+func (r *checkoutRepo) CountWaitlisted(ctx context.Context, saleID int64) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, entry := range r.waitlist {
+		// Items nobody waits for any more are counted too, so they are released
+		count := counts[entry.ItemID]
+		if entry.Status == domain.WaitlistWaiting {
+			count++
+		}
+		counts[entry.ItemID] = count
+	}
+	return counts, nil
+}
+
+// expireReservations makes every reservation of the test sale expire, as if its time had run out.
+func expireReservations(t *testing.T, server *miniredis.Miniredis) {
+	t.Helper()
+	key := testPrefix + "reservations:global"
+	codes, err := server.ZMembers(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range codes {
+		if _, err := server.ZAdd(key, 1, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func joinWaitlist(svc *service.FlashSaleService, userID string) (*domain.WaitlistEntry, error) {
+	return svc.JoinWaitlist(context.Background(), 1, userID, "", "sneaker-42", 1)
+}
+
+// TestWaitlistHoldsBackFreedUnits checks that units coming free while users wait for an item are
+// kept from every other checkout, and that the waitlist is open to anyone while they are.
+func TestWaitlistHoldsBackFreedUnits(t *testing.T) {
+	svc, server := newCheckoutService(t, 0, 2)
+
+	if _, err := joinWaitlist(svc, "bob"); !errors.Is(err, domain.ErrItemAvailable) {
+		t.Fatalf("joining the waitlist of an available item error = %v, want %v", err, domain.ErrItemAvailable)
+	}
+	for i := 0; i < 2; i++ {
+		if err := checkout(svc, "alice", ""); err != nil {
+			t.Fatalf("checkout %d error = %v", i+1, err)
+		}
+	}
+	if err := checkout(svc, "carol", ""); !errors.Is(err, domain.ErrOutOfStock) {
+		t.Fatalf("checkout of a sold item error = %v, want %v", err, domain.ErrOutOfStock)
+	}
+	for i, user := range []string{"bob", "carol"} {
+		entry, err := joinWaitlist(svc, user)
+		if err != nil {
+			t.Fatalf("JoinWaitlist(%s) error = %v", user, err)
+		}
+		if entry.Position != i+1 {
+			t.Errorf("%s joined the waitlist at position %d, want %d", user, entry.Position, i+1)
+		}
+	}
+	if got, _ := server.Get(testPrefix + "waitlisted:sneaker-42"); got != "2" {
+		t.Errorf("item is held back for %q users, want 2", got)
+	}
+
+	expireReservations(t, server)
+	if err := checkout(svc, "dave", ""); !errors.Is(err, domain.ErrOutOfStock) {
+		t.Fatalf("checkout of a waitlisted item error = %v, want %v", err, domain.ErrOutOfStock)
+	}
+	if got, _ := server.Get(testPrefix + "stock:sneaker-42"); got != "2" {
+		t.Errorf("stock = %q after the reservations expired, want 2", got)
+	}
+	// The freed units cannot be bought by dave, so dave may wait for them too
+	if _, err := joinWaitlist(svc, "dave"); err != nil {
+		t.Errorf("joining the waitlist of a held back item error = %v", err)
+	}
+}
+
+// TestWaitlistReleasesItemWhenEmpty checks that an item is kept for its waitlist until the last
+// user waiting for it leaves, and is for sale to everyone from then on.
+func TestWaitlistReleasesItemWhenEmpty(t *testing.T) {
+	svc, server := newCheckoutService(t, 0, 1)
+
+	if err := checkout(svc, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"bob", "carol"} {
+		if _, err := joinWaitlist(svc, user); err != nil {
+			t.Fatalf("JoinWaitlist(%s) error = %v", user, err)
+		}
+	}
+	expireReservations(t, server)
+
+	if err := svc.LeaveWaitlist(context.Background(), 1, "bob", "sneaker-42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout(svc, "dave", ""); !errors.Is(err, domain.ErrOutOfStock) {
+		t.Fatalf("checkout while carol waits error = %v, want %v", err, domain.ErrOutOfStock)
+	}
+
+	if err := svc.LeaveWaitlist(context.Background(), 1, "carol", "sneaker-42"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(testPrefix + "waitlisted:sneaker-42") {
+		t.Error("item is still held back after its waitlist emptied")
+	}
+	if err := checkout(svc, "dave", ""); err != nil {
+		t.Errorf("checkout after the waitlist emptied error = %v", err)
+	}
+}